@@ -0,0 +1,105 @@
+package account
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Outcomes of a login attempt.
+const (
+	LoginSucceeded   = "success"
+	LoginUnknownUser = "unknown_email"
+	LoginBadPassword = "bad_password"
+	LoginThrottled   = "throttled"
+	// The password was right and a second factor was asked for
+	LoginTwoFactorPending = "2fa_pending"
+	LoginBadCode          = "bad_2fa_code"
+)
+
+// LoginAttempt is one try at logging in, kept for admins to review.
+type LoginAttempt struct {
+	ID        int64     `json:"id"`
+	Email     string    `json:"email"`
+	UserID    *int      `json:"userId"`
+	IPAddress string    `json:"ipAddress"`
+	UserAgent string    `json:"userAgent"`
+	Outcome   string    `json:"outcome"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Querier is satisfied by *pgxpool.Pool and pgx.Tx.
+type Querier interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+// RecordLoginAttempt stores an attempt.
+func RecordLoginAttempt(ctx context.Context, db DB, a LoginAttempt) error {
+	_, err := db.Exec(ctx, `
+		INSERT INTO login_attempts (email, user_id, ip_address, user_agent, outcome) VALUES ($1, $2, $3, $4, $5)`,
+		a.Email, a.UserID, a.IPAddress, a.UserAgent, a.Outcome)
+	return err
+}
+
+// AttemptFilter narrows a listing of login attempts. Zero values match everything.
+type AttemptFilter struct {
+	Email     string
+	IPAddress string
+	Outcome   string
+	From, To  time.Time
+	Limit     int
+}
+
+// LoginAttempts lists attempts, newest first.
+func LoginAttempts(ctx context.Context, db Querier, f AttemptFilter) ([]LoginAttempt, error) {
+	if f.Limit <= 0 {
+		f.Limit = 50
+	}
+	query := `SELECT id, email, user_id, ip_address, user_agent, outcome, created_at FROM login_attempts WHERE true`
+	var args []any
+	add := func(clause string, arg any) {
+		args = append(args, arg)
+		query += fmt.Sprintf(" AND "+clause, len(args))
+	}
+	if f.Email != "" {
+		add("email = $%d", f.Email)
+	}
+	if f.IPAddress != "" {
+		add("ip_address = $%d", f.IPAddress)
+	}
+	if f.Outcome != "" {
+		add("outcome = $%d", f.Outcome)
+	}
+	if !f.From.IsZero() {
+		add("created_at >= $%d", f.From)
+	}
+	if !f.To.IsZero() {
+		add("created_at <= $%d", f.To)
+	}
+	args = append(args, f.Limit)
+	query += fmt.Sprintf(" ORDER BY created_at DESC LIMIT $%d", len(args))
+
+	rows, err := db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts := make([]LoginAttempt, 0)
+	for rows.Next() {
+		var a LoginAttempt
+		if err := rows.Scan(&a.ID, &a.Email, &a.UserID, &a.IPAddress, &a.UserAgent, &a.Outcome, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
+
+// PurgeLoginAttempts deletes attempts made before cutoff.
+func PurgeLoginAttempts(ctx context.Context, db DB, cutoff time.Time) (int64, error) {
+	tag, err := db.Exec(ctx, `DELETE FROM login_attempts WHERE created_at < $1`, cutoff)
+	return tag.RowsAffected(), err
+}
@@ -0,0 +1,129 @@
+// Package account handles the parts of a user account beyond the password:
+// resets and verification proved by email, login attempts, and two-factor
+// authentication.
+package account
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/Zeropeepo/sea-catering-backend/session"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var (
+	ErrUnknownEmail = errors.New("no account with that email")
+	ErrInvalidToken = errors.New("reset link is invalid or has expired")
+)
+
+var resetTTL = 30 * time.Minute
+
+// SetResetLifetime changes how long a password reset link works.
+func SetResetLifetime(d time.Duration) {
+	resetTTL = d
+}
+
+// DB is satisfied by *pgxpool.Pool and pgx.Tx.
+type DB interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// TxDB is satisfied by *pgxpool.Pool.
+type TxDB interface {
+	DB
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+// User is who a reset link is sent to.
+type User struct {
+	ID       int
+	FullName string
+	Email    string
+}
+
+// RequestReset creates a reset token for the account with email. Only the
+// newest token works; asking again replaces the previous link.
+func RequestReset(ctx context.Context, db DB, email, ip string) (User, string, error) {
+	var u User
+	err := db.QueryRow(ctx, `SELECT id, full_name, email FROM users WHERE email = $1`, email).Scan(&u.ID, &u.FullName, &u.Email)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return u, "", ErrUnknownEmail
+	}
+	if err != nil {
+		return u, "", err
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return u, "", err
+	}
+	if _, err := db.Exec(ctx, `UPDATE password_reset_tokens SET used_at = now() WHERE user_id = $1 AND used_at IS NULL`, u.ID); err != nil {
+		return u, "", err
+	}
+	_, err = db.Exec(ctx, `INSERT INTO password_reset_tokens (user_id, token_hash, expires_at, requested_ip) VALUES ($1, $2, $3, $4)`,
+		u.ID, hash(token), time.Now().Add(resetTTL), ip)
+	return u, token, err
+}
+
+// ResetPassword uses a reset token to set a new password hash. Every
+// session of the user is revoked, so whoever knew the old password is
+// logged out too.
+func ResetPassword(ctx context.Context, db TxDB, token, passwordHash string) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var (
+		tokenID   int64
+		userID    int
+		expiresAt time.Time
+		usedAt    *time.Time
+	)
+	err = tx.QueryRow(ctx, `
+		SELECT id, user_id, expires_at, used_at FROM password_reset_tokens
+		WHERE token_hash = $1 FOR UPDATE`, hash(token)).Scan(&tokenID, &userID, &expiresAt, &usedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrInvalidToken
+	}
+	if err != nil {
+		return err
+	}
+	if usedAt != nil || time.Now().After(expiresAt) {
+		return ErrInvalidToken
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE password_reset_tokens SET used_at = now() WHERE id = $1`, tokenID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `UPDATE users SET password_hash = $2, updated_at = now() WHERE id = $1`, userID, passwordHash); err != nil {
+		return err
+	}
+	if _, err := session.RevokeAll(ctx, tx, userID, session.RevokedPasswordReset); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// Tokens are only stored hashed, so a copy of the table cannot be used to
+// take over an account.
+func hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
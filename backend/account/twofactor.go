@@ -0,0 +1,399 @@
+package account
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/Zeropeepo/sea-catering-backend/totp"
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	ErrTwoFactorEnabled    = errors.New("two-factor authentication is already on")
+	ErrTwoFactorNotEnabled = errors.New("two-factor authentication is not on")
+	ErrNoEnrollment        = errors.New("start two-factor setup first")
+	ErrInvalidCode         = errors.New("invalid authentication code")
+	ErrInvalidChallenge    = errors.New("login challenge is invalid or has expired; please log in again")
+	ErrEnrollmentDisabled  = errors.New("two-factor setup is unavailable until the server has a TWO_FACTOR_KEY")
+)
+
+const (
+	totpIssuer = "SEA Catering"
+	// One step either side covers a phone clock that is a little off
+	totpSkew          = 1
+	recoveryCodeCount = 10
+	challengeTTL      = 5 * time.Minute
+	challengeMaxTries = 5
+)
+
+// TOTP secrets have to be read back to check codes, so unlike tokens they
+// cannot be hashed; they are sealed with AES-GCM under this key instead.
+// New secrets are only sealed under a key of their own.
+var (
+	secretKey  [32]byte
+	enrollable bool
+)
+
+// SetSecretKey sets the key TOTP secrets are sealed with. Changing it
+// makes every enrolled authenticator useless.
+func SetSecretKey(key string) {
+	secretKey = sha256.Sum256([]byte(key))
+	enrollable = true
+}
+
+// SetFallbackSecretKey opens secrets sealed before the two-factor key was
+// configured, when JWT_SECRET was used, but refuses new enrollments: they
+// would be lost the next time JWT_SECRET is rotated.
+func SetFallbackSecretKey(key string) {
+	secretKey = sha256.Sum256([]byte(key))
+	enrollable = false
+}
+
+// CanEnroll reports whether users can set up two-factor authentication.
+func CanEnroll() bool {
+	return enrollable
+}
+
+// StartEnrollment gives the user a new TOTP secret to add to their
+// authenticator app. It does nothing until confirmed with a code; starting
+// again replaces the pending secret.
+func StartEnrollment(ctx context.Context, db DB, userID int) (secret, uri string, err error) {
+	if !enrollable {
+		return "", "", ErrEnrollmentDisabled
+	}
+	var (
+		email     string
+		enabledAt *time.Time
+	)
+	err = db.QueryRow(ctx, `SELECT email, totp_enabled_at FROM users WHERE id = $1`, userID).Scan(&email, &enabledAt)
+	if err != nil {
+		return "", "", err
+	}
+	if enabledAt != nil {
+		return "", "", ErrTwoFactorEnabled
+	}
+
+	if secret, err = totp.NewSecret(); err != nil {
+		return "", "", err
+	}
+	sealed, err := seal(secret)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := db.Exec(ctx, `UPDATE users SET totp_secret = $2, totp_last_step = NULL, updated_at = now() WHERE id = $1`, userID, sealed); err != nil {
+		return "", "", err
+	}
+	return secret, totp.URI(totpIssuer, email, secret), nil
+}
+
+// ConfirmEnrollment turns two-factor authentication on once the user shows
+// a code from the pending secret, and returns their recovery codes. The
+// codes are only stored hashed, so this is the one time they can be shown.
+func ConfirmEnrollment(ctx context.Context, db TxDB, userID int, code string) ([]string, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var (
+		sealed    *string
+		enabledAt *time.Time
+	)
+	err = tx.QueryRow(ctx, `SELECT totp_secret, totp_enabled_at FROM users WHERE id = $1 FOR UPDATE`, userID).Scan(&sealed, &enabledAt)
+	if err != nil {
+		return nil, err
+	}
+	if enabledAt != nil {
+		return nil, ErrTwoFactorEnabled
+	}
+	if sealed == nil {
+		return nil, ErrNoEnrollment
+	}
+	secret, err := open(*sealed)
+	if err != nil {
+		return nil, err
+	}
+	step, ok := totp.Verify(secret, code, time.Now(), totpSkew)
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE users SET totp_enabled_at = now(), totp_last_step = $2, updated_at = now() WHERE id = $1`, userID, step); err != nil {
+		return nil, err
+	}
+	codes, err := replaceRecoveryCodes(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit(ctx)
+}
+
+// DisableTwoFactor turns two-factor authentication off, given a current
+// code or an unused recovery code.
+func DisableTwoFactor(ctx context.Context, db TxDB, userID int, code string) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := checkSecondFactor(ctx, tx, userID, code, true); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `
+		UPDATE users SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = NULL, updated_at = now()
+		WHERE id = $1`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes, given a code from the
+// authenticator app.
+func RegenerateRecoveryCodes(ctx context.Context, db TxDB, userID int, code string) ([]string, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := checkSecondFactor(ctx, tx, userID, code, false); err != nil {
+		return nil, err
+	}
+	codes, err := replaceRecoveryCodes(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit(ctx)
+}
+
+// TwoFactorStatus is what a user sees of their own two-factor setup.
+type TwoFactorStatus struct {
+	Enabled           bool `json:"enabled"`
+	RecoveryCodesLeft int  `json:"recoveryCodesLeft"`
+	// Required is set when the user's role must use two-factor authentication
+	Required bool `json:"required"`
+}
+
+func TwoFactor(ctx context.Context, db DB, userID int) (TwoFactorStatus, error) {
+	var s TwoFactorStatus
+	err := db.QueryRow(ctx, `
+		SELECT u.totp_enabled_at IS NOT NULL,
+			(SELECT COUNT(*) FROM recovery_codes r WHERE r.user_id = u.id AND r.used_at IS NULL),
+			u.role = 'admin' AND COALESCE((SELECT require_admin_two_factor FROM security_settings), false)
+		FROM users u WHERE u.id = $1`, userID).Scan(&s.Enabled, &s.RecoveryCodesLeft, &s.Required)
+	return s, err
+}
+
+// StartChallenge is the first step of logging in with two-factor
+// authentication: the password was right, and the returned challenge
+// stands in for it while the user fetches a code.
+func StartChallenge(ctx context.Context, db DB, userID int, ip string) (string, error) {
+	challenge, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	_, err = db.Exec(ctx, `INSERT INTO two_factor_challenges (user_id, token_hash, expires_at, ip_address) VALUES ($1, $2, $3, $4)`,
+		userID, hash(challenge), time.Now().Add(challengeTTL), ip)
+	return challenge, err
+}
+
+// CompleteChallenge is the second step: a code from the authenticator app,
+// or an unused recovery code, finishes the login. A challenge works once and
+// allows a few wrong codes before the password has to be entered again. The
+// user is returned even when the code is wrong, so the attempt can be logged.
+func CompleteChallenge(ctx context.Context, db TxDB, challenge, code string) (User, error) {
+	var u User
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return u, err
+	}
+	defer tx.Rollback(ctx)
+
+	var (
+		challengeID int64
+		expiresAt   time.Time
+		usedAt      *time.Time
+		tries       int
+	)
+	err = tx.QueryRow(ctx, `
+		SELECT c.id, c.expires_at, c.used_at, c.failed_attempts, u.id, u.full_name, u.email
+		FROM two_factor_challenges c JOIN users u ON u.id = c.user_id
+		WHERE c.token_hash = $1 FOR UPDATE OF c`, hash(challenge)).Scan(&challengeID, &expiresAt, &usedAt, &tries, &u.ID, &u.FullName, &u.Email)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return u, ErrInvalidChallenge
+	}
+	if err != nil {
+		return u, err
+	}
+	if usedAt != nil || tries >= challengeMaxTries || time.Now().After(expiresAt) {
+		return u, ErrInvalidChallenge
+	}
+
+	err = checkSecondFactor(ctx, tx, u.ID, code, true)
+	if errors.Is(err, ErrInvalidCode) {
+		if _, err := tx.Exec(ctx, `UPDATE two_factor_challenges SET failed_attempts = failed_attempts + 1 WHERE id = $1`, challengeID); err != nil {
+			return u, err
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return u, err
+		}
+		return u, ErrInvalidCode
+	}
+	if err != nil {
+		return u, err
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE two_factor_challenges SET used_at = now() WHERE id = $1`, challengeID); err != nil {
+		return u, err
+	}
+	return u, tx.Commit(ctx)
+}
+
+// PurgeChallenges deletes challenges that can no longer be used.
+func PurgeChallenges(ctx context.Context, db DB) (int64, error) {
+	tag, err := db.Exec(ctx, `DELETE FROM two_factor_challenges WHERE expires_at < now() - interval '1 day'`)
+	return tag.RowsAffected(), err
+}
+
+// SecuritySettings are the site-wide security switches admins control.
+type SecuritySettings struct {
+	RequireAdminTwoFactor bool       `json:"requireAdminTwoFactor"`
+	UpdatedAt             *time.Time `json:"updatedAt"`
+	UpdatedBy             *int       `json:"updatedBy"`
+}
+
+func GetSecuritySettings(ctx context.Context, db DB) (SecuritySettings, error) {
+	var s SecuritySettings
+	err := db.QueryRow(ctx, `SELECT require_admin_two_factor, updated_at, updated_by FROM security_settings`).
+		Scan(&s.RequireAdminTwoFactor, &s.UpdatedAt, &s.UpdatedBy)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return s, nil
+	}
+	return s, err
+}
+
+func UpdateSecuritySettings(ctx context.Context, db DB, s SecuritySettings, adminID int) (SecuritySettings, error) {
+	err := db.QueryRow(ctx, `
+		INSERT INTO security_settings (id, require_admin_two_factor, updated_at, updated_by) VALUES (true, $1, now(), $2)
+		ON CONFLICT (id) DO UPDATE SET require_admin_two_factor = EXCLUDED.require_admin_two_factor,
+			updated_at = EXCLUDED.updated_at, updated_by = EXCLUDED.updated_by
+		RETURNING require_admin_two_factor, updated_at, updated_by`, s.RequireAdminTwoFactor, adminID).
+		Scan(&s.RequireAdminTwoFactor, &s.UpdatedAt, &s.UpdatedBy)
+	return s, err
+}
+
+// checkSecondFactor accepts a code from the authenticator app, which must be
+// newer than the last one used so a code seen over someone's shoulder
+// cannot be replayed, or, if allowRecovery, an unused recovery code, which
+// is then used up.
+func checkSecondFactor(ctx context.Context, tx pgx.Tx, userID int, code string, allowRecovery bool) error {
+	var (
+		sealed    *string
+		enabledAt *time.Time
+		lastStep  *int64
+	)
+	err := tx.QueryRow(ctx, `SELECT totp_secret, totp_enabled_at, totp_last_step FROM users WHERE id = $1 FOR UPDATE`, userID).
+		Scan(&sealed, &enabledAt, &lastStep)
+	if err != nil {
+		return err
+	}
+	if enabledAt == nil || sealed == nil {
+		return ErrTwoFactorNotEnabled
+	}
+
+	secret, err := open(*sealed)
+	if err != nil {
+		return err
+	}
+	if step, ok := totp.Verify(secret, code, time.Now(), totpSkew); ok && (lastStep == nil || step > *lastStep) {
+		_, err := tx.Exec(ctx, `UPDATE users SET totp_last_step = $2 WHERE id = $1`, userID, step)
+		return err
+	}
+
+	if allowRecovery {
+		tag, err := tx.Exec(ctx, `
+			UPDATE recovery_codes SET used_at = now()
+			WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`, userID, hash(normalizeRecoveryCode(code)))
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 1 {
+			return nil
+		}
+	}
+	return ErrInvalidCode
+}
+
+// Recovery codes look like ABCD-EFGH-IJKL-MNOP; the dashes and case are
+// ignored when one is typed back.
+func replaceRecoveryCodes(ctx context.Context, tx pgx.Tx, userID int) ([]string, error) {
+	if _, err := tx.Exec(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return nil, err
+	}
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		raw := base32.StdEncoding.EncodeToString(b)
+		codes[i] = raw[0:4] + "-" + raw[4:8] + "-" + raw[8:12] + "-" + raw[12:16]
+		if _, err := tx.Exec(ctx, `INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)`, userID, hash(raw)); err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+func seal(secret string) (string, error) {
+	gcm, err := newGCM()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(secret), nil)), nil
+}
+
+func open(sealed string) (string, error) {
+	gcm, err := newGCM()
+	if err != nil {
+		return "", err
+	}
+	b, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(b) < gcm.NonceSize() {
+		return "", errors.New("malformed totp secret")
+	}
+	secret, err := gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("totp secret cannot be opened; was the two-factor key changed?")
+	}
+	return string(secret), nil
+}
+
+func newGCM() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(secretKey[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
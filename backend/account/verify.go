@@ -0,0 +1,117 @@
+package account
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	ErrAlreadyVerified    = errors.New("email address is already verified")
+	ErrResendTooSoon      = errors.New("a verification email was sent recently; please wait before asking again")
+	ErrInvalidVerifyToken = errors.New("verification link is invalid or has expired")
+)
+
+// Resends are limited per user so the endpoint cannot be used to flood an inbox.
+const (
+	resendInterval = time.Minute
+	resendPerHour  = 5
+)
+
+var verifyTTL = 48 * time.Hour
+
+// SetVerificationLifetime changes how long an email verification link works.
+func SetVerificationLifetime(d time.Duration) {
+	verifyTTL = d
+}
+
+// StartVerification creates a verification token for a user who has just
+// registered. Only the newest token works.
+func StartVerification(ctx context.Context, db DB, userID int) (User, string, error) {
+	var (
+		u          User
+		verifiedAt *time.Time
+	)
+	err := db.QueryRow(ctx, `SELECT id, full_name, email, email_verified_at FROM users WHERE id = $1`, userID).
+		Scan(&u.ID, &u.FullName, &u.Email, &verifiedAt)
+	if err != nil {
+		return u, "", err
+	}
+	if verifiedAt != nil {
+		return u, "", ErrAlreadyVerified
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return u, "", err
+	}
+	if _, err := db.Exec(ctx, `UPDATE email_verification_tokens SET used_at = now() WHERE user_id = $1 AND used_at IS NULL`, u.ID); err != nil {
+		return u, "", err
+	}
+	_, err = db.Exec(ctx, `INSERT INTO email_verification_tokens (user_id, token_hash, expires_at) VALUES ($1, $2, $3)`,
+		u.ID, hash(token), time.Now().Add(verifyTTL))
+	return u, token, err
+}
+
+// ResendVerification is StartVerification for a user asking again, at most
+// once a minute and a few times an hour.
+func ResendVerification(ctx context.Context, db DB, userID int) (User, string, error) {
+	var lastMinute, lastHour int
+	err := db.QueryRow(ctx, `
+		SELECT count(*) FILTER (WHERE created_at > $2), count(*) FILTER (WHERE created_at > $3)
+		FROM email_verification_tokens WHERE user_id = $1`,
+		userID, time.Now().Add(-resendInterval), time.Now().Add(-time.Hour)).Scan(&lastMinute, &lastHour)
+	if err != nil {
+		return User{}, "", err
+	}
+	if lastMinute > 0 || lastHour >= resendPerHour {
+		return User{}, "", ErrResendTooSoon
+	}
+	return StartVerification(ctx, db, userID)
+}
+
+// VerifyEmail marks the email of a token's user as verified.
+func VerifyEmail(ctx context.Context, db TxDB, token string) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var (
+		tokenID   int64
+		userID    int
+		expiresAt time.Time
+		usedAt    *time.Time
+	)
+	err = tx.QueryRow(ctx, `
+		SELECT id, user_id, expires_at, used_at FROM email_verification_tokens
+		WHERE token_hash = $1 FOR UPDATE`, hash(token)).Scan(&tokenID, &userID, &expiresAt, &usedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrInvalidVerifyToken
+	}
+	if err != nil {
+		return err
+	}
+	if usedAt != nil || time.Now().After(expiresAt) {
+		return ErrInvalidVerifyToken
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE email_verification_tokens SET used_at = now() WHERE id = $1`, tokenID); err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `UPDATE users SET email_verified_at = now(), updated_at = now() WHERE id = $1 AND email_verified_at IS NULL`, userID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// EmailVerified reports whether a user has verified their email address.
+func EmailVerified(ctx context.Context, db DB, userID int) (bool, error) {
+	var verified bool
+	err := db.QueryRow(ctx, `SELECT email_verified_at IS NOT NULL FROM users WHERE id = $1`, userID).Scan(&verified)
+	return verified, err
+}
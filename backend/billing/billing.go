@@ -0,0 +1,314 @@
+// Package billing charges subscriptions month by month. Each billing period
+// gets a payment order at the gateway; the webhook marks the period paid.
+package billing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Zeropeepo/sea-catering-backend/delivery"
+	"github.com/Zeropeepo/sea-catering-backend/gateway"
+	"github.com/Zeropeepo/sea-catering-backend/ledger"
+	"github.com/Zeropeepo/sea-catering-backend/lifecycle"
+	"github.com/Zeropeepo/sea-catering-backend/pricing"
+	"github.com/Zeropeepo/sea-catering-backend/promo"
+	"github.com/jackc/pgx/v5"
+)
+
+// ErrNothingDue means the subscription has no period waiting for payment.
+var ErrNothingDue = errors.New("nothing to pay for")
+
+// Checkout is a payment order ready for the customer to complete.
+type Checkout struct {
+	OrderID string
+	Period  lifecycle.Period
+	Charge  gateway.Charge
+}
+
+// subscription is what billing needs to know about a subscription.
+type subscription struct {
+	id           int
+	userID       int
+	status       lifecycle.Status
+	paidFrom     *time.Time
+	paidUntil    *time.Time
+	planID       int
+	plan         pricing.Plan
+	totalPrice   float64
+	breakdown    *pricing.Quote
+	mealTypes    []string
+	deliveryDays []string
+	customer     gateway.Customer
+}
+
+func lockSubscription(ctx context.Context, tx pgx.Tx, subscriptionID int) (subscription, error) {
+	var s subscription
+	err := tx.QueryRow(ctx, `
+		SELECT s.id, s.user_id, s.status, s.current_period_start, s.current_period_end, s.plan_id, p.name, p.price_per_meal, p.meal_types,
+			s.total_price, s.price_breakdown, s.meal_types, s.delivery_days, u.full_name, u.email
+		FROM subscriptions s
+		JOIN plans p ON p.id = s.plan_id
+		JOIN users u ON u.id = s.user_id
+		WHERE s.id = $1
+		FOR UPDATE OF s`, subscriptionID).Scan(&s.id, &s.userID, &s.status, &s.paidFrom, &s.paidUntil, &s.planID, &s.plan.Name, &s.plan.PricePerMeal, &s.plan.MealTypes,
+		&s.totalPrice, &s.breakdown, &s.mealTypes, &s.deliveryDays, &s.customer.Name, &s.customer.Email)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return s, lifecycle.ErrNotFound
+	}
+	return s, err
+}
+
+// price is what the subscription costs a month: the breakdown stored when it
+// was created or last changed, so catalog and fee changes only reach new
+// quotes. Subscriptions from before breakdowns were kept pay their stored
+// total as it is.
+func (s subscription) price() pricing.Quote {
+	if s.breakdown != nil {
+		return s.breakdown.Undiscounted()
+	}
+	return pricing.Quote{
+		PlanName:  s.plan.Name,
+		Items:     []pricing.LineItem{{Code: "PLAN", Description: s.plan.Name, Amount: s.totalPrice}},
+		Subtotal:  s.totalPrice,
+		Discounts: []pricing.LineItem{},
+		Total:     s.totalPrice,
+	}
+}
+
+// openPeriod bills the period starting on start at the subscription's
+// price, less the promo code it reserved when it was created.
+func openPeriod(ctx context.Context, tx pgx.Tx, s subscription, start time.Time) (lifecycle.Period, error) {
+	quote := s.price()
+
+	redemption, code, err := promo.Reserved(ctx, tx, s.id)
+	if errors.Is(err, promo.ErrNoReservation) {
+		return lifecycle.OpenPeriod(ctx, tx, s.id, start, quote)
+	}
+	if err != nil {
+		return lifecycle.Period{}, err
+	}
+	quote = quote.WithDiscount(pricing.LineItem{
+		Code:        "PROMO",
+		Description: "Promo " + code.Code,
+		Amount:      code.Discount(quote.Subtotal),
+	})
+	period, err := lifecycle.OpenPeriod(ctx, tx, s.id, start, quote)
+	if err != nil {
+		return period, err
+	}
+	return period, promo.Attach(ctx, tx, redemption.ID, period.ID, period.Discount)
+}
+
+// StartCheckout creates a payment order for the subscription's open period.
+// A pending subscription gets its first period, starting today, opened on
+// demand. Periods fully covered by credit are marked paid without an order
+// and reported as ErrNothingDue.
+func StartCheckout(ctx context.Context, db lifecycle.DB, payments gateway.PaymentGateway, subscriptionID int) (Checkout, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return Checkout{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	s, err := lockSubscription(ctx, tx, subscriptionID)
+	if err != nil {
+		return Checkout{}, err
+	}
+	if s.status == lifecycle.Cancelled || s.status == lifecycle.Expired {
+		return Checkout{}, ErrNothingDue
+	}
+
+	period, err := lifecycle.OpenPeriodFor(ctx, tx, subscriptionID)
+	if errors.Is(err, lifecycle.ErrNoOpenPeriod) && s.status == lifecycle.Pending {
+		period, err = openPeriod(ctx, tx, s, time.Now())
+	}
+	if errors.Is(err, lifecycle.ErrNoOpenPeriod) {
+		return Checkout{}, ErrNothingDue
+	}
+	if err != nil {
+		return Checkout{}, err
+	}
+
+	if period.AmountDue() <= 0 {
+		if err := settleWithCredit(ctx, tx, s, period); err != nil {
+			return Checkout{}, err
+		}
+		return Checkout{}, ErrNothingDue
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return Checkout{}, err
+	}
+	return createOrder(ctx, db, payments, s, period)
+}
+
+// settleWithCredit pays a period entirely out of credit and commits tx.
+func settleWithCredit(ctx context.Context, tx pgx.Tx, s subscription, period lifecycle.Period) error {
+	if _, err := lifecycle.PayPeriod(ctx, tx, period.ID, nil); err != nil {
+		return err
+	}
+	if err := promo.Redeem(ctx, tx, period.ID, nil); err != nil {
+		return err
+	}
+	if s.status == lifecycle.Pending || s.status == lifecycle.PastDue || s.status == lifecycle.Suspended {
+		_, err := lifecycle.Apply(ctx, tx, lifecycle.Request{
+			SubscriptionID: s.id,
+			To:             lifecycle.Active,
+			Actor:          lifecycle.ActorBilling,
+			Reason:         fmt.Sprintf("billing period %d paid from credit", period.ID),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// createOrder records an order for the amount due on a period and asks the gateway for a charge.
+func createOrder(ctx context.Context, db ledger.DB, payments gateway.PaymentGateway, s subscription, period lifecycle.Period) (Checkout, error) {
+	orderID := fmt.Sprintf("SEACATERING-%d-%d", s.id, time.Now().Unix())
+	checkout, err := placeOrder(ctx, db, payments, s, ledger.Payment{
+		OrderID:         orderID,
+		SubscriptionID:  s.id,
+		BillingPeriodID: &period.ID,
+		UserID:          s.userID,
+		Amount:          period.AmountDue(),
+	}, periodItems(s, period))
+	if err != nil {
+		return Checkout{}, err
+	}
+	checkout.Period = period
+	return checkout, nil
+}
+
+// periodItems lists what a period's order charges for. Every line is whole
+// rupiah, so they add up to the amount due exactly as Midtrans requires.
+func periodItems(s subscription, period lifecycle.Period) []gateway.Item {
+	subscription := gateway.Item{
+		ID:    "SUB-" + strconv.Itoa(s.id),
+		Name:  fmt.Sprintf("Subscription: %s %s - %s", s.plan.Name, period.Start.Format("2 Jan"), period.End.AddDate(0, 0, -1).Format("2 Jan 2006")),
+		Price: pricing.Rupiah(period.Amount),
+		Qty:   1,
+	}
+	if period.Breakdown == nil {
+		// Billed before breakdowns were kept: the amount is all subscription
+		return appendDeductions([]gateway.Item{subscription}, period)
+	}
+
+	var items []gateway.Item
+	for _, line := range period.Breakdown.Items {
+		if line.Code == "PLAN" {
+			subscription.Price = pricing.Rupiah(line.Amount)
+			items = append(items, subscription)
+			continue
+		}
+		items = append(items, gateway.Item{ID: line.Code, Name: line.Description, Price: pricing.Rupiah(line.Amount), Qty: 1})
+	}
+	return appendDeductions(items, period)
+}
+
+func appendDeductions(items []gateway.Item, period lifecycle.Period) []gateway.Item {
+	if discount := pricing.Rupiah(period.Discount); discount > 0 {
+		items = append(items, gateway.Item{ID: "PROMO", Name: "Promo discount", Price: -discount, Qty: 1})
+	}
+	if tax := pricing.Rupiah(period.Tax); tax > 0 {
+		rate := 0.0
+		if period.Breakdown != nil {
+			rate = period.Breakdown.TaxRate
+		}
+		items = append(items, gateway.Item{ID: "TAX", Name: fmt.Sprintf("PPN %g%%", rate), Price: tax, Qty: 1})
+	}
+	if credit := pricing.Rupiah(period.CreditApplied); credit > 0 {
+		items = append(items, gateway.Item{ID: "CREDIT", Name: "Account credit", Price: -credit, Qty: 1})
+	}
+	return items
+}
+
+// placeOrder records payment and asks the gateway to charge it. The items
+// must add up to the payment amount.
+func placeOrder(ctx context.Context, db ledger.DB, payments gateway.PaymentGateway, s subscription, payment ledger.Payment, items []gateway.Item) (Checkout, error) {
+	// Record the order before asking for a token so a notification can never arrive for an unknown order
+	payment.Gateway = payments.Name()
+	if _, err := ledger.Create(ctx, db, payment); err != nil {
+		return Checkout{}, fmt.Errorf("record payment %s: %w", payment.OrderID, err)
+	}
+
+	charge, err := payments.CreateCharge(ctx, gateway.ChargeRequest{
+		OrderID:  payment.OrderID,
+		Amount:   pricing.Rupiah(payment.Amount),
+		Customer: s.customer,
+		Items:    items,
+	})
+	if err != nil {
+		if err := ledger.SetStatus(ctx, db, payment.OrderID, "failure"); err != nil {
+			fmt.Printf("Error marking payment %s as failed: %v\n", payment.OrderID, err)
+		}
+		return Checkout{}, err
+	}
+	return Checkout{OrderID: payment.OrderID, Charge: charge}, nil
+}
+
+// Renew opens the next billing period of every running subscription whose
+// current period ends within leadDays, and creates its payment order so the
+// customer can pay before service lapses. It is safe to run repeatedly.
+func Renew(ctx context.Context, db lifecycle.DB, payments gateway.PaymentGateway, leadDays int) (int, error) {
+	horizon := delivery.Day(time.Now()).AddDate(0, 0, leadDays)
+	rows, err := db.Query(ctx, `
+		SELECT s.id FROM subscriptions s
+		WHERE s.status IN ('active', 'paused') AND s.current_period_end <= $1
+			AND NOT EXISTS (
+				SELECT 1 FROM billing_periods bp
+				WHERE bp.subscription_id = s.id AND bp.period_start >= s.current_period_end
+			)`, horizon)
+	if err != nil {
+		return 0, err
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return 0, err
+	}
+
+	renewed := 0
+	var errs []error
+	for _, id := range ids {
+		if err := renew(ctx, db, payments, id); err != nil {
+			errs = append(errs, fmt.Errorf("renew subscription %d: %w", id, err))
+			continue
+		}
+		renewed++
+	}
+	return renewed, errors.Join(errs...)
+}
+
+func renew(ctx context.Context, db lifecycle.DB, payments gateway.PaymentGateway, subscriptionID int) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	s, err := lockSubscription(ctx, tx, subscriptionID)
+	if err != nil {
+		return err
+	}
+	if s.paidUntil == nil {
+		return nil
+	}
+
+	period, err := openPeriod(ctx, tx, s, *s.paidUntil)
+	if err != nil {
+		return err
+	}
+	if period.AmountDue() <= 0 {
+		return settleWithCredit(ctx, tx, s, period)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	// The period stays open if the order fails; the customer can still pay it from the dashboard
+	_, err = createOrder(ctx, db, payments, s, period)
+	return err
+}
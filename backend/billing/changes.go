@@ -0,0 +1,199 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/Zeropeepo/sea-catering-backend/delivery"
+	"github.com/Zeropeepo/sea-catering-backend/gateway"
+	"github.com/Zeropeepo/sea-catering-backend/ledger"
+	"github.com/Zeropeepo/sea-catering-backend/lifecycle"
+	"github.com/Zeropeepo/sea-catering-backend/pricing"
+)
+
+var (
+	ErrNotChangeable = errors.New("subscription cannot be changed in its current status")
+	ErrRenewalOpen   = errors.New("the next billing period is already waiting for payment")
+	ErrNoChange      = errors.New("the new selection is the same as the current one")
+)
+
+// ChangeRequest switches a subscription to another plan, meal mix or set of
+// delivery days. Plan is the catalog plan PlanID refers to.
+type ChangeRequest struct {
+	SubscriptionID int
+	UserID         int
+	PlanID         int
+	Plan           pricing.Plan
+	MealTypes      []string
+	DeliveryDays   []string
+}
+
+// ChangeResult is the recorded change and, for an upgrade, the order that
+// pays for it. The change only takes effect once that order is paid.
+type ChangeResult struct {
+	Change   lifecycle.Change
+	Checkout *Checkout
+}
+
+// Proration is the difference between two monthly prices for the part of
+// the period [start, end) that is left on today, rounded to whole rupiah.
+func Proration(oldAmount, newAmount float64, start, end, today time.Time) float64 {
+	total := end.Sub(start).Hours() / 24
+	if today.Before(start) {
+		today = start
+	}
+	left := end.Sub(today).Hours() / 24
+	if total <= 0 || left <= 0 {
+		return 0
+	}
+	return math.Round((newAmount - oldAmount) * left / total)
+}
+
+// ChangePlan changes what a subscription delivers from now on.
+//
+// A pending subscription has not paid for anything yet, so the change is
+// applied at once, its unpaid period is dropped to be repriced at checkout
+// and the order that would have paid it is cancelled. For a running subscription the rest of the paid period is
+// prorated: a downgrade is applied at once and the difference is credited
+// to the next renewal, while an upgrade waits for an order covering the
+// difference to be paid.
+func ChangePlan(ctx context.Context, db lifecycle.DB, payments gateway.PaymentGateway, req ChangeRequest) (ChangeResult, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return ChangeResult{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	s, err := lockSubscription(ctx, tx, req.SubscriptionID)
+	if err != nil {
+		return ChangeResult{}, err
+	}
+	if s.userID != req.UserID {
+		return ChangeResult{}, lifecycle.ErrNotFound
+	}
+	if s.planID == req.PlanID && sameSet(s.mealTypes, req.MealTypes) && sameSet(s.deliveryDays, req.DeliveryDays) {
+		return ChangeResult{}, ErrNoChange
+	}
+
+	quote, err := pricing.Calculate(req.Plan, req.MealTypes, req.DeliveryDays)
+	if err != nil {
+		return ChangeResult{}, err
+	}
+	change := lifecycle.Change{
+		SubscriptionID:  s.id,
+		UserID:          &req.UserID,
+		NewPlanID:       req.PlanID,
+		NewPlanName:     req.Plan.Name,
+		NewMealTypes:    req.MealTypes,
+		NewDeliveryDays: req.DeliveryDays,
+		OldAmount:       s.totalPrice,
+		NewAmount:       quote.Total,
+		NewBreakdown:    &quote,
+	}
+
+	switch s.status {
+	case lifecycle.Pending:
+		if err := lifecycle.VoidOpenPeriods(ctx, tx, s.id); err != nil {
+			return ChangeResult{}, err
+		}
+	case lifecycle.Active, lifecycle.Paused:
+		// The open period was priced with the old selection; let it be paid first
+		_, err := lifecycle.OpenPeriodFor(ctx, tx, s.id)
+		if err == nil {
+			return ChangeResult{}, ErrRenewalOpen
+		}
+		if !errors.Is(err, lifecycle.ErrNoOpenPeriod) {
+			return ChangeResult{}, err
+		}
+		if s.paidFrom != nil && s.paidUntil != nil {
+			change.Proration = Proration(s.totalPrice, quote.Total, delivery.Date(*s.paidFrom), delivery.Date(*s.paidUntil), delivery.Day(time.Now()))
+			_, change.ProrationTax = pricing.SplitTax(change.Proration, quote.TaxRate)
+		}
+	default:
+		return ChangeResult{}, ErrNotChangeable
+	}
+
+	change, err = lifecycle.RecordChange(ctx, tx, change)
+	if err != nil {
+		return ChangeResult{}, err
+	}
+	if change.Proration > 0 {
+		if err := tx.Commit(ctx); err != nil {
+			return ChangeResult{}, err
+		}
+		checkout, err := createChangeOrder(ctx, db, payments, s, change)
+		if err != nil {
+			return ChangeResult{Change: change}, err
+		}
+		return ChangeResult{Change: change, Checkout: &checkout}, nil
+	}
+
+	if change.Proration < 0 {
+		_, err := tx.Exec(ctx, `UPDATE subscriptions SET credit_balance = credit_balance + $1 WHERE id = $2`, -change.Proration, s.id)
+		if err != nil {
+			return ChangeResult{}, err
+		}
+	}
+	if _, err := lifecycle.ApplyChange(ctx, tx, change.ID, nil); err != nil {
+		return ChangeResult{}, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return ChangeResult{}, err
+	}
+	if s.status == lifecycle.Pending {
+		// The dropped period's order is still open at the gateway and must not
+		// be paid at the old price. One left open here is cancelled when the
+		// subscription expires unpaid.
+		if err := ledger.CancelOutstanding(ctx, db, s.id, payments.Cancel); err != nil {
+			fmt.Printf("Error cancelling orders of subscription %d after a plan change: %v\n", s.id, err)
+		}
+	}
+	change.Status = lifecycle.ChangeApplied
+	return ChangeResult{Change: change}, nil
+}
+
+// createChangeOrder charges the prorated difference of an upgrade, with its
+// tax on a line of its own.
+func createChangeOrder(ctx context.Context, db ledger.DB, payments gateway.PaymentGateway, s subscription, change lifecycle.Change) (Checkout, error) {
+	orderID := fmt.Sprintf("SEACATERING-%d-C%d", s.id, change.ID)
+	tax := pricing.Rupiah(change.ProrationTax)
+
+	name := "Upgrade to " + change.NewPlanName
+	if s.paidUntil != nil {
+		name += " until " + s.paidUntil.AddDate(0, 0, -1).Format("2 Jan 2006")
+	}
+	items := []gateway.Item{{
+		ID:    "CHANGE-" + strconv.FormatInt(change.ID, 10),
+		Name:  name,
+		Price: pricing.Rupiah(change.Proration) - tax,
+		Qty:   1,
+	}}
+	if tax > 0 {
+		items = append(items, gateway.Item{ID: "TAX", Name: fmt.Sprintf("PPN %g%%", change.NewBreakdown.TaxRate), Price: tax, Qty: 1})
+	}
+	return placeOrder(ctx, db, payments, s, ledger.Payment{
+		OrderID:              orderID,
+		SubscriptionID:       s.id,
+		SubscriptionChangeID: &change.ID,
+		UserID:               s.userID,
+		Amount:               change.Proration,
+	}, items)
+}
+
+// sameSet reports whether a and b hold the same values in any order.
+func sameSet(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, v := range a {
+		if !slices.Contains(b, v) {
+			return false
+		}
+	}
+	return true
+}
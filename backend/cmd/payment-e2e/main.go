@@ -0,0 +1,384 @@
+// Command payment-e2e runs payments end to end against a backend started
+// with PAYMENT_GATEWAY=fake, so nothing leaves the machine. It registers a
+// throwaway customer, and for each scenario subscribes, pays through the fake
+// gateway and checks the outcome the webhook reported and what the
+// subscription, its payments and its invoices look like afterwards.
+//
+// The customer has to be able to subscribe straight away, so run the backend
+// with REQUIRE_EMAIL_VERIFICATION=false. The command exits non-zero if any
+// scenario fails.
+//
+//	go run ./cmd/payment-e2e -url http://localhost:8080
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"time"
+)
+
+type plan struct {
+	Name      string   `json:"name"`
+	MealTypes []string `json:"mealTypes"`
+}
+
+type subscription struct {
+	ID     int    `json:"id"`
+	Status string `json:"status"`
+}
+
+type payment struct {
+	OrderID       string `json:"orderId"`
+	GatewayStatus string `json:"gatewayStatus"`
+}
+
+type period struct {
+	Status string `json:"status"`
+}
+
+type invoice struct {
+	OrderID string `json:"orderId"`
+}
+
+type scenario struct {
+	name string
+	run  func(c *client, p plan) error
+}
+
+var scenarios = []scenario{
+	{"settlement activates a pending subscription", settlementActivates},
+	{"card capture then settlement pays once", captureThenSettlement},
+	{"a repeated settlement is a duplicate", duplicateSettlement},
+	{"an expired order can be paid again", expiredThenPaid},
+	{"a denied payment leaves the subscription pending", deniedStaysPending},
+}
+
+func main() {
+	base := flag.String("url", "http://localhost:8080", "backend base URL")
+	flag.Parse()
+
+	c, err := newClient(*base)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "setup: %v\n", err)
+		os.Exit(2)
+	}
+	p, err := c.signUp()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "setup: %v\n", err)
+		os.Exit(2)
+	}
+
+	failed := 0
+	for _, s := range scenarios {
+		if err := s.run(c, p); err != nil {
+			failed++
+			fmt.Printf("FAIL %s: %v\n", s.name, err)
+			continue
+		}
+		fmt.Printf("ok   %s\n", s.name)
+	}
+
+	fmt.Printf("%d of %d scenarios passed\n", len(scenarios)-failed, len(scenarios))
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func settlementActivates(c *client, p plan) error {
+	id, order, err := c.subscribeAndPay(p)
+	if err != nil {
+		return err
+	}
+	if err := c.expectOutcome(order, "settlement", "applied"); err != nil {
+		return err
+	}
+	if err := c.expectStatus(id, "active"); err != nil {
+		return err
+	}
+	if err := c.expectPayment(id, order, "settlement"); err != nil {
+		return err
+	}
+	return c.expectInvoice(order)
+}
+
+func captureThenSettlement(c *client, p plan) error {
+	id, order, err := c.subscribeAndPay(p)
+	if err != nil {
+		return err
+	}
+	if err := c.expectOutcome(order, "capture", "applied"); err != nil {
+		return err
+	}
+	if err := c.expectStatus(id, "active"); err != nil {
+		return err
+	}
+	if err := c.expectOutcome(order, "settlement", "applied"); err != nil {
+		return err
+	}
+	if err := c.expectPayment(id, order, "settlement"); err != nil {
+		return err
+	}
+	return c.expectPaidPeriods(id, 1)
+}
+
+func duplicateSettlement(c *client, p plan) error {
+	id, order, err := c.subscribeAndPay(p)
+	if err != nil {
+		return err
+	}
+	if err := c.expectOutcome(order, "settlement", "applied"); err != nil {
+		return err
+	}
+	if err := c.expectOutcome(order, "settlement", "duplicate"); err != nil {
+		return err
+	}
+	return c.expectPaidPeriods(id, 1)
+}
+
+func expiredThenPaid(c *client, p plan) error {
+	id, order, err := c.subscribeAndPay(p)
+	if err != nil {
+		return err
+	}
+	if err := c.expectOutcome(order, "expire", "applied"); err != nil {
+		return err
+	}
+	if err := c.expectStatus(id, "pending"); err != nil {
+		return err
+	}
+
+	retry, err := c.pay(id)
+	if err != nil {
+		return err
+	}
+	if retry == order {
+		return fmt.Errorf("paying again reused expired order %s", order)
+	}
+	if err := c.expectOutcome(retry, "settlement", "applied"); err != nil {
+		return err
+	}
+	if err := c.expectStatus(id, "active"); err != nil {
+		return err
+	}
+	return c.expectPayment(id, order, "expire")
+}
+
+func deniedStaysPending(c *client, p plan) error {
+	id, order, err := c.subscribeAndPay(p)
+	if err != nil {
+		return err
+	}
+	if err := c.expectOutcome(order, "deny", "applied"); err != nil {
+		return err
+	}
+	if err := c.expectStatus(id, "pending"); err != nil {
+		return err
+	}
+	return c.expectPaidPeriods(id, 0)
+}
+
+// client talks to the backend as one logged in customer. It keeps cookies so
+// it works with AUTH_MODE=cookie as well as with bearer tokens.
+type client struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+func newClient(base string) (*client, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &client{base: base, http: &http.Client{Jar: jar, Timeout: 15 * time.Second}}, nil
+}
+
+// signUp registers and logs in a new customer and picks the plan to subscribe to.
+func (c *client) signUp() (plan, error) {
+	var plans []plan
+	if err := c.call(http.MethodGet, "/api/plans", nil, &plans); err != nil {
+		return plan{}, err
+	}
+	if len(plans) == 0 {
+		return plan{}, fmt.Errorf("no active plans to subscribe to")
+	}
+
+	email := fmt.Sprintf("payment-e2e-%d@example.com", time.Now().UnixNano())
+	password := "E2e-Check-123!"
+	err := c.call(http.MethodPost, "/api/register", map[string]string{"fullname": "Payment Check", "email": email, "password": password}, nil)
+	if err != nil {
+		return plan{}, fmt.Errorf("register: %w", err)
+	}
+	var login struct {
+		Token string `json:"token"`
+	}
+	if err := c.call(http.MethodPost, "/api/login", map[string]string{"email": email, "password": password}, &login); err != nil {
+		return plan{}, fmt.Errorf("login: %w", err)
+	}
+	c.token = login.Token
+	return plans[0], nil
+}
+
+func (c *client) subscribeAndPay(p plan) (int, string, error) {
+	meals := p.MealTypes
+	if len(meals) == 0 {
+		meals = []string{"Lunch"}
+	}
+	var created struct {
+		SubscriptionID int `json:"subscriptionId"`
+	}
+	err := c.call(http.MethodPost, "/api/subscribe", map[string]any{
+		"name":          "Payment Check",
+		"phone":         "081234567890",
+		"selectedPlan":  p.Name,
+		"selectedMeals": meals[:1],
+		"selectedDays":  []string{"Monday", "Wednesday", "Friday"},
+	}, &created)
+	if err != nil {
+		return 0, "", fmt.Errorf("subscribe: %w", err)
+	}
+	order, err := c.pay(created.SubscriptionID)
+	return created.SubscriptionID, order, err
+}
+
+func (c *client) pay(subscriptionID int) (string, error) {
+	var checkout struct {
+		OrderID   string `json:"orderId"`
+		SnapToken string `json:"snapToken"`
+	}
+	err := c.call(http.MethodPost, fmt.Sprintf("/api/subscriptions/%d/create-payment", subscriptionID), nil, &checkout)
+	if err != nil {
+		return "", fmt.Errorf("create payment: %w", err)
+	}
+	if checkout.OrderID == "" {
+		return "", fmt.Errorf("create payment returned no order")
+	}
+	return checkout.OrderID, nil
+}
+
+// expectOutcome moves an order to status at the fake gateway and checks what
+// the webhook made of the notification.
+func (c *client) expectOutcome(orderID, status, want string) error {
+	var result struct {
+		Outcome string `json:"outcome"`
+	}
+	err := c.call(http.MethodPost, "/api/fake-gateway/orders/"+url.PathEscape(orderID)+"/"+status, nil, &result)
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", status, orderID, err)
+	}
+	if result.Outcome != want {
+		return fmt.Errorf("%s %s: got outcome %q, want %q", status, orderID, result.Outcome, want)
+	}
+	return nil
+}
+
+func (c *client) expectStatus(subscriptionID int, want string) error {
+	var subs []subscription
+	if err := c.call(http.MethodGet, "/api/subscriptions", nil, &subs); err != nil {
+		return err
+	}
+	for _, s := range subs {
+		if s.ID == subscriptionID {
+			if s.Status != want {
+				return fmt.Errorf("subscription %d is %s, want %s", subscriptionID, s.Status, want)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("subscription %d not listed", subscriptionID)
+}
+
+func (c *client) expectPayment(subscriptionID int, orderID, want string) error {
+	var payments []payment
+	if err := c.call(http.MethodGet, fmt.Sprintf("/api/subscriptions/%d/payments", subscriptionID), nil, &payments); err != nil {
+		return err
+	}
+	for _, p := range payments {
+		if p.OrderID == orderID {
+			if p.GatewayStatus != want {
+				return fmt.Errorf("payment %s is %s, want %s", orderID, p.GatewayStatus, want)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("payment %s not listed", orderID)
+}
+
+func (c *client) expectPaidPeriods(subscriptionID, want int) error {
+	var periods []period
+	if err := c.call(http.MethodGet, fmt.Sprintf("/api/subscriptions/%d/billing-periods", subscriptionID), nil, &periods); err != nil {
+		return err
+	}
+	paid := 0
+	for _, p := range periods {
+		if p.Status == "paid" {
+			paid++
+		}
+	}
+	if paid != want {
+		return fmt.Errorf("subscription %d has %d paid periods, want %d", subscriptionID, paid, want)
+	}
+	return nil
+}
+
+func (c *client) expectInvoice(orderID string) error {
+	var invoices []invoice
+	if err := c.call(http.MethodGet, "/api/invoices", nil, &invoices); err != nil {
+		return err
+	}
+	for _, inv := range invoices {
+		if inv.OrderID == orderID {
+			return nil
+		}
+	}
+	return fmt.Errorf("no invoice for order %s", orderID)
+}
+
+// call sends body as JSON and decodes a successful response into out. Any
+// status outside 2xx is an error carrying the response body.
+func (c *client) call(method, path string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.base+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	} else if method != http.MethodGet {
+		// Cookie mode: echo the CSRF cookie back, as the frontend does
+		for _, cookie := range c.http.Jar.Cookies(req.URL) {
+			if cookie.Name == "sea_csrf" {
+				req.Header.Set("X-CSRF-Token", cookie.Value)
+			}
+		}
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s %s: HTTP %d: %s", method, path, resp.StatusCode, respBody)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(respBody, out)
+}
@@ -0,0 +1,129 @@
+// Command webhook-replay posts recorded Midtrans notifications to a running
+// backend and checks each response against the expectation stored with it.
+//
+// Each case file in the directory is replayed in name order:
+//
+//	{
+//	  "description": "settlement activates the subscription",
+//	  "expect": {"status": 200, "outcome": "applied"},
+//	  "notification": { ...payload as Midtrans sent it... }
+//	}
+//
+// Recorded payloads name orders from the environment they were captured in,
+// so -order and -amount point them at an order that exists locally. The
+// signature is then recomputed with -key. A case can opt out of any of these
+// with "keepOrder", "keepAmount" or "keepSignature" to exercise the checks
+// they would otherwise hide. The command exits non-zero if any case fails.
+//
+//	go run ./cmd/webhook-replay -order SEACATERING-12-1718000000 -amount 1032000.00
+package main
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+type testCase struct {
+	Description   string                 `json:"description"`
+	KeepOrder     bool                   `json:"keepOrder"`
+	KeepAmount    bool                   `json:"keepAmount"`
+	KeepSignature bool                   `json:"keepSignature"`
+	Notification  map[string]interface{} `json:"notification"`
+	Expect        struct {
+		Status  int    `json:"status"`
+		Outcome string `json:"outcome"`
+	} `json:"expect"`
+}
+
+func main() {
+	url := flag.String("url", "http://localhost:8080/api/midtrans/notification", "notification endpoint")
+	dir := flag.String("dir", "testdata/midtrans", "directory of recorded cases")
+	key := flag.String("key", os.Getenv("MIDTRANS_SERVER_KEY"), "server key used to re-sign payloads")
+	order := flag.String("order", "", "replace order_id in every payload")
+	amount := flag.String("amount", "", "replace gross_amount in every payload")
+	flag.Parse()
+
+	files, err := filepath.Glob(filepath.Join(*dir, "*.json"))
+	if err != nil || len(files) == 0 {
+		fmt.Fprintf(os.Stderr, "no cases found in %s\n", *dir)
+		os.Exit(2)
+	}
+	sort.Strings(files)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	failed := 0
+	for _, file := range files {
+		if err := replay(client, *url, *key, *order, *amount, file); err != nil {
+			failed++
+			fmt.Printf("FAIL %s: %v\n", filepath.Base(file), err)
+			continue
+		}
+		fmt.Printf("ok   %s\n", filepath.Base(file))
+	}
+
+	fmt.Printf("%d of %d cases passed\n", len(files)-failed, len(files))
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func replay(client *http.Client, url, key, order, amount, file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var tc testCase
+	if err := json.Unmarshal(data, &tc); err != nil {
+		return fmt.Errorf("invalid case file: %v", err)
+	}
+
+	n := tc.Notification
+	if order != "" && !tc.KeepOrder {
+		n["order_id"] = order
+	}
+	if amount != "" && !tc.KeepAmount {
+		n["gross_amount"] = amount
+	}
+	if !tc.KeepSignature {
+		orderID, _ := n["order_id"].(string)
+		statusCode, _ := n["status_code"].(string)
+		grossAmount, _ := n["gross_amount"].(string)
+		hash := sha512.Sum512([]byte(orderID + statusCode + grossAmount + key))
+		n["signature_key"] = hex.EncodeToString(hash[:])
+	}
+
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(resp.Body)
+
+	if tc.Expect.Status != 0 && resp.StatusCode != tc.Expect.Status {
+		return fmt.Errorf("%s: got HTTP %d, want %d: %s", tc.Description, resp.StatusCode, tc.Expect.Status, respBody)
+	}
+	if tc.Expect.Outcome != "" {
+		var result struct {
+			Outcome string `json:"outcome"`
+		}
+		json.Unmarshal(respBody, &result)
+		if result.Outcome != tc.Expect.Outcome {
+			return fmt.Errorf("%s: got outcome %q, want %q", tc.Description, result.Outcome, tc.Expect.Outcome)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+// Package config reads optional settings from the environment. Every helper
+// takes the default to use when the variable is unset or cannot be parsed.
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func String(key, fallback string) string {
+	if v := strings.TrimSpace(os.Getenv(key)); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func Int(key string, fallback int) int {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		fmt.Printf("Config: %s=%q is not an integer, using %d\n", key, v, fallback)
+		return fallback
+	}
+	return n
+}
+
+func Float(key string, fallback float64) float64 {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		fmt.Printf("Config: %s=%q is not a number, using %v\n", key, v, fallback)
+		return fallback
+	}
+	return f
+}
+
+func Bool(key string, fallback bool) bool {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		fmt.Printf("Config: %s=%q is not a boolean, using %v\n", key, v, fallback)
+		return fallback
+	}
+	return b
+}
+
+// Duration accepts Go duration strings such as "30m" or "24h".
+func Duration(key string, fallback time.Duration) time.Duration {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		fmt.Printf("Config: %s=%q is not a duration, using %v\n", key, v, fallback)
+		return fallback
+	}
+	return d
+}
+
+// List splits a comma separated value, dropping empty entries.
+func List(key string) []string {
+	var items []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,424 @@
+package database
+
+import (
+	"context"
+	"fmt"
+)
+
+// migrations are applied in order on startup and recorded in schema_migrations.
+// Only ever append to this list; a migration that has shipped must not change.
+var migrations = []string{
+	// 1: plans catalog
+	`CREATE TABLE IF NOT EXISTS plans (
+		id SERIAL PRIMARY KEY,
+		name character varying(100) NOT NULL UNIQUE,
+		price_per_meal numeric(10,2) NOT NULL CHECK (price_per_meal > 0),
+		description text NOT NULL DEFAULT '',
+		image_url text NOT NULL DEFAULT '',
+		details text[] NOT NULL DEFAULT '{}',
+		meal_types text[] NOT NULL DEFAULT '{Breakfast,Lunch,Dinner}',
+		is_active boolean NOT NULL DEFAULT true,
+		created_at timestamp with time zone DEFAULT now() NOT NULL,
+		updated_at timestamp with time zone DEFAULT now() NOT NULL
+	);
+	INSERT INTO plans (name, price_per_meal, description, image_url, details) VALUES
+		('Diet Plan', 30000, 'Perfectly balanced meals to help you achieve your weight goals without sacrificing flavor.', '/icons/healthy_plan.png',
+			'{"Calorie-controlled portions","High in fiber and vitamins","Low in saturated fats","Includes lean proteins and complex carbs"}'),
+		('Protein Plan', 40000, 'Fuel your fitness journey with high-protein meals designed to build muscle and aid recovery.', '/icons/protein_plan.png',
+			'{"At least 30g of protein per meal","Sourced from high-quality lean meats and fish","Includes essential amino acids for muscle repair","Great for post-workout recovery"}'),
+		('Royal Plan', 60000, 'Indulge in our premium selection of gourmet healthy meals, crafted with the finest ingredients.', '/icons/royal_plan.png',
+			'{"Features premium ingredients like salmon and steak","Complex, chef-designed flavor profiles","Organic vegetables and artisanal grains","The ultimate healthy luxury experience"}')
+	ON CONFLICT (name) DO NOTHING;
+	ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS plan_id integer REFERENCES plans(id);
+	UPDATE subscriptions s SET plan_id = p.id FROM plans p WHERE s.plan_id IS NULL AND s.plan_name = p.name;`,
+
+	// 2: subscription status history
+	`CREATE TABLE IF NOT EXISTS subscription_events (
+		id BIGSERIAL PRIMARY KEY,
+		subscription_id integer NOT NULL REFERENCES subscriptions(id) ON DELETE CASCADE,
+		old_status character varying(20),
+		new_status character varying(20) NOT NULL,
+		actor character varying(20) NOT NULL,
+		actor_user_id integer REFERENCES users(id),
+		reason text NOT NULL DEFAULT '',
+		created_at timestamp with time zone DEFAULT now() NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS subscription_events_subscription_idx ON subscription_events (subscription_id, created_at);
+	CREATE INDEX IF NOT EXISTS subscription_events_transition_idx ON subscription_events (old_status, new_status, created_at);`,
+
+	// 3: date-bounded pauses and the credit they earn
+	`ALTER TABLE subscriptions
+		ADD COLUMN IF NOT EXISTS pause_start date,
+		ADD COLUMN IF NOT EXISTS pause_end date,
+		ADD COLUMN IF NOT EXISTS credit_balance numeric(10,2) NOT NULL DEFAULT 0;
+	ALTER TABLE subscriptions ADD CONSTRAINT subscriptions_pause_window_check
+		CHECK ((pause_start IS NULL) = (pause_end IS NULL) AND (pause_end IS NULL OR pause_end >= pause_start));`,
+
+	// 4: background job run history
+	`CREATE TABLE IF NOT EXISTS job_runs (
+		id BIGSERIAL PRIMARY KEY,
+		job_name character varying(100) NOT NULL,
+		scheduled_for timestamp with time zone NOT NULL,
+		instance character varying(255) NOT NULL DEFAULT '',
+		status character varying(20) NOT NULL DEFAULT 'running',
+		error text NOT NULL DEFAULT '',
+		started_at timestamp with time zone DEFAULT now() NOT NULL,
+		finished_at timestamp with time zone,
+		UNIQUE (job_name, scheduled_for)
+	);
+	CREATE INDEX IF NOT EXISTS job_runs_started_idx ON job_runs (started_at DESC);`,
+
+	// 5: find pending subscriptions old enough to expire
+	`CREATE INDEX IF NOT EXISTS subscriptions_pending_idx ON subscriptions (created_at) WHERE status = 'pending';`,
+
+	// 6: payments ledger, replacing the single order ID the original schema kept on subscriptions
+	`CREATE TABLE IF NOT EXISTS payments (
+		id BIGSERIAL PRIMARY KEY,
+		order_id character varying(100) NOT NULL UNIQUE,
+		subscription_id integer NOT NULL REFERENCES subscriptions(id),
+		user_id integer NOT NULL REFERENCES users(id),
+		amount numeric(12,2) NOT NULL,
+		currency character(3) NOT NULL DEFAULT 'IDR',
+		gateway character varying(20) NOT NULL DEFAULT 'midtrans',
+		gateway_status character varying(30) NOT NULL DEFAULT 'created',
+		transaction_id character varying(100),
+		payment_type character varying(50),
+		raw_payload jsonb,
+		created_at timestamp with time zone DEFAULT now() NOT NULL,
+		updated_at timestamp with time zone DEFAULT now() NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS payments_subscription_idx ON payments (subscription_id, created_at DESC);
+	CREATE INDEX IF NOT EXISTS payments_created_idx ON payments (created_at DESC);
+	DO $$
+	BEGIN
+		IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'subscriptions' AND column_name = 'midtrans_order_id') THEN
+			INSERT INTO payments (order_id, subscription_id, user_id, amount)
+				SELECT midtrans_order_id, id, user_id, total_price FROM subscriptions WHERE midtrans_order_id IS NOT NULL
+				ON CONFLICT (order_id) DO NOTHING;
+			ALTER TABLE subscriptions DROP COLUMN midtrans_order_id;
+		END IF;
+	END $$;`,
+
+	// 7: every payment notification received, deduplicated per transaction and status
+	`CREATE TABLE IF NOT EXISTS payment_notifications (
+		id BIGSERIAL PRIMARY KEY,
+		order_id character varying(100) NOT NULL,
+		dedupe_key character varying(200) NOT NULL,
+		transaction_id character varying(100) NOT NULL DEFAULT '',
+		transaction_status character varying(30) NOT NULL,
+		status_code character varying(10) NOT NULL DEFAULT '',
+		fraud_status character varying(20) NOT NULL DEFAULT '',
+		gross_amount character varying(30) NOT NULL DEFAULT '',
+		outcome character varying(20) NOT NULL DEFAULT '',
+		raw_payload jsonb,
+		received_at timestamp with time zone DEFAULT now() NOT NULL,
+		UNIQUE (order_id, dedupe_key)
+	);
+	CREATE INDEX IF NOT EXISTS payment_notifications_received_idx ON payment_notifications (received_at DESC);`,
+
+	// 8: monthly billing periods; subscriptions already paid for start their first period today
+	`ALTER TABLE subscriptions
+		ADD COLUMN IF NOT EXISTS current_period_start date,
+		ADD COLUMN IF NOT EXISTS current_period_end date;
+	CREATE TABLE IF NOT EXISTS billing_periods (
+		id BIGSERIAL PRIMARY KEY,
+		subscription_id integer NOT NULL REFERENCES subscriptions(id),
+		period_start date NOT NULL,
+		period_end date NOT NULL,
+		amount numeric(12,2) NOT NULL,
+		credit_applied numeric(12,2) NOT NULL DEFAULT 0,
+		status character varying(20) NOT NULL DEFAULT 'open',
+		paid_at timestamp with time zone,
+		created_at timestamp with time zone DEFAULT now() NOT NULL,
+		UNIQUE (subscription_id, period_start),
+		CHECK (period_end > period_start)
+	);
+	CREATE INDEX IF NOT EXISTS billing_periods_paid_idx ON billing_periods (period_start, period_end) WHERE status = 'paid';
+	ALTER TABLE payments ADD COLUMN IF NOT EXISTS billing_period_id bigint REFERENCES billing_periods(id);
+	INSERT INTO billing_periods (subscription_id, period_start, period_end, amount, status, paid_at)
+		SELECT id, CURRENT_DATE, (CURRENT_DATE + interval '1 month')::date, total_price, 'paid', now()
+		FROM subscriptions WHERE status IN ('active', 'paused')
+		ON CONFLICT (subscription_id, period_start) DO NOTHING;
+	UPDATE subscriptions SET current_period_start = CURRENT_DATE, current_period_end = (CURRENT_DATE + interval '1 month')::date
+		WHERE status IN ('active', 'paused') AND current_period_end IS NULL;
+	CREATE INDEX IF NOT EXISTS subscriptions_period_end_idx ON subscriptions (current_period_end)
+		WHERE status IN ('active', 'paused', 'past_due', 'suspended');`,
+
+	// 9: refunds issued by admins, kept as the audit trail of who refunded what and why
+	`CREATE TABLE IF NOT EXISTS refunds (
+		id BIGSERIAL PRIMARY KEY,
+		payment_id bigint NOT NULL REFERENCES payments(id),
+		refund_key character varying(120) NOT NULL UNIQUE,
+		amount numeric(12,2) NOT NULL CHECK (amount > 0),
+		reason text NOT NULL,
+		status character varying(20) NOT NULL DEFAULT 'requested',
+		error text NOT NULL DEFAULT '',
+		admin_user_id integer REFERENCES users(id),
+		created_at timestamp with time zone DEFAULT now() NOT NULL,
+		updated_at timestamp with time zone DEFAULT now() NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS refunds_payment_idx ON refunds (payment_id, created_at);`,
+
+	// 10: plan, meal and day changes on running subscriptions and their proration
+	`CREATE TABLE IF NOT EXISTS subscription_changes (
+		id BIGSERIAL PRIMARY KEY,
+		subscription_id integer NOT NULL REFERENCES subscriptions(id),
+		user_id integer REFERENCES users(id),
+		old_plan_id integer REFERENCES plans(id),
+		new_plan_id integer NOT NULL REFERENCES plans(id),
+		new_plan_name character varying(100) NOT NULL,
+		old_meal_types text[] NOT NULL,
+		new_meal_types text[] NOT NULL,
+		old_delivery_days text[] NOT NULL,
+		new_delivery_days text[] NOT NULL,
+		old_amount numeric(12,2) NOT NULL,
+		new_amount numeric(12,2) NOT NULL,
+		proration numeric(12,2) NOT NULL DEFAULT 0,
+		status character varying(20) NOT NULL,
+		created_at timestamp with time zone DEFAULT now() NOT NULL,
+		applied_at timestamp with time zone
+	);
+	CREATE INDEX IF NOT EXISTS subscription_changes_subscription_idx ON subscription_changes (subscription_id, created_at DESC);
+	ALTER TABLE payments ADD COLUMN IF NOT EXISTS subscription_change_id bigint REFERENCES subscription_changes(id);`,
+
+	// 11: invoices, one per paid order, numbered without gaps within a year
+	`CREATE TABLE IF NOT EXISTS invoice_counters (
+		year integer PRIMARY KEY,
+		last_number integer NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS invoices (
+		id BIGSERIAL PRIMARY KEY,
+		number character varying(30) NOT NULL UNIQUE,
+		payment_id bigint NOT NULL UNIQUE REFERENCES payments(id),
+		subscription_id integer NOT NULL REFERENCES subscriptions(id),
+		user_id integer NOT NULL REFERENCES users(id),
+		customer_name character varying(255) NOT NULL,
+		customer_email character varying(255) NOT NULL,
+		plan_name character varying(100) NOT NULL,
+		meal_types text[] NOT NULL,
+		delivery_days text[] NOT NULL,
+		period_start date,
+		period_end date,
+		items jsonb NOT NULL,
+		subtotal numeric(12,2) NOT NULL,
+		tax numeric(12,2) NOT NULL DEFAULT 0,
+		total numeric(12,2) NOT NULL,
+		currency character(3) NOT NULL DEFAULT 'IDR',
+		issued_at timestamp with time zone DEFAULT now() NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS invoices_issued_idx ON invoices (issued_at);
+	CREATE INDEX IF NOT EXISTS invoices_user_idx ON invoices (user_id, issued_at DESC);`,
+
+	// 12: promo codes, which discount the first billing period of a new subscription
+	`CREATE TABLE IF NOT EXISTS promo_codes (
+		id SERIAL PRIMARY KEY,
+		code character varying(40) NOT NULL UNIQUE,
+		description text NOT NULL DEFAULT '',
+		kind character varying(10) NOT NULL CHECK (kind IN ('percent', 'fixed')),
+		value numeric(12,2) NOT NULL CHECK (value > 0),
+		starts_at timestamp with time zone,
+		ends_at timestamp with time zone,
+		max_redemptions integer CHECK (max_redemptions > 0),
+		max_per_user integer CHECK (max_per_user > 0),
+		plan_ids integer[] NOT NULL DEFAULT '{}',
+		first_subscription_only boolean NOT NULL DEFAULT false,
+		is_active boolean NOT NULL DEFAULT true,
+		created_at timestamp with time zone DEFAULT now() NOT NULL,
+		updated_at timestamp with time zone DEFAULT now() NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS promo_redemptions (
+		id BIGSERIAL PRIMARY KEY,
+		promo_code_id integer NOT NULL REFERENCES promo_codes(id),
+		user_id integer NOT NULL REFERENCES users(id),
+		subscription_id integer NOT NULL UNIQUE REFERENCES subscriptions(id),
+		billing_period_id bigint REFERENCES billing_periods(id),
+		payment_id bigint REFERENCES payments(id),
+		discount numeric(12,2) NOT NULL DEFAULT 0,
+		status character varying(20) NOT NULL DEFAULT 'reserved',
+		created_at timestamp with time zone DEFAULT now() NOT NULL,
+		redeemed_at timestamp with time zone
+	);
+	CREATE INDEX IF NOT EXISTS promo_redemptions_code_idx ON promo_redemptions (promo_code_id, user_id);
+	ALTER TABLE billing_periods ADD COLUMN IF NOT EXISTS discount numeric(12,2) NOT NULL DEFAULT 0;`,
+
+	// 13: price breakdowns with fees and tax; earlier rows were priced without either
+	`ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS price_breakdown jsonb;
+	ALTER TABLE billing_periods
+		ADD COLUMN IF NOT EXISTS tax numeric(12,2) NOT NULL DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS breakdown jsonb;
+	ALTER TABLE subscription_changes
+		ADD COLUMN IF NOT EXISTS new_breakdown jsonb,
+		ADD COLUMN IF NOT EXISTS proration_tax numeric(12,2) NOT NULL DEFAULT 0;
+	ALTER TABLE invoices ADD COLUMN IF NOT EXISTS tax_rate numeric(5,2) NOT NULL DEFAULT 0;`,
+
+	// 14: login sessions and their rotating refresh tokens
+	`CREATE TABLE IF NOT EXISTS sessions (
+		id BIGSERIAL PRIMARY KEY,
+		user_id integer NOT NULL REFERENCES users(id),
+		user_agent text NOT NULL DEFAULT '',
+		ip_address character varying(45) NOT NULL DEFAULT '',
+		created_at timestamp with time zone DEFAULT now() NOT NULL,
+		last_used_at timestamp with time zone DEFAULT now() NOT NULL,
+		revoked_at timestamp with time zone,
+		revoked_reason character varying(30)
+	);
+	CREATE INDEX IF NOT EXISTS sessions_user_idx ON sessions (user_id) WHERE revoked_at IS NULL;
+	CREATE TABLE IF NOT EXISTS refresh_tokens (
+		id BIGSERIAL PRIMARY KEY,
+		session_id bigint NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+		token_hash character(64) NOT NULL UNIQUE,
+		created_at timestamp with time zone DEFAULT now() NOT NULL,
+		expires_at timestamp with time zone NOT NULL,
+		replaced_at timestamp with time zone
+	);
+	CREATE INDEX IF NOT EXISTS refresh_tokens_session_idx ON refresh_tokens (session_id);`,
+
+	// 15: single-use password reset tokens
+	`CREATE TABLE IF NOT EXISTS password_reset_tokens (
+		id BIGSERIAL PRIMARY KEY,
+		user_id integer NOT NULL REFERENCES users(id),
+		token_hash character(64) NOT NULL UNIQUE,
+		requested_ip character varying(45) NOT NULL DEFAULT '',
+		created_at timestamp with time zone DEFAULT now() NOT NULL,
+		expires_at timestamp with time zone NOT NULL,
+		used_at timestamp with time zone
+	);
+	CREATE INDEX IF NOT EXISTS password_reset_tokens_user_idx ON password_reset_tokens (user_id) WHERE used_at IS NULL;`,
+
+	// 16: email verification; accounts that existed before it count as verified
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified_at timestamp with time zone;
+	UPDATE users SET email_verified_at = created_at WHERE email_verified_at IS NULL;
+	CREATE TABLE IF NOT EXISTS email_verification_tokens (
+		id BIGSERIAL PRIMARY KEY,
+		user_id integer NOT NULL REFERENCES users(id),
+		token_hash character(64) NOT NULL UNIQUE,
+		created_at timestamp with time zone DEFAULT now() NOT NULL,
+		expires_at timestamp with time zone NOT NULL,
+		used_at timestamp with time zone
+	);
+	CREATE INDEX IF NOT EXISTS email_verification_tokens_user_idx ON email_verification_tokens (user_id, created_at);`,
+
+	// 17: login attempts for admins to review, and rate limit counters shared between instances
+	`CREATE TABLE IF NOT EXISTS login_attempts (
+		id BIGSERIAL PRIMARY KEY,
+		email character varying(255) NOT NULL,
+		user_id integer REFERENCES users(id),
+		ip_address character varying(45) NOT NULL,
+		user_agent text NOT NULL DEFAULT '',
+		outcome character varying(20) NOT NULL,
+		created_at timestamp with time zone DEFAULT now() NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS login_attempts_created_idx ON login_attempts (created_at);
+	CREATE INDEX IF NOT EXISTS login_attempts_email_idx ON login_attempts (email, created_at);
+	CREATE INDEX IF NOT EXISTS login_attempts_ip_idx ON login_attempts (ip_address, created_at);
+	CREATE TABLE IF NOT EXISTS rate_limits (
+		bucket character varying(400) PRIMARY KEY,
+		hits integer NOT NULL,
+		last_hit_at timestamp with time zone NOT NULL
+	);`,
+
+	// 18: named roles; plain users become customers
+	`UPDATE users SET role = 'customer' WHERE role = 'user';
+	ALTER TABLE users ALTER COLUMN role SET DEFAULT 'customer';
+	ALTER TABLE users DROP CONSTRAINT IF EXISTS users_role_check;
+	ALTER TABLE users ADD CONSTRAINT users_role_check CHECK (role IN ('customer', 'admin', 'kitchen_staff', 'courier', 'finance'));`,
+
+	// 19: two-factor authentication
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret text;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled_at timestamp with time zone;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step bigint;
+	CREATE TABLE IF NOT EXISTS recovery_codes (
+		id bigserial PRIMARY KEY,
+		user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		code_hash character(64) NOT NULL,
+		used_at timestamp with time zone,
+		created_at timestamp with time zone DEFAULT now() NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS recovery_codes_user_idx ON recovery_codes (user_id);
+	CREATE TABLE IF NOT EXISTS two_factor_challenges (
+		id bigserial PRIMARY KEY,
+		user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		token_hash character(64) NOT NULL UNIQUE,
+		ip_address character varying(45) NOT NULL DEFAULT '',
+		failed_attempts integer NOT NULL DEFAULT 0,
+		expires_at timestamp with time zone NOT NULL,
+		used_at timestamp with time zone,
+		created_at timestamp with time zone DEFAULT now() NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS security_settings (
+		id boolean PRIMARY KEY DEFAULT true CHECK (id),
+		require_admin_two_factor boolean NOT NULL DEFAULT false,
+		updated_at timestamp with time zone,
+		updated_by integer REFERENCES users(id) ON DELETE SET NULL
+	);
+	INSERT INTO security_settings (id) VALUES (true) ON CONFLICT DO NOTHING;`,
+
+	// 20: the order that paid each billing period, so its settlement after a capture is recognised
+	`ALTER TABLE billing_periods ADD COLUMN IF NOT EXISTS payment_id bigint REFERENCES payments(id);
+	UPDATE billing_periods bp SET payment_id = (
+		SELECT p.id FROM payments p
+		WHERE p.billing_period_id = bp.id
+			AND p.gateway_status IN ('capture', 'settlement', 'partial_refund', 'refund', 'partial_chargeback', 'chargeback')
+		ORDER BY p.id LIMIT 1)
+	WHERE bp.status IN ('paid', 'refunded') AND bp.payment_id IS NULL;`,
+
+	// 21: the order that paid each plan change, for the same reason
+	`ALTER TABLE subscription_changes ADD COLUMN IF NOT EXISTS payment_id bigint REFERENCES payments(id);
+	UPDATE subscription_changes sc SET payment_id = (
+		SELECT p.id FROM payments p
+		WHERE p.subscription_change_id = sc.id
+			AND p.gateway_status IN ('capture', 'settlement', 'partial_refund', 'refund', 'partial_chargeback', 'chargeback')
+		ORDER BY p.id LIMIT 1)
+	WHERE sc.status = 'applied' AND sc.payment_id IS NULL;`,
+
+	// 22: referral codes, promo codes handed out by a customer who earns credit from them
+	`ALTER TABLE promo_codes ADD COLUMN IF NOT EXISTS referrer_user_id integer REFERENCES users(id) ON DELETE CASCADE;
+	CREATE UNIQUE INDEX IF NOT EXISTS promo_codes_referrer_idx ON promo_codes (referrer_user_id);
+	ALTER TABLE promo_redemptions ADD COLUMN IF NOT EXISTS referrer_credit numeric(12,2) NOT NULL DEFAULT 0;`,
+
+	// 23: which subscription a referral credited, so a refund can take the credit back
+	`ALTER TABLE promo_redemptions ADD COLUMN IF NOT EXISTS referrer_subscription_id integer REFERENCES subscriptions(id);`,
+
+	// 24: the hit before the last one, so a refunded login attempt does not restart the wait
+	`ALTER TABLE rate_limits ADD COLUMN IF NOT EXISTS prev_hit_at timestamp with time zone;`,
+}
+
+// Migrate brings the schema up to date. Each migration runs in its own
+// transaction so a failure leaves the database at the last good version.
+func Migrate() error {
+	ctx := context.Background()
+
+	_, err := DB.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version integer PRIMARY KEY,
+		applied_at timestamp with time zone DEFAULT now() NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("Unable to create schema_migrations: %v", err)
+	}
+
+	var current int
+	if err := DB.QueryRow(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return fmt.Errorf("Unable to read schema version: %v", err)
+	}
+
+	for i := current; i < len(migrations); i++ {
+		version := i + 1
+		tx, err := DB.Begin(ctx)
+		if err != nil {
+			return fmt.Errorf("Unable to start migration %d: %v", version, err)
+		}
+		if _, err := tx.Exec(ctx, migrations[i]); err != nil {
+			tx.Rollback(ctx)
+			return fmt.Errorf("Migration %d failed: %v", version, err)
+		}
+		if _, err := tx.Exec(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, version); err != nil {
+			tx.Rollback(ctx)
+			return fmt.Errorf("Unable to record migration %d: %v", version, err)
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return fmt.Errorf("Unable to commit migration %d: %v", version, err)
+		}
+		fmt.Printf("Applied database migration %d\n", version)
+	}
+	return nil
+}
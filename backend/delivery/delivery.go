@@ -0,0 +1,67 @@
+// Package delivery works out which calendar days a subscription is delivered on.
+package delivery
+
+import "time"
+
+// Window is an inclusive range of calendar days, such as a pause.
+type Window struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// Contains reports whether day falls inside the window.
+func (w Window) Contains(day time.Time) bool {
+	day = Day(day)
+	return !day.Before(Day(w.Start)) && !day.After(Day(w.End))
+}
+
+// Day truncates t to midnight in its own location.
+func Day(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// Date returns the calendar day of t as midnight local time, which is how
+// Day(time.Now()) and ParseDate see days. pgx reads date columns as midnight
+// UTC, so dates from the database go through Date before being compared.
+func Date(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+}
+
+// ParseDate reads a day written as YYYY-MM-DD.
+func ParseDate(s string) (time.Time, error) {
+	return time.ParseInLocation("2006-01-02", s, time.Local)
+}
+
+// Dates returns every delivery date between from and to inclusive, given the
+// weekday names a subscription is delivered on. Days inside any of the skip
+// windows are left out.
+func Dates(weekdays []string, from, to time.Time, skip ...Window) []time.Time {
+	wanted := make(map[time.Weekday]bool, len(weekdays))
+	for _, name := range weekdays {
+		for wd := time.Sunday; wd <= time.Saturday; wd++ {
+			if wd.String() == name {
+				wanted[wd] = true
+			}
+		}
+	}
+
+	dates := make([]time.Time, 0)
+	for day := Day(from); !day.After(Day(to)); day = day.AddDate(0, 0, 1) {
+		if !wanted[day.Weekday()] || skipped(day, skip) {
+			continue
+		}
+		dates = append(dates, day)
+	}
+	return dates
+}
+
+func skipped(day time.Time, windows []Window) bool {
+	for _, w := range windows {
+		if w.Contains(day) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,228 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Fake is an in-memory gateway for running payments offline. It hands out
+// tokens without calling anyone and reports results by posting notifications,
+// signed with the same server key as Midtrans uses, to our own webhook.
+// Orders only live as long as the process.
+type Fake struct {
+	serverKey string
+	notifyURL string
+	client    *http.Client
+
+	mu     sync.Mutex
+	orders map[string]*fakeOrder
+}
+
+type fakeOrder struct {
+	amount        int64
+	refunded      int64
+	transactionID string
+	status        string
+	refundKeys    map[string]bool
+}
+
+func NewFake(serverKey, notifyURL string) *Fake {
+	return &Fake{
+		serverKey: serverKey,
+		notifyURL: notifyURL,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		orders:    make(map[string]*fakeOrder),
+	}
+}
+
+func (f *Fake) Name() string { return "fake" }
+
+func (f *Fake) CreateCharge(ctx context.Context, req ChargeRequest) (Charge, error) {
+	// Midtrans rejects these too, so catch them here rather than in production
+	if err := req.Validate(); err != nil {
+		return Charge{}, fmt.Errorf("fake charge: %w", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.orders[req.OrderID]; ok {
+		return Charge{}, fmt.Errorf("fake charge %s: order ID already used", req.OrderID)
+	}
+	f.orders[req.OrderID] = &fakeOrder{
+		amount:        req.Amount,
+		transactionID: randomID(),
+		status:        "pending",
+		refundKeys:    make(map[string]bool),
+	}
+	return Charge{Token: "fake-" + req.OrderID}, nil
+}
+
+func (f *Fake) Status(ctx context.Context, orderID string) (Status, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	o, ok := f.orders[orderID]
+	if !ok {
+		return Status{}, ErrNotFound
+	}
+	return f.status(orderID, o), nil
+}
+
+func (f *Fake) Cancel(ctx context.Context, orderID string) error {
+	f.mu.Lock()
+	o, ok := f.orders[orderID]
+	if !ok {
+		f.mu.Unlock()
+		return nil
+	}
+	if o.status != "pending" && o.status != "authorize" {
+		f.mu.Unlock()
+		return fmt.Errorf("fake cancel %s: order is %s", orderID, o.status)
+	}
+	o.status = "cancel"
+	n := f.notification(orderID, o)
+	f.mu.Unlock()
+
+	go f.send(n)
+	return nil
+}
+
+func (f *Fake) Refund(ctx context.Context, req RefundRequest) error {
+	f.mu.Lock()
+	o, ok := f.orders[req.OrderID]
+	if !ok {
+		f.mu.Unlock()
+		return ErrNotFound
+	}
+	if req.Key != "" && o.refundKeys[req.Key] {
+		f.mu.Unlock()
+		return nil
+	}
+	if o.status != "settlement" && o.status != "partial_refund" {
+		f.mu.Unlock()
+		return fmt.Errorf("fake refund %s: order is %s", req.OrderID, o.status)
+	}
+	if req.Amount <= 0 || o.refunded+req.Amount > o.amount {
+		f.mu.Unlock()
+		return fmt.Errorf("fake refund %s: cannot refund %d of %d with %d already refunded", req.OrderID, req.Amount, o.amount, o.refunded)
+	}
+	o.refundKeys[req.Key] = true
+	o.refunded += req.Amount
+	o.status = "partial_refund"
+	if o.refunded == o.amount {
+		o.status = "refund"
+	}
+	n := f.notification(req.OrderID, o)
+	n["refund_amount"] = fmt.Sprintf("%d.00", req.Amount)
+	f.mu.Unlock()
+
+	go f.send(n)
+	return nil
+}
+
+// Notify moves an order to status, as a customer or the bank would, and
+// delivers the notification before returning. It returns the outcome the
+// webhook reported, so offline checks can see how it was handled.
+func (f *Fake) Notify(ctx context.Context, orderID, status string) (string, error) {
+	if _, ok := fakeStatusCodes[status]; !ok {
+		return "", fmt.Errorf("fake notify %s: unsupported status %q", orderID, status)
+	}
+	f.mu.Lock()
+	o, ok := f.orders[orderID]
+	if !ok {
+		f.mu.Unlock()
+		return "", ErrNotFound
+	}
+	o.status = status
+	n := f.notification(orderID, o)
+	f.mu.Unlock()
+
+	return f.post(ctx, n)
+}
+
+var fakeStatusCodes = map[string]string{
+	"pending":        "201",
+	"authorize":      "201",
+	"capture":        "200",
+	"settlement":     "200",
+	"deny":           "202",
+	"cancel":         "200",
+	"expire":         "407",
+	"failure":        "202",
+	"refund":         "200",
+	"partial_refund": "200",
+}
+
+func (f *Fake) status(orderID string, o *fakeOrder) Status {
+	return Status{
+		OrderID:           orderID,
+		TransactionID:     o.transactionID,
+		TransactionStatus: o.status,
+		FraudStatus:       "accept",
+		StatusCode:        fakeStatusCodes[o.status],
+		GrossAmount:       fmt.Sprintf("%d.00", o.amount),
+		PaymentType:       "fake",
+	}
+}
+
+// notification builds a Midtrans style payload; callers hold f.mu.
+func (f *Fake) notification(orderID string, o *fakeOrder) map[string]string {
+	s := f.status(orderID, o)
+	hash := sha512.Sum512([]byte(s.OrderID + s.StatusCode + s.GrossAmount + f.serverKey))
+	return map[string]string{
+		"transaction_time":   time.Now().Format("2006-01-02 15:04:05"),
+		"transaction_id":     s.TransactionID,
+		"transaction_status": s.TransactionStatus,
+		"fraud_status":       s.FraudStatus,
+		"status_code":        s.StatusCode,
+		"order_id":           s.OrderID,
+		"gross_amount":       s.GrossAmount,
+		"currency":           "IDR",
+		"payment_type":       s.PaymentType,
+		"signature_key":      hex.EncodeToString(hash[:]),
+	}
+}
+
+func (f *Fake) send(n map[string]string) {
+	if _, err := f.post(context.Background(), n); err != nil {
+		fmt.Printf("Fake gateway: %v\n", err)
+	}
+}
+
+func (f *Fake) post(ctx context.Context, n map[string]string) (string, error) {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.notifyURL, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("notify %s: %v", n["order_id"], err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("notify %s: webhook answered %s", n["order_id"], resp.Status)
+	}
+	var result struct {
+		Outcome string `json:"outcome"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	return result.Outcome, nil
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
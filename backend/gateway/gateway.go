@@ -0,0 +1,112 @@
+// Package gateway talks to the payment provider on behalf of the backend.
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/Zeropeepo/sea-catering-backend/config"
+	"github.com/midtrans/midtrans-go"
+)
+
+var ErrNotFound = errors.New("order not found at the payment gateway")
+
+// PaymentGateway is the set of payment provider operations the backend needs.
+// Results of a charge arrive later as notifications on the Midtrans webhook,
+// whichever implementation is in use.
+type PaymentGateway interface {
+	// Name is stored with each payment so it can be traced to its provider.
+	Name() string
+	// CreateCharge opens a payment page for an order.
+	CreateCharge(ctx context.Context, req ChargeRequest) (Charge, error)
+	// Status asks the provider for the current state of an order.
+	Status(ctx context.Context, orderID string) (Status, error)
+	// Cancel voids an order that has not been paid. Cancelling an order the
+	// provider has never seen is not an error.
+	Cancel(ctx context.Context, orderID string) error
+	// Refund returns all or part of a paid order.
+	Refund(ctx context.Context, req RefundRequest) error
+}
+
+type Customer struct {
+	Name  string
+	Email string
+}
+
+type Item struct {
+	ID    string
+	Name  string
+	Price int64
+	Qty   int32
+}
+
+// ChargeRequest amounts are whole rupiah; Amount must equal the sum of the items.
+type ChargeRequest struct {
+	OrderID  string
+	Amount   int64
+	Customer Customer
+	Items    []Item
+}
+
+// Validate checks that the items add up to the amount charged, which
+// Midtrans requires of ItemDetails and GrossAmt.
+func (r ChargeRequest) Validate() error {
+	var sum int64
+	for _, item := range r.Items {
+		sum += item.Price * int64(item.Qty)
+	}
+	if sum != r.Amount {
+		return fmt.Errorf("charge %s: items add up to %d, not %d", r.OrderID, sum, r.Amount)
+	}
+	return nil
+}
+
+// Charge is what the frontend needs to take the customer through payment.
+type Charge struct {
+	Token       string `json:"token"`
+	RedirectURL string `json:"redirectUrl"`
+}
+
+// Status uses the provider's own status names, which match the webhook.
+type Status struct {
+	OrderID           string
+	TransactionID     string
+	TransactionStatus string
+	FraudStatus       string
+	StatusCode        string
+	GrossAmount       string
+	PaymentType       string
+}
+
+// RefundRequest.Key makes a retried refund safe; the provider applies each key once.
+type RefundRequest struct {
+	OrderID string
+	Key     string
+	Amount  int64
+	Reason  string
+}
+
+// FromConfig builds the gateway named by PAYMENT_GATEWAY, "midtrans" (the
+// default) or "fake". MIDTRANS_ENV picks sandbox or production for Midtrans.
+func FromConfig() (PaymentGateway, error) {
+	serverKey := os.Getenv("MIDTRANS_SERVER_KEY")
+
+	switch name := config.String("PAYMENT_GATEWAY", "midtrans"); name {
+	case "midtrans":
+		switch env := config.String("MIDTRANS_ENV", "sandbox"); env {
+		case "sandbox":
+			return NewMidtrans(serverKey, midtrans.Sandbox), nil
+		case "production":
+			return NewMidtrans(serverKey, midtrans.Production), nil
+		default:
+			return nil, fmt.Errorf("unknown MIDTRANS_ENV %q", env)
+		}
+	case "fake":
+		notifyURL := config.String("FAKE_GATEWAY_NOTIFY_URL", "http://localhost:8080/api/midtrans/notification")
+		return NewFake(serverKey, notifyURL), nil
+	default:
+		return nil, fmt.Errorf("unknown PAYMENT_GATEWAY %q", name)
+	}
+}
@@ -0,0 +1,102 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/midtrans/midtrans-go"
+	"github.com/midtrans/midtrans-go/coreapi"
+	"github.com/midtrans/midtrans-go/snap"
+)
+
+// Midtrans takes payments through Snap and manages them through the Core API.
+type Midtrans struct {
+	snap snap.Client
+	core coreapi.Client
+}
+
+func NewMidtrans(serverKey string, env midtrans.EnvironmentType) *Midtrans {
+	m := &Midtrans{}
+	m.snap.New(serverKey, env)
+	m.core.New(serverKey, env)
+	return m
+}
+
+func (m *Midtrans) Name() string { return "midtrans" }
+
+func (m *Midtrans) CreateCharge(ctx context.Context, req ChargeRequest) (Charge, error) {
+	if err := req.Validate(); err != nil {
+		return Charge{}, err
+	}
+	items := make([]midtrans.ItemDetails, len(req.Items))
+	for i, item := range req.Items {
+		items[i] = midtrans.ItemDetails{ID: item.ID, Name: item.Name, Price: item.Price, Qty: item.Qty}
+	}
+
+	resp, err := m.snap.CreateTransaction(&snap.Request{
+		TransactionDetails: midtrans.TransactionDetails{
+			OrderID:  req.OrderID,
+			GrossAmt: req.Amount,
+		},
+		CustomerDetail: &midtrans.CustomerDetails{
+			FName: req.Customer.Name,
+			Email: req.Customer.Email,
+		},
+		Items: &items,
+	})
+	if err != nil {
+		return Charge{}, fmt.Errorf("midtrans charge %s: %s", req.OrderID, err.GetMessage())
+	}
+	return Charge{Token: resp.Token, RedirectURL: resp.RedirectURL}, nil
+}
+
+func (m *Midtrans) Status(ctx context.Context, orderID string) (Status, error) {
+	resp, err := m.core.CheckTransaction(orderID)
+	if err != nil {
+		if err.GetStatusCode() == http.StatusNotFound {
+			return Status{}, ErrNotFound
+		}
+		return Status{}, fmt.Errorf("midtrans status %s: %s", orderID, err.GetMessage())
+	}
+	// The Core API reports a missing transaction in the body with an HTTP 200
+	if resp.StatusCode == "404" {
+		return Status{}, ErrNotFound
+	}
+	return Status{
+		OrderID:           resp.OrderID,
+		TransactionID:     resp.TransactionID,
+		TransactionStatus: resp.TransactionStatus,
+		FraudStatus:       resp.FraudStatus,
+		StatusCode:        resp.StatusCode,
+		GrossAmount:       resp.GrossAmount,
+		PaymentType:       resp.PaymentType,
+	}, nil
+}
+
+func (m *Midtrans) Cancel(ctx context.Context, orderID string) error {
+	_, err := m.core.CancelTransaction(orderID)
+	if err != nil {
+		// Snap only creates the transaction once the customer picks a payment method
+		if err.GetStatusCode() == http.StatusNotFound {
+			return nil
+		}
+		return fmt.Errorf("midtrans cancel %s: %s", orderID, err.GetMessage())
+	}
+	return nil
+}
+
+func (m *Midtrans) Refund(ctx context.Context, req RefundRequest) error {
+	_, err := m.core.RefundTransaction(req.OrderID, &coreapi.RefundReq{
+		RefundKey: req.Key,
+		Amount:    req.Amount,
+		Reason:    req.Reason,
+	})
+	if err != nil {
+		if err.GetStatusCode() == http.StatusNotFound {
+			return ErrNotFound
+		}
+		return fmt.Errorf("midtrans refund %s: %s", req.OrderID, err.GetMessage())
+	}
+	return nil
+}
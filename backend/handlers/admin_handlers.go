@@ -2,11 +2,14 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"net/http"
+	"strconv"
     "time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/Zeropeepo/sea-catering-backend/database"
+	"github.com/Zeropeepo/sea-catering-backend/lifecycle"
 )
 
 // --- Structs ---
@@ -49,16 +52,17 @@ func GetAdminDashboardHandler(c *gin.Context) {
     var data AdminDashboardData
 
     // 1. New Subscriptions Query (with proper error checking)
-    newSubsQuery := `SELECT COUNT(*) FROM subscriptions WHERE created_at >= $1 AND created_at <= $2;`
+    newSubsQuery := `SELECT COUNT(*) FROM subscriptions WHERE status <> 'expired' AND created_at >= $1 AND created_at <= $2;`
     err = database.DB.QueryRow(context.Background(), newSubsQuery, startDate, endDate).Scan(&data.NewSubscriptions)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query new subscriptions"})
         return
     }
 
-    // 2. MRR Query (with proper error checking)
-    mrrQuery := `SELECT COALESCE(SUM(total_price), 0) FROM subscriptions WHERE status = 'active' AND created_at >= $1 AND created_at <= $2;`
-    err = database.DB.QueryRow(context.Background(), mrrQuery, startDate, endDate).Scan(&data.MonthlyRecurringRevenue)
+    // 2. MRR Query: monthly billing periods paid for and running on the last day of the range,
+    // net of promo discounts; tax is collected for the state, so it is left out
+    mrrQuery := `SELECT COALESCE(SUM(amount - discount), 0) FROM billing_periods WHERE status = 'paid' AND period_start <= $1::date AND period_end > $1::date;`
+    err = database.DB.QueryRow(context.Background(), mrrQuery, endDate).Scan(&data.MonthlyRecurringRevenue)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query MRR"})
         return
@@ -72,8 +76,8 @@ func GetAdminDashboardHandler(c *gin.Context) {
         return
     }
 
-    // 4. Reactivations Query (with proper error checking)
-    reactivationsQuery := `SELECT COUNT(*) FROM subscriptions WHERE status = 'active' AND updated_at >= $1 AND updated_at <= $2 AND created_at < updated_at;`
+    // 4. Reactivations Query: paused subscriptions brought back to active within the range
+    reactivationsQuery := `SELECT COUNT(*) FROM subscription_events WHERE old_status = 'paused' AND new_status = 'active' AND created_at >= $1 AND created_at <= $2;`
     err = database.DB.QueryRow(context.Background(), reactivationsQuery, startDate, endDate).Scan(&data.Reactivations)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query reactivations"})
@@ -84,7 +88,7 @@ func GetAdminDashboardHandler(c *gin.Context) {
     growthQuery := `
         SELECT to_char(created_at, 'YYYY-MM-DD') as date, COUNT(*) as count
         FROM subscriptions
-        WHERE created_at >= $1 AND created_at <= $2
+        WHERE status <> 'expired' AND created_at >= $1 AND created_at <= $2
         GROUP BY date
         ORDER BY date ASC;
     `
@@ -109,13 +113,118 @@ func GetAdminDashboardHandler(c *gin.Context) {
     c.JSON(http.StatusOK, data)
 }
 
+// Admin override for a subscription status, still bound by the lifecycle rules
+func AdminUpdateSubscriptionStatusHandler(c *gin.Context) {
+    subscriptionID, err := strconv.Atoi(c.Param("id"))
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subscription ID format"})
+        return
+    }
 
+    var payload struct {
+        Status string `json:"status" binding:"required"`
+        Reason string `json:"reason"`
+    }
+    if err := c.ShouldBindJSON(&payload); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request. 'status' field is required."})
+        return
+    }
 
+    adminID, _ := c.Get("userID")
+    _, err = lifecycle.Apply(context.Background(), database.DB, lifecycle.Request{
+        SubscriptionID: subscriptionID,
+        To:             lifecycle.Status(payload.Status),
+        Actor:          lifecycle.ActorAdmin,
+        ActorUserID:    adminID.(int),
+        Reason:         payload.Reason,
+    })
+    if errors.Is(err, lifecycle.ErrNotFound) {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found"})
+        return
+    }
+    if errors.Is(err, lifecycle.ErrIllegalTransition) {
+        c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+        return
+    }
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update subscription status"})
+        return
+    }
+    if to := lifecycle.Status(payload.Status); to == lifecycle.Cancelled || to == lifecycle.Expired {
+        cancelOpenOrders(subscriptionID)
+    }
 
+    c.JSON(http.StatusOK, gin.H{"message": "Subscription status updated successfully to " + payload.Status})
+}
 
+// Status history of any subscription
+func AdminGetSubscriptionHistoryHandler(c *gin.Context) {
+    subscriptionID, err := strconv.Atoi(c.Param("id"))
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subscription ID format"})
+        return
+    }
 
+    events, err := lifecycle.History(context.Background(), database.DB, subscriptionID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch subscription history"})
+        return
+    }
+    if len(events) == 0 {
+        var exists bool
+        err := database.DB.QueryRow(context.Background(), "SELECT EXISTS (SELECT 1 FROM subscriptions WHERE id = $1)", subscriptionID).Scan(&exists)
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch subscription history"})
+            return
+        }
+        if !exists {
+            c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found"})
+            return
+        }
+    }
+    c.JSON(http.StatusOK, events)
+}
 
+type JobRun struct {
+    ID           int64      `json:"id"`
+    JobName      string     `json:"jobName"`
+    ScheduledFor time.Time  `json:"scheduledFor"`
+    Instance     string     `json:"instance"`
+    Status       string     `json:"status"`
+    Error        string     `json:"error"`
+    StartedAt    time.Time  `json:"startedAt"`
+    FinishedAt   *time.Time `json:"finishedAt"`
+}
 
+// Recent background job runs, optionally filtered by job name
+func GetJobRunsHandler(c *gin.Context) {
+    limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+    if err != nil || limit < 1 || limit > 500 {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 500"})
+        return
+    }
 
+    sqlStatement := `
+        SELECT id, job_name, scheduled_for, instance, status, error, started_at, finished_at
+        FROM job_runs
+        WHERE $1 = '' OR job_name = $1
+        ORDER BY started_at DESC
+        LIMIT $2`
+    rows, err := database.DB.Query(context.Background(), sqlStatement, c.Query("job"), limit)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch job runs"})
+        return
+    }
+    defer rows.Close()
 
-
+    runs := make([]JobRun, 0)
+    for rows.Next() {
+        var run JobRun
+        if err := rows.Scan(&run.ID, &run.JobName, &run.ScheduledFor, &run.Instance, &run.Status, &run.Error, &run.StartedAt, &run.FinishedAt); err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process job runs"})
+            return
+        }
+        runs = append(runs, run)
+    }
+    c.JSON(http.StatusOK, runs)
+}
@@ -2,16 +2,18 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
-	"os"
 	"regexp"
-	"time"
+	"strings"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
-	"github.com/google/uuid"
+	"github.com/Zeropeepo/sea-catering-backend/account"
 	"github.com/Zeropeepo/sea-catering-backend/database"
+	"github.com/Zeropeepo/sea-catering-backend/rbac"
+	"github.com/Zeropeepo/sea-catering-backend/session"
+	"github.com/jackc/pgx/v5"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -31,6 +33,9 @@ type UserProfile struct {
 	FullName string `json:"fullName"`
 	Email    string `json:"email"`
 	Role     string `json:"role"`
+	EmailVerified bool `json:"emailVerified"`
+	Permissions []rbac.Permission `json:"permissions"`
+	TwoFactorEnabled bool `json:"twoFactorEnabled"`
 }
 
 // Handler for GetUserProfile
@@ -42,12 +47,14 @@ func GetUserProfileHandler(c *gin.Context) {
 	}
 
 	var userProfile UserProfile
-	sqlStatement := `SELECT id, full_name, email, role FROM users WHERE id = $1`
+	sqlStatement := `SELECT id, full_name, email, role, email_verified_at IS NOT NULL, totp_enabled_at IS NOT NULL FROM users WHERE id = $1`
 	err := database.DB.QueryRow(context.Background(), sqlStatement, userID.(int)).Scan(
 		&userProfile.ID,
 		&userProfile.FullName,
 		&userProfile.Email,
 		&userProfile.Role,
+		&userProfile.EmailVerified,
+		&userProfile.TwoFactorEnabled,
 	)
 
 	if err != nil {
@@ -55,12 +62,21 @@ func GetUserProfileHandler(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
 	}
+	userProfile.Permissions = rbac.Roles[rbac.Role(userProfile.Role)]
+	if userProfile.Permissions == nil {
+		userProfile.Permissions = []rbac.Permission{}
+	}
 
 	c.JSON(http.StatusOK, userProfile)
 }
 
 // User registration handler
 func RegisterHandler(c *gin.Context) {
+	if wait := registrationWait(context.Background(), c.ClientIP()); wait > 0 {
+		tooManyAttempts(c, wait)
+		return
+	}
+
 	var user UserRegistration
 	if err := c.ShouldBindJSON(&user); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data: " + err.Error()})
@@ -83,6 +99,14 @@ func RegisterHandler(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user. Email may already be in use."})
 		return
 	}
+
+	// The account exists either way; a failed email can be sent again from the resend endpoint
+	verifyUser, verifyToken, err := account.StartVerification(context.Background(), database.DB, id)
+	if err != nil {
+		fmt.Printf("Error creating verification token for user %d: %v\n", id, err)
+	} else {
+		go sendVerification(verifyUser, verifyToken)
+	}
 	c.JSON(http.StatusOK, gin.H{"message": "User registered successfully!", "userId": id})
 }
 
@@ -94,53 +118,192 @@ func LoginHandler(c *gin.Context) {
 		PasswordHash string
 	}
 
-	// FMT for better logging and debugging
-	fmt.Println("--- New Login Attempt ---")
 	if err := c.ShouldBindJSON(&loginCreds); err != nil {
-		fmt.Println("Error: Failed to bind JSON.", err)
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
 		return
 	}
-	fmt.Printf("Received login request for email: '%s'\n", loginCreds.Email)
+
+	ctx := context.Background()
+	attempt := account.LoginAttempt{
+		Email:     strings.ToLower(strings.TrimSpace(loginCreds.Email)),
+		IPAddress: c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+	}
+	if wait := loginWait(ctx, attempt); wait > 0 {
+		attempt.Outcome = account.LoginThrottled
+		recordLoginAttempt(attempt)
+		tooManyAttempts(c, wait)
+		return
+	}
 
 	sqlStatement := `SELECT id, password_hash FROM users WHERE email = $1`
-	err := database.DB.QueryRow(context.Background(), sqlStatement, loginCreds.Email).Scan(&userFromDB.ID, &userFromDB.PasswordHash)
-	if err != nil {
-		fmt.Printf("Database Error: User not found for email '%s'. Error: %v\n", loginCreds.Email, err)
+	err := database.DB.QueryRow(ctx, sqlStatement, loginCreds.Email).Scan(&userFromDB.ID, &userFromDB.PasswordHash)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		attempt.Outcome = account.LoginUnknownUser
+	case err != nil:
+		loginNotCounted(ctx, attempt)
+		fmt.Printf("Error looking up user for login: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not log in"})
+		return
+	default:
+		attempt.UserID = &userFromDB.ID
+		if bcrypt.CompareHashAndPassword([]byte(userFromDB.PasswordHash), []byte(loginCreds.Password)) != nil {
+			attempt.Outcome = account.LoginBadPassword
+		}
+	}
+	if attempt.Outcome != "" {
+		recordLoginAttempt(attempt)
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password"})
 		return
 	}
-	fmt.Printf("User found in DB with ID: %d. Comparing password...\n", userFromDB.ID)
 
-	err = bcrypt.CompareHashAndPassword([]byte(userFromDB.PasswordHash), []byte(loginCreds.Password))
+	// With two-factor authentication on, the password only earns a
+	// challenge; the session comes from /login/2fa
+	twoFactor, err := account.TwoFactor(ctx, database.DB, userFromDB.ID)
 	if err != nil {
-		fmt.Printf("CRITICAL: Password comparison failed for user ID %d. Error: %v\n", userFromDB.ID, err)
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password"})
+		loginNotCounted(ctx, attempt)
+		fmt.Printf("Error fetching two-factor status for login: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not log in"})
+		return
+	}
+	if twoFactor.Enabled {
+		// The password was right; only wrong codes count from here
+		loginNotCounted(ctx, attempt)
+		challenge, err := account.StartChallenge(ctx, database.DB, userFromDB.ID, c.ClientIP())
+		if err != nil {
+			fmt.Printf("Error starting two-factor login: %v\n", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not log in"})
+			return
+		}
+		attempt.Outcome = account.LoginTwoFactorPending
+		recordLoginAttempt(attempt)
+		c.JSON(http.StatusOK, gin.H{
+			"message":           "Enter the code from your authenticator app",
+			"twoFactorRequired": true,
+			"challenge":         challenge,
+		})
 		return
 	}
 
-	fmt.Printf("Password comparison successful for user ID %d. Generating tokens...\n", userFromDB.ID)
-	csrfToken := uuid.New().String()
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"sub":  userFromDB.ID,
-		"exp":  time.Now().Add(time.Hour * 24).Unix(),
-		"csrf": csrfToken,
-	})
-
-	tokenString, err := token.SignedString([]byte(os.Getenv("JWT_SECRET")))
+	tokens, err := session.Start(ctx, database.DB, userFromDB.ID, c.Request.UserAgent(), c.ClientIP())
 	if err != nil {
+		loginNotCounted(ctx, attempt)
 		fmt.Println("Error: Could not generate token.", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate token"})
 		return
 	}
 
-	fmt.Println("Login successful. Sending token and csrf token to frontend.")
-	c.JSON(http.StatusOK, gin.H{
-		"message": "Login successful!",
-		"token":   tokenString,
-		"csrf":    csrfToken,
-	})
+	attempt.Outcome = account.LoginSucceeded
+	recordLoginAttempt(attempt)
+	loginSucceeded(ctx, attempt)
+	body := tokenResponse(c, tokens)
+	body["message"] = "Login successful!"
+	c.JSON(http.StatusOK, body)
+}
+
+type TokenRefresh struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// Trades a refresh token for a new access token and refresh token. Each
+// refresh token works once; using it again logs the session out.
+func RefreshTokenHandler(c *gin.Context) {
+	refreshToken, ok := refreshTokenFrom(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token required"})
+		return
+	}
+
+	tokens, err := session.Refresh(context.Background(), database.DB, refreshToken)
+	switch {
+	case errors.Is(err, session.ErrReused):
+		fmt.Println("Warning: a rotated refresh token was presented again; its session has been revoked")
+		clearSessionCookies(c)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, session.ErrInvalidToken), errors.Is(err, session.ErrRevoked):
+		clearSessionCookies(c)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		fmt.Printf("Error refreshing token: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not refresh token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, tokenResponse(c, tokens))
+}
+
+// refreshTokenFrom reads the refresh token from the body or, in cookie mode,
+// from its cookie. The cookie is only accepted with a matching CSRF header.
+func refreshTokenFrom(c *gin.Context) (string, bool) {
+	var input TokenRefresh
+	if err := c.ShouldBindJSON(&input); err == nil && input.RefreshToken != "" {
+		return input.RefreshToken, true
+	}
+	if !session.CookieMode() {
+		return "", false
+	}
+
+	refreshToken, err := c.Cookie(session.RefreshCookie)
+	csrfCookie, _ := c.Cookie(session.CSRFCookie)
+	if err != nil || refreshToken == "" || csrfCookie == "" || c.GetHeader("X-CSRF-Token") != csrfCookie {
+		return "", false
+	}
+	return refreshToken, true
+}
+
+// tokenResponse is the body for a new set of tokens. In cookie mode the
+// tokens go into HttpOnly cookies and only the CSRF value is returned.
+func tokenResponse(c *gin.Context, tokens session.Tokens) gin.H {
+	body := gin.H{"expiresAt": tokens.ExpiresAt, "csrf": tokens.CSRF}
+	if session.CookieMode() {
+		for _, cookie := range session.Cookies(tokens) {
+			http.SetCookie(c.Writer, cookie)
+		}
+		return body
+	}
+	body["token"] = tokens.AccessToken
+	body["refreshToken"] = tokens.RefreshToken
+	return body
+}
+
+func clearSessionCookies(c *gin.Context) {
+	if !session.CookieMode() {
+		return
+	}
+	for _, cookie := range session.ClearCookies() {
+		http.SetCookie(c.Writer, cookie)
+	}
+}
+
+// Ends the session the request was made with
+func LogoutHandler(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	sessionID, _ := c.Get("sessionID")
+
+	if err := session.Revoke(context.Background(), database.DB, sessionID.(int64), userID.(int)); err != nil {
+		fmt.Printf("Error revoking session %v: %v\n", sessionID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+		return
+	}
+	clearSessionCookies(c)
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
+}
+
+// Ends every session of the user, on every device
+func LogoutAllHandler(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	revoked, err := session.RevokeAll(context.Background(), database.DB, userID.(int), session.RevokedLogoutAll)
+	if err != nil {
+		fmt.Printf("Error revoking sessions of user %v: %v\n", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+		return
+	}
+	clearSessionCookies(c)
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out of all sessions", "sessions": revoked})
 }
 
 func validatePassword(password string) bool {
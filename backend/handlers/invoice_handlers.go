@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Zeropeepo/sea-catering-backend/database"
+	"github.com/Zeropeepo/sea-catering-backend/invoice"
+	"github.com/gin-gonic/gin"
+)
+
+// Invoices of the logged in user, newest first
+func GetUserInvoicesHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User context not found"})
+		return
+	}
+
+	invoices, err := invoice.List(context.Background(), database.DB, invoice.Filter{UserID: userID.(int), Limit: 500})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch invoices"})
+		return
+	}
+	c.JSON(http.StatusOK, invoices)
+}
+
+// One invoice the user owns, as JSON or, for /invoices/:id.pdf, as a PDF
+func GetInvoiceHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User context not found"})
+		return
+	}
+
+	inv, asPDF, ok := loadInvoice(c)
+	if !ok {
+		return
+	}
+	// Someone else's invoice looks the same as a missing one
+	if inv.UserID != userID.(int) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invoice not found"})
+		return
+	}
+	writeInvoice(c, inv, asPDF)
+}
+
+// Any invoice, for admins
+func AdminGetInvoiceHandler(c *gin.Context) {
+	inv, asPDF, ok := loadInvoice(c)
+	if !ok {
+		return
+	}
+	writeInvoice(c, inv, asPDF)
+}
+
+// loadInvoice reads the invoice named by the :id parameter. Gin cannot route
+// "/:id" and "/:id.pdf" separately, so the extension is split off here.
+func loadInvoice(c *gin.Context) (invoice.Invoice, bool, bool) {
+	param, asPDF := strings.CutSuffix(c.Param("id"), ".pdf")
+	id, err := strconv.ParseInt(param, 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid invoice ID format"})
+		return invoice.Invoice{}, false, false
+	}
+
+	inv, err := invoice.Get(context.Background(), database.DB, id)
+	if errors.Is(err, invoice.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invoice not found"})
+		return inv, false, false
+	}
+	if err != nil {
+		fmt.Printf("Error fetching invoice %d: %v\n", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch invoice"})
+		return inv, false, false
+	}
+	return inv, asPDF, true
+}
+
+func writeInvoice(c *gin.Context, inv invoice.Invoice, asPDF bool) {
+	if !asPDF {
+		c.JSON(http.StatusOK, inv)
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf(`inline; filename="%s.pdf"`, inv.Number))
+	c.Data(http.StatusOK, "application/pdf", inv.PDF())
+}
+
+// Admin listing of invoices with optional date filters
+func GetAdminInvoicesHandler(c *gin.Context) {
+	var filter invoice.Filter
+
+	var err error
+	if v := c.Query("userId"); v != "" {
+		if filter.UserID, err = strconv.Atoi(v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid userId"})
+			return
+		}
+	}
+	layout := "2006-01-02"
+	if v := c.Query("startDate"); v != "" {
+		if filter.From, err = time.Parse(layout, v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid start date format."})
+			return
+		}
+	}
+	if v := c.Query("endDate"); v != "" {
+		if filter.To, err = time.Parse(layout, v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid end date format."})
+			return
+		}
+		filter.To = filter.To.Add(24*time.Hour - time.Second)
+	}
+	if filter.Limit, err = strconv.Atoi(c.DefaultQuery("limit", "50")); err != nil || filter.Limit < 1 || filter.Limit > 500 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 500"})
+		return
+	}
+
+	invoices, err := invoice.List(context.Background(), database.DB, filter)
+	if err != nil {
+		fmt.Printf("Error listing invoices: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch invoices"})
+		return
+	}
+	c.JSON(http.StatusOK, invoices)
+}
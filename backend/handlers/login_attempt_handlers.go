@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Zeropeepo/sea-catering-backend/account"
+	"github.com/Zeropeepo/sea-catering-backend/database"
+	"github.com/Zeropeepo/sea-catering-backend/ratelimit"
+	"github.com/gin-gonic/gin"
+)
+
+// AuthLimits throttle logins and registrations. Logins are limited per
+// address, which stops one client guessing many accounts, and per account,
+// which stops many clients guessing one.
+type AuthLimits struct {
+	LoginIP      *ratelimit.Limiter
+	LoginAccount *ratelimit.Limiter
+	RegisterIP   *ratelimit.Limiter
+}
+
+// The throttles, set up at startup
+var authLimits AuthLimits
+
+func SetAuthLimits(l AuthLimits) {
+	authLimits = l
+}
+
+// loginWait counts a login before the password is checked and returns how
+// long it must wait instead. Counting first means concurrent guesses are all
+// counted; a refused login is not. Unknown emails are counted like real
+// accounts, so a lockout gives away nothing. A limiter that cannot reach its store
+// lets the attempt through; being unable to log in at all would be worse
+// than a few unthrottled guesses.
+func loginWait(ctx context.Context, attempt account.LoginAttempt) time.Duration {
+	byIP, err := authLimits.LoginIP.Take(ctx, attempt.IPAddress)
+	if err != nil {
+		fmt.Printf("Error checking login rate limit: %v\n", err)
+	}
+	if byIP > 0 {
+		return byIP
+	}
+	byAccount, err := authLimits.LoginAccount.Take(ctx, attempt.Email)
+	if err != nil {
+		fmt.Printf("Error checking login rate limit: %v\n", err)
+	}
+	if byAccount > 0 {
+		refundLogin(ctx, authLimits.LoginIP, attempt.IPAddress)
+	}
+	return byAccount
+}
+
+// loginNotCounted gives back a login counted by loginWait that was not a
+// wrong guess, such as a right password waiting for its two-factor code.
+func loginNotCounted(ctx context.Context, attempt account.LoginAttempt) {
+	refundLogin(ctx, authLimits.LoginIP, attempt.IPAddress)
+	refundLogin(ctx, authLimits.LoginAccount, attempt.Email)
+}
+
+// The address gets its attempt back but keeps its earlier count, or an
+// attacker could clear it by logging in to their own account between guesses.
+func loginSucceeded(ctx context.Context, attempt account.LoginAttempt) {
+	refundLogin(ctx, authLimits.LoginIP, attempt.IPAddress)
+	if err := authLimits.LoginAccount.Reset(ctx, attempt.Email); err != nil {
+		fmt.Printf("Error resetting login rate limit: %v\n", err)
+	}
+}
+
+func refundLogin(ctx context.Context, limiter *ratelimit.Limiter, key string) {
+	if err := limiter.Refund(ctx, key); err != nil {
+		fmt.Printf("Error refunding login attempt: %v\n", err)
+	}
+}
+
+// Every registration counts, successful or not.
+func registrationWait(ctx context.Context, ip string) time.Duration {
+	wait, err := authLimits.RegisterIP.Take(ctx, ip)
+	if err != nil {
+		fmt.Printf("Error checking registration rate limit: %v\n", err)
+		return 0
+	}
+	return wait
+}
+
+func recordLoginAttempt(attempt account.LoginAttempt) {
+	if err := account.RecordLoginAttempt(context.Background(), database.DB, attempt); err != nil {
+		fmt.Printf("Error recording login attempt: %v\n", err)
+	}
+}
+
+func tooManyAttempts(c *gin.Context, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error":      fmt.Sprintf("Too many attempts. Please try again in %d seconds.", seconds),
+		"retryAfter": seconds,
+	})
+}
+
+// Admin listing of login attempts, filterable by email, address and outcome
+func GetLoginAttemptsHandler(c *gin.Context) {
+	filter := account.AttemptFilter{
+		Email:     strings.ToLower(c.Query("email")),
+		IPAddress: c.Query("ip"),
+		Outcome:   c.Query("outcome"),
+	}
+
+	var err error
+	layout := "2006-01-02"
+	if v := c.Query("startDate"); v != "" {
+		if filter.From, err = time.Parse(layout, v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid start date format."})
+			return
+		}
+	}
+	if v := c.Query("endDate"); v != "" {
+		if filter.To, err = time.Parse(layout, v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid end date format."})
+			return
+		}
+		filter.To = filter.To.Add(24*time.Hour - time.Second)
+	}
+	if filter.Limit, err = strconv.Atoi(c.DefaultQuery("limit", "50")); err != nil || filter.Limit < 1 || filter.Limit > 500 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 500"})
+		return
+	}
+
+	attempts, err := account.LoginAttempts(context.Background(), database.DB, filter)
+	if err != nil {
+		fmt.Printf("Error listing login attempts: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch login attempts"})
+		return
+	}
+	c.JSON(http.StatusOK, attempts)
+}
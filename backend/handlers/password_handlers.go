@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/Zeropeepo/sea-catering-backend/account"
+	"github.com/Zeropeepo/sea-catering-backend/database"
+	"github.com/Zeropeepo/sea-catering-backend/mailer"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The mail sender and the frontend address links in emails point to, chosen at startup
+var (
+	mail   mailer.Mailer
+	appURL string
+)
+
+func SetMailer(m mailer.Mailer, frontendURL string) {
+	mail = m
+	appURL = frontendURL
+}
+
+type ForgotPassword struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+type ResetPassword struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+// The answer is the same whether or not the email has an account, so the
+// endpoint cannot be used to find out who is registered.
+func ForgotPasswordHandler(c *gin.Context) {
+	var input ForgotPassword
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data: " + err.Error()})
+		return
+	}
+
+	user, token, err := account.RequestReset(context.Background(), database.DB, input.Email, c.ClientIP())
+	switch {
+	case errors.Is(err, account.ErrUnknownEmail):
+	case err != nil:
+		fmt.Printf("Error creating password reset token: %v\n", err)
+	default:
+		// Sent in the background so a known email does not answer slower than an unknown one
+		go sendPasswordReset(user, token)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "If an account exists for that email, a reset link has been sent."})
+}
+
+func sendPasswordReset(user account.User, token string) {
+	link := appURL + "/reset-password?token=" + url.QueryEscape(token)
+	err := mail.Send(context.Background(), mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your SEA Catering password",
+		Body: fmt.Sprintf("Hi %s,\n\n"+
+			"Someone asked to reset the password of your SEA Catering account. To choose a new password, open this link:\n\n"+
+			"%s\n\n"+
+			"The link works once and expires soon. If you did not ask for it, you can ignore this email; your password stays the same.\n",
+			user.FullName, link),
+	})
+	if err != nil {
+		fmt.Printf("Error sending password reset email to user %d: %v\n", user.ID, err)
+	}
+}
+
+// Sets a new password with a token from a reset email and logs out every session
+func ResetPasswordHandler(c *gin.Context) {
+	var input ResetPassword
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data: " + err.Error()})
+		return
+	}
+	if !validatePassword(input.Password) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password must be at least 8 characters long and contain uppercase, lowercase, digit, and special character."})
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(input.Password), 12)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
+
+	err = account.ResetPassword(context.Background(), database.DB, input.Token, string(hashedPassword))
+	if errors.Is(err, account.ErrInvalidToken) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error resetting password: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Password has been reset. Please log in with your new password."})
+}
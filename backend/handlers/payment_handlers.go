@@ -2,25 +2,25 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
-	"os"
 	"strconv" 
 	"time"
 
+	"github.com/Zeropeepo/sea-catering-backend/billing"
 	"github.com/Zeropeepo/sea-catering-backend/database"
+	"github.com/Zeropeepo/sea-catering-backend/gateway"
+	"github.com/Zeropeepo/sea-catering-backend/ledger"
+	"github.com/Zeropeepo/sea-catering-backend/lifecycle"
 	"github.com/gin-gonic/gin"
-	"github.com/midtrans/midtrans-go"
-	"github.com/midtrans/midtrans-go/snap"
 )
 
+// The payment provider, chosen at startup
+var payments gateway.PaymentGateway
 
-
-// Global snap client, initiated with the server key and environment
-var s snap.Client
-
-func init() {
-	s.New(os.Getenv("MIDTRANS_SERVER_KEY"), midtrans.Sandbox)
+func SetPaymentGateway(g gateway.PaymentGateway) {
+	payments = g
 }
 
 func CreatePaymentHandler(c *gin.Context) {
@@ -38,56 +38,250 @@ func CreatePaymentHandler(c *gin.Context) {
 		return
 	}
 
-	var user UserProfile
-	var subscriptionAmount float64
-	var subscriptionPlan string
+	var owned bool
+	err = database.DB.QueryRow(context.Background(),
+		"SELECT EXISTS (SELECT 1 FROM subscriptions WHERE id = $1 AND user_id = $2)", subscriptionID, userID.(int)).Scan(&owned)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create payment transaction"})
+		return
+	}
+	if !owned {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found or you do not have permission"})
+		return
+	}
+
+	// Pays the open billing period at the recomputed price, never the stored or client supplied total
+	checkout, err := billing.StartCheckout(context.Background(), database.DB, payments, subscriptionID)
+	if errors.Is(err, billing.ErrNothingDue) {
+		c.JSON(http.StatusConflict, gin.H{"error": "There is nothing to pay for on this subscription"})
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error creating payment for subscription %d: %v\n", subscriptionID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create payment transaction"})
+		return
+	}
+
+	// Send the snap token back to the client
+	c.JSON(http.StatusOK, gin.H{
+		"snapToken":   checkout.Charge.Token,
+		"redirectUrl": checkout.Charge.RedirectURL,
+		"orderId":     checkout.OrderID,
+		"period":      checkout.Period,
+	})
+}
+
+// Payments made for a subscription the user owns
+func GetSubscriptionPaymentsHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User context not found"})
+		return
+	}
 
-	// Get user profile from database using userID
+	subscriptionID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subscription ID format"})
+		return
+	}
+
+	var owned bool
 	err = database.DB.QueryRow(context.Background(),
-		"SELECT id, full_name, email FROM users WHERE id = $1", userID.(int)).Scan(&user.ID, &user.FullName, &user.Email)
+		"SELECT EXISTS (SELECT 1 FROM subscriptions WHERE id = $1 AND user_id = $2)", subscriptionID, userID).Scan(&owned)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch payments"})
+		return
+	}
+	if !owned {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found or you do not have permission"})
+		return
+	}
+
+	records, err := ledger.ForSubscription(context.Background(), database.DB, subscriptionID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "User profile not found"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch payments"})
 		return
 	}
+	// The raw gateway payload is for admins only
+	for i := range records {
+		records[i].RawPayload = nil
+	}
+	c.JSON(http.StatusOK, records)
+}
 
-	// Get subscription details from database
+// Billing periods of a subscription the user owns
+func GetSubscriptionBillingPeriodsHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User context not found"})
+		return
+	}
+
+	subscriptionID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subscription ID format"})
+		return
+	}
+
+	var owned bool
 	err = database.DB.QueryRow(context.Background(),
-		"SELECT plan_name, total_price FROM subscriptions WHERE id = $1 AND user_id = $2", subscriptionID, userID.(int)).Scan(&subscriptionPlan, &subscriptionAmount)
+		"SELECT EXISTS (SELECT 1 FROM subscriptions WHERE id = $1 AND user_id = $2)", subscriptionID, userID).Scan(&owned)
 	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch billing periods"})
+		return
+	}
+	if !owned {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found or you do not have permission"})
 		return
 	}
 
-	// Request structure for Midtrans Snap
-	snapReq := &snap.Request{
-		TransactionDetails: midtrans.TransactionDetails{
-			OrderID:  fmt.Sprintf("SEACATERING-%d-%d", subscriptionID, time.Now().Unix()),
-			GrossAmt: int64(subscriptionAmount),
-		},
-		CustomerDetail: &midtrans.CustomerDetails{
-			FName: user.FullName,
-			Email: user.Email,
-		},
-		Items: &[]midtrans.ItemDetails{
-			{
-				ID:    "SUB-" + strconv.Itoa(subscriptionID),
-				Price: int64(subscriptionAmount),
-				Qty:   1,
-				Name:  "Subscription: " + subscriptionPlan,
-			},
-		},
-	}
-
-	// Create snap token
-	snapToken, midtransErr := s.CreateTransactionToken(snapReq)
-	if midtransErr != nil {
-		fmt.Printf("Error creating Midtrans transaction: %v\n", midtransErr.GetMessage())
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create payment transaction"})
+	periods, err := lifecycle.Periods(context.Background(), database.DB, subscriptionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch billing periods"})
 		return
 	}
+	c.JSON(http.StatusOK, periods)
+}
 
-	// Send the snap token back to the client
-	c.JSON(http.StatusOK, gin.H{
-		"snapToken": snapToken,
+// Admin listing of all payments with optional filters
+func GetAdminPaymentsHandler(c *gin.Context) {
+	filter := ledger.Filter{Status: c.Query("status")}
+
+	var err error
+	if v := c.Query("subscriptionId"); v != "" {
+		if filter.SubscriptionID, err = strconv.Atoi(v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subscriptionId"})
+			return
+		}
+	}
+	layout := "2006-01-02"
+	if v := c.Query("startDate"); v != "" {
+		if filter.From, err = time.Parse(layout, v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid start date format."})
+			return
+		}
+	}
+	if v := c.Query("endDate"); v != "" {
+		if filter.To, err = time.Parse(layout, v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid end date format."})
+			return
+		}
+		filter.To = filter.To.Add(24*time.Hour - time.Second)
+	}
+	if filter.Limit, err = strconv.Atoi(c.DefaultQuery("limit", "50")); err != nil || filter.Limit < 1 || filter.Limit > 500 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 500"})
+		return
+	}
+
+	records, err := ledger.List(context.Background(), database.DB, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch payments"})
+		return
+	}
+	c.JSON(http.StatusOK, records)
+}
+
+// Drives an order through the fake gateway, which then posts the matching
+// notification to our webhook. Only routed when PAYMENT_GATEWAY=fake.
+func FakeGatewayNotifyHandler(c *gin.Context) {
+	fake, ok := payments.(*gateway.Fake)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Fake gateway is not enabled"})
+		return
+	}
+
+	outcome, err := fake.Notify(c.Request.Context(), c.Param("orderId"), c.Param("status"))
+	if errors.Is(err, gateway.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Notification sent", "outcome": outcome})
+}
+
+// Admin refund of all or part of a captured payment
+func RefundPaymentHandler(c *gin.Context) {
+	var payload struct {
+		Amount float64 `json:"amount"`
+		Reason string  `json:"reason" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request. 'reason' field is required."})
+		return
+	}
+
+	adminID, _ := c.Get("userID")
+	refund, err := ledger.IssueRefund(context.Background(), database.DB, payments, ledger.RefundRequest{
+		OrderID:     c.Param("orderId"),
+		Amount:      payload.Amount,
+		Reason:      payload.Reason,
+		AdminUserID: adminID.(int),
 	})
+	switch {
+	case errors.Is(err, ledger.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found"})
+		return
+	case errors.Is(err, ledger.ErrNotRefundable):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, ledger.ErrInvalidRefund), errors.Is(err, ledger.ErrRefundTooLarge):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case err != nil && refund.Status == ledger.RefundFailed:
+		fmt.Printf("Error refunding payment %s: %v\n", c.Param("orderId"), err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "The payment gateway refused the refund", "refund": refund})
+		return
+	case err != nil:
+		fmt.Printf("Error refunding payment %s: %v\n", c.Param("orderId"), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refund payment"})
+		return
+	}
+	c.JSON(http.StatusOK, refund)
+}
+
+// Refunds still waiting for their result, so an admin can retry them
+func GetStuckRefundsHandler(c *gin.Context) {
+	refunds, err := ledger.StuckRefunds(context.Background(), database.DB, time.Minute)
+	if err != nil {
+		fmt.Printf("Error fetching stuck refunds: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch refunds"})
+		return
+	}
+	c.JSON(http.StatusOK, refunds)
+}
+
+// Sends a refund that never got its result recorded to the gateway again
+func RetryRefundHandler(c *gin.Context) {
+	adminID, _ := c.Get("userID")
+	refund, err := ledger.RetryRefund(context.Background(), database.DB, payments, c.Param("refundKey"), adminID.(int))
+	switch {
+	case errors.Is(err, ledger.ErrRefundNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Refund not found"})
+		return
+	case errors.Is(err, ledger.ErrRefundFinished):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "refund": refund})
+		return
+	case err != nil && refund.Status == ledger.RefundFailed:
+		fmt.Printf("Error retrying refund %s: %v\n", c.Param("refundKey"), err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "The payment gateway refused the refund", "refund": refund})
+		return
+	case err != nil:
+		fmt.Printf("Error retrying refund %s: %v\n", c.Param("refundKey"), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retry refund"})
+		return
+	}
+	c.JSON(http.StatusOK, refund)
+}
+
+// Refund audit trail of one payment
+func GetPaymentRefundsHandler(c *gin.Context) {
+	refunds, err := ledger.Refunds(context.Background(), database.DB, c.Param("orderId"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch refunds"})
+		return
+	}
+	c.JSON(http.StatusOK, refunds)
 }
@@ -0,0 +1,239 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/Zeropeepo/sea-catering-backend/database"
+	"github.com/Zeropeepo/sea-catering-backend/pricing"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+type Plan struct {
+	ID           int      `json:"id"`
+	Name         string   `json:"name"`
+	PricePerMeal float64  `json:"pricePerMeal"`
+	Description  string   `json:"description"`
+	ImageURL     string   `json:"imageUrl"`
+	Details      []string `json:"details"`
+	MealTypes    []string `json:"mealTypes"`
+	IsActive     bool     `json:"isActive"`
+}
+
+type PlanInput struct {
+	Name         string   `json:"name" binding:"required"`
+	PricePerMeal float64  `json:"pricePerMeal" binding:"required,gt=0"`
+	Description  string   `json:"description"`
+	ImageURL     string   `json:"imageUrl"`
+	Details      []string `json:"details"`
+	MealTypes    []string `json:"mealTypes" binding:"required,min=1"`
+}
+
+var (
+	errPlanNotFound = errors.New("plan not found")
+	errPlanRetired  = errors.New("plan is no longer available")
+)
+
+const planColumns = `id, name, price_per_meal, description, image_url, details, meal_types, is_active`
+
+func scanPlan(row pgx.Row) (Plan, error) {
+	var p Plan
+	err := row.Scan(&p.ID, &p.Name, &p.PricePerMeal, &p.Description, &p.ImageURL, &p.Details, &p.MealTypes, &p.IsActive)
+	return p, err
+}
+
+// PricingPlan returns the fields of the plan that the pricing engine needs.
+func (p Plan) PricingPlan() pricing.Plan {
+	return pricing.Plan{Name: p.Name, PricePerMeal: p.PricePerMeal, MealTypes: p.MealTypes}
+}
+
+// findActivePlanByName looks up a plan a customer may still subscribe to.
+func findActivePlanByName(ctx context.Context, name string) (Plan, error) {
+	plan, err := scanPlan(database.DB.QueryRow(ctx, `SELECT `+planColumns+` FROM plans WHERE name = $1`, name))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Plan{}, errPlanNotFound
+	}
+	if err != nil {
+		return Plan{}, err
+	}
+	if !plan.IsActive {
+		return Plan{}, errPlanRetired
+	}
+	return plan, nil
+}
+
+func validatePlanInput(input PlanInput) error {
+	for _, meal := range input.MealTypes {
+		valid := false
+		for _, allowed := range pricing.MealTypes {
+			if meal == allowed {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return fmt.Errorf("invalid meal type %q", meal)
+		}
+	}
+	return nil
+}
+
+// Public listing of the plans customers can subscribe to
+func GetPlansHandler(c *gin.Context) {
+	rows, err := database.DB.Query(context.Background(), `SELECT `+planColumns+` FROM plans WHERE is_active ORDER BY price_per_meal ASC`)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch plans"})
+		return
+	}
+	defer rows.Close()
+
+	plans := make([]Plan, 0)
+	for rows.Next() {
+		plan, err := scanPlan(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process plans"})
+			return
+		}
+		plans = append(plans, plan)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading plans data"})
+		return
+	}
+	c.JSON(http.StatusOK, plans)
+}
+
+// Single plan lookup. Retired plans are still returned so existing subscriptions can show them.
+func GetPlanHandler(c *gin.Context) {
+	planID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid plan ID format"})
+		return
+	}
+
+	plan, err := scanPlan(database.DB.QueryRow(context.Background(), `SELECT `+planColumns+` FROM plans WHERE id = $1`, planID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Plan not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch plan"})
+		return
+	}
+	c.JSON(http.StatusOK, plan)
+}
+
+// Admin listing, including retired plans
+func GetAdminPlansHandler(c *gin.Context) {
+	rows, err := database.DB.Query(context.Background(), `SELECT `+planColumns+` FROM plans ORDER BY is_active DESC, price_per_meal ASC`)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch plans"})
+		return
+	}
+	defer rows.Close()
+
+	plans := make([]Plan, 0)
+	for rows.Next() {
+		plan, err := scanPlan(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process plans"})
+			return
+		}
+		plans = append(plans, plan)
+	}
+	c.JSON(http.StatusOK, plans)
+}
+
+func CreatePlanHandler(c *gin.Context) {
+	var input PlanInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data: " + err.Error()})
+		return
+	}
+	if err := validatePlanInput(input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data: " + err.Error()})
+		return
+	}
+	if input.Details == nil {
+		input.Details = []string{}
+	}
+
+	sqlStatement := `
+		INSERT INTO plans (name, price_per_meal, description, image_url, details, meal_types)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING ` + planColumns
+	plan, err := scanPlan(database.DB.QueryRow(context.Background(), sqlStatement,
+		input.Name, input.PricePerMeal, input.Description, input.ImageURL, input.Details, input.MealTypes))
+	if err != nil {
+		fmt.Printf("Error creating plan: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create plan. Name may already be in use."})
+		return
+	}
+	c.JSON(http.StatusOK, plan)
+}
+
+// Existing subscriptions keep the price they were created with, renewals
+// included; only new quotes and plan changes see the new price.
+func UpdatePlanHandler(c *gin.Context) {
+	planID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid plan ID format"})
+		return
+	}
+
+	var input PlanInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data: " + err.Error()})
+		return
+	}
+	if err := validatePlanInput(input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data: " + err.Error()})
+		return
+	}
+	if input.Details == nil {
+		input.Details = []string{}
+	}
+
+	sqlStatement := `
+		UPDATE plans
+		SET name = $1, price_per_meal = $2, description = $3, image_url = $4, details = $5, meal_types = $6, updated_at = now()
+		WHERE id = $7
+		RETURNING ` + planColumns
+	plan, err := scanPlan(database.DB.QueryRow(context.Background(), sqlStatement,
+		input.Name, input.PricePerMeal, input.Description, input.ImageURL, input.Details, input.MealTypes, planID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Plan not found"})
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error updating plan %d: %v\n", planID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update plan"})
+		return
+	}
+	c.JSON(http.StatusOK, plan)
+}
+
+// Retiring hides a plan from new subscriptions without touching existing ones
+func RetirePlanHandler(c *gin.Context) {
+	planID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid plan ID format"})
+		return
+	}
+
+	result, err := database.DB.Exec(context.Background(),
+		`UPDATE plans SET is_active = false, updated_at = now() WHERE id = $1`, planID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retire plan"})
+		return
+	}
+	if result.RowsAffected() == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Plan not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Plan retired successfully"})
+}
@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Zeropeepo/sea-catering-backend/database"
+	"github.com/Zeropeepo/sea-catering-backend/promo"
+	"github.com/gin-gonic/gin"
+)
+
+type PromoCodeInput struct {
+	Code                  string     `json:"code" binding:"required"`
+	Description           string     `json:"description"`
+	Kind                  string     `json:"kind" binding:"required"`
+	Value                 float64    `json:"value" binding:"required,gt=0"`
+	StartsAt              *time.Time `json:"startsAt"`
+	EndsAt                *time.Time `json:"endsAt"`
+	MaxRedemptions        *int       `json:"maxRedemptions"`
+	MaxPerUser            *int       `json:"maxPerUser"`
+	PlanIDs               []int      `json:"planIds"`
+	FirstSubscriptionOnly bool       `json:"firstSubscriptionOnly"`
+	IsActive              *bool      `json:"isActive"`
+}
+
+func (in PromoCodeInput) code() promo.Code {
+	// New codes are active unless the admin says otherwise
+	active := in.IsActive == nil || *in.IsActive
+	return promo.Code{
+		Code:                  in.Code,
+		Description:           in.Description,
+		Kind:                  in.Kind,
+		Value:                 in.Value,
+		StartsAt:              in.StartsAt,
+		EndsAt:                in.EndsAt,
+		MaxRedemptions:        in.MaxRedemptions,
+		MaxPerUser:            in.MaxPerUser,
+		PlanIDs:               in.PlanIDs,
+		FirstSubscriptionOnly: in.FirstSubscriptionOnly,
+		IsActive:              active,
+	}
+}
+
+// Admin listing of every promo code
+func GetAdminPromoCodesHandler(c *gin.Context) {
+	codes, err := promo.List(context.Background(), database.DB)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch promo codes"})
+		return
+	}
+	c.JSON(http.StatusOK, codes)
+}
+
+func CreatePromoCodeHandler(c *gin.Context) {
+	var input PromoCodeInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data: " + err.Error()})
+		return
+	}
+
+	code, err := promo.Create(context.Background(), database.DB, input.code())
+	if !writePromoError(c, err, "create") {
+		c.JSON(http.StatusOK, code)
+	}
+}
+
+// Changes apply to future redemptions; codes already reserved keep their place
+func UpdatePromoCodeHandler(c *gin.Context) {
+	codeID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid promo code ID format"})
+		return
+	}
+
+	var input PromoCodeInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data: " + err.Error()})
+		return
+	}
+
+	update := input.code()
+	update.ID = codeID
+	code, err := promo.Update(context.Background(), database.DB, update)
+	if !writePromoError(c, err, "update") {
+		c.JSON(http.StatusOK, code)
+	}
+}
+
+// Deactivating keeps the code and its redemptions but stops new ones
+func DeactivatePromoCodeHandler(c *gin.Context) {
+	codeID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid promo code ID format"})
+		return
+	}
+
+	err = promo.Deactivate(context.Background(), database.DB, codeID)
+	if !writePromoError(c, err, "deactivate") {
+		c.JSON(http.StatusOK, gin.H{"message": "Promo code deactivated successfully"})
+	}
+}
+
+// Who used a promo code and on which payment
+func GetPromoCodeRedemptionsHandler(c *gin.Context) {
+	codeID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid promo code ID format"})
+		return
+	}
+
+	redemptions, err := promo.Redemptions(context.Background(), database.DB, codeID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch promo code redemptions"})
+		return
+	}
+	c.JSON(http.StatusOK, redemptions)
+}
+
+// The logged in customer's referral code, made the first time it is asked
+// for, and what it has earned them so far
+func GetReferralCodeHandler(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	ctx := context.Background()
+
+	code, err := promo.ReferralCode(ctx, database.DB, userID.(int))
+	if err != nil {
+		fmt.Printf("Error fetching referral code of user %v: %v\n", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch referral code"})
+		return
+	}
+	referrals, credit, err := promo.Referrals(ctx, database.DB, userID.(int))
+	if err != nil {
+		fmt.Printf("Error counting referrals of user %v: %v\n", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch referral code"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"code":            code.Code,
+		"discountPercent": code.Value,
+		"reward":          promo.ReferralReward(),
+		"referrals":       referrals,
+		"creditEarned":    credit,
+	})
+}
+
+// writePromoError answers an admin promo request that failed and reports
+// whether there was an error to answer.
+func writePromoError(c *gin.Context, err error, action string) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, promo.ErrInvalidCode):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data: " + err.Error()})
+	case errors.Is(err, promo.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Promo code not found"})
+	case errors.Is(err, promo.ErrDuplicateCode):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		fmt.Printf("Error trying to %s promo code: %v\n", action, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to " + action + " promo code"})
+	}
+	return true
+}
@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Zeropeepo/sea-catering-backend/database"
+	"github.com/Zeropeepo/sea-catering-backend/rbac"
+	"github.com/gin-gonic/gin"
+)
+
+// User roles, looked up through a short-lived cache set up at startup
+var roles *rbac.Cache
+
+func SetRoleCache(c *rbac.Cache) {
+	roles = c
+}
+
+type RoleInfo struct {
+	Role        rbac.Role         `json:"role"`
+	Permissions []rbac.Permission `json:"permissions"`
+}
+
+type AdminUser struct {
+	ID            int       `json:"id"`
+	FullName      string    `json:"fullName"`
+	Email         string    `json:"email"`
+	Role          rbac.Role `json:"role"`
+	EmailVerified bool      `json:"emailVerified"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+type RoleAssignment struct {
+	Role rbac.Role `json:"role" binding:"required"`
+}
+
+// Every role and what it may do
+func GetRolesHandler(c *gin.Context) {
+	list := make([]RoleInfo, 0, len(rbac.Roles))
+	for role, perms := range rbac.Roles {
+		list = append(list, RoleInfo{Role: role, Permissions: perms})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Role < list[j].Role })
+	c.JSON(http.StatusOK, list)
+}
+
+// Admin listing of users, filterable by role and email
+func GetAdminUsersHandler(c *gin.Context) {
+	query := `SELECT id, full_name, email, role, email_verified_at IS NOT NULL, created_at FROM users WHERE true`
+	var args []any
+	add := func(clause string, arg any) {
+		args = append(args, arg)
+		query += fmt.Sprintf(" AND "+clause, len(args))
+	}
+	if v := c.Query("role"); v != "" {
+		if !rbac.Role(v).Valid() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown role"})
+			return
+		}
+		add("role = $%d", v)
+	}
+	if v := c.Query("email"); v != "" {
+		add("strpos(lower(email), $%d) > 0", strings.ToLower(v))
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 500 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 500"})
+		return
+	}
+	args = append(args, limit)
+	query += fmt.Sprintf(" ORDER BY id LIMIT $%d", len(args))
+
+	rows, err := database.DB.Query(context.Background(), query, args...)
+	if err != nil {
+		fmt.Printf("Error listing users: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch users"})
+		return
+	}
+	defer rows.Close()
+
+	users := make([]AdminUser, 0)
+	for rows.Next() {
+		var u AdminUser
+		if err := rows.Scan(&u.ID, &u.FullName, &u.Email, &u.Role, &u.EmailVerified, &u.CreatedAt); err != nil {
+			fmt.Printf("Error scanning user: %v\n", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch users"})
+			return
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch users"})
+		return
+	}
+	c.JSON(http.StatusOK, users)
+}
+
+// Assigns a role to a user. Admins cannot change their own role, so the
+// last admin cannot lock everyone out by accident.
+func UpdateUserRoleHandler(c *gin.Context) {
+	adminID, _ := c.Get("userID")
+
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+	if userID == adminID.(int) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot change your own role"})
+		return
+	}
+
+	var input RoleAssignment
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data: " + err.Error()})
+		return
+	}
+
+	err = roles.SetRole(context.Background(), userID, input.Role)
+	switch {
+	case errors.Is(err, rbac.ErrUnknownRole):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, rbac.ErrUserNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	case err != nil:
+		fmt.Printf("Error setting role of user %d: %v\n", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update role"})
+		return
+	}
+
+	fmt.Printf("User %v set the role of user %d to %s\n", adminID, userID, input.Role)
+	c.JSON(http.StatusOK, gin.H{"message": "Role updated successfully", "userId": userID, "role": input.Role})
+}
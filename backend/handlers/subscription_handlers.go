@@ -2,16 +2,20 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
-	"os" 
 	"strconv" 
-	"strings" 
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/Zeropeepo/sea-catering-backend/billing"
 	"github.com/Zeropeepo/sea-catering-backend/database"
-	"crypto/sha512"
-    "encoding/hex"
+	"github.com/Zeropeepo/sea-catering-backend/delivery"
+	"github.com/Zeropeepo/sea-catering-backend/ledger"
+	"github.com/Zeropeepo/sea-catering-backend/lifecycle"
+	"github.com/Zeropeepo/sea-catering-backend/pricing"
+	"github.com/Zeropeepo/sea-catering-backend/promo"
 )
 
 type Subscription struct {
@@ -22,18 +26,28 @@ type Subscription struct {
 	SelectedDays  []string `json:"selectedDays"`
 	Allergies     string   `json:"allergies"`
 	TotalPrice    float64  `json:"totalPrice"`
+	PromoCode     string   `json:"promoCode"`
 }
 
 
 type UserSubscription struct {
-	ID           int      `json:"id"`
-	PlanName     string   `json:"planName"`
-	MealTypes    []string `json:"mealTypes"`
-	DeliveryDays []string `json:"deliveryDays"`
-	TotalPrice   float64  `json:"totalPrice"`
-	Status       string   `json:"status"`
+	ID                 int         `json:"id"`
+	PlanName           string      `json:"planName"`
+	MealTypes          []string    `json:"mealTypes"`
+	DeliveryDays       []string    `json:"deliveryDays"`
+	TotalPrice         float64     `json:"totalPrice"`
+	Status             string      `json:"status"`
+	PauseStart         *time.Time  `json:"pauseStart"`
+	PauseEnd           *time.Time  `json:"pauseEnd"`
+	CreditBalance      float64     `json:"creditBalance"`
+	CurrentPeriodStart *time.Time  `json:"currentPeriodStart"`
+	CurrentPeriodEnd   *time.Time  `json:"currentPeriodEnd"`
+	UpcomingDeliveries []time.Time `json:"upcomingDeliveries"`
 }
 
+// How far ahead the subscriptions listing looks for deliveries
+const upcomingDeliveryDays = 14
+
 // Handler for GetUserSubscription
 func GetUserSubscriptionsHandler(c *gin.Context) {
 	userID, exists := c.Get("userID")
@@ -43,7 +57,8 @@ func GetUserSubscriptionsHandler(c *gin.Context) {
 	}
 
 	sqlStatement := `
-		SELECT id, plan_name, meal_types, delivery_days, total_price, status
+		SELECT id, plan_name, meal_types, delivery_days, total_price, status, pause_start, pause_end, credit_balance,
+			current_period_start, current_period_end
 		FROM subscriptions
 		WHERE user_id = $1
 		ORDER BY created_at DESC`
@@ -59,10 +74,24 @@ func GetUserSubscriptionsHandler(c *gin.Context) {
 	for rows.Next() {
 		var sub UserSubscription
 
-		if err := rows.Scan(&sub.ID, &sub.PlanName, &sub.MealTypes, &sub.DeliveryDays, &sub.TotalPrice, &sub.Status); err != nil {
+		if err := rows.Scan(&sub.ID, &sub.PlanName, &sub.MealTypes, &sub.DeliveryDays, &sub.TotalPrice, &sub.Status,
+			&sub.PauseStart, &sub.PauseEnd, &sub.CreditBalance, &sub.CurrentPeriodStart, &sub.CurrentPeriodEnd); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process subscription data"})
 			return
 		}
+
+		// Days inside a pause window are not delivered; deliveries carry on through the grace period
+		sub.UpcomingDeliveries = []time.Time{}
+		if sub.Status == string(lifecycle.Active) || sub.Status == string(lifecycle.PastDue) || sub.Status == string(lifecycle.Paused) {
+			var skip []delivery.Window
+			if sub.PauseStart != nil && sub.PauseEnd != nil {
+				skip = append(skip, delivery.Window{Start: delivery.Date(*sub.PauseStart), End: delivery.Date(*sub.PauseEnd)})
+			}
+			today := time.Now()
+			if sub.Status != string(lifecycle.Paused) || len(skip) > 0 {
+				sub.UpcomingDeliveries = delivery.Dates(sub.DeliveryDays, today, today.AddDate(0, 0, upcomingDeliveryDays-1), skip...)
+			}
+		}
 		subscriptions = append(subscriptions, sub)
 	}
 	c.JSON(http.StatusOK, subscriptions)
@@ -81,25 +110,62 @@ func SubscribeHandler(c *gin.Context) {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization context not found"})
 		return
 	}
-	
+
+	plan, quote, validationErrors, err := quoteSubscription(context.Background(), sub, userID.(int))
+	if err != nil {
+		fmt.Printf("Error quoting subscription: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to price subscription"})
+		return
+	}
+	if len(validationErrors) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subscription: " + validationErrors[0], "errors": validationErrors, "quote": quote})
+		return
+	}
+
 	// MODIFIED SQL: Added 'status' column to the insert with a default value of 'pending'
 	sqlStatement := `
-		INSERT INTO subscriptions (name, phone_number, plan_name, meal_types, delivery_days, allergies, total_price, user_id, status)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, 'pending')
+		INSERT INTO subscriptions (name, phone_number, plan_name, meal_types, delivery_days, allergies, total_price, user_id, status, plan_id, price_breakdown)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, 'pending', $9, $10)
 		RETURNING id`
 	
+	ctx := context.Background()
+	tx, err := database.DB.Begin(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create subscription"})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	// The monthly price; promo discounts only come off the first period
+	regular := quote.Undiscounted()
 	var id int
-	err := database.DB.QueryRow(context.Background(), sqlStatement,
+	err = tx.QueryRow(ctx, sqlStatement,
 		sub.Name,
 		sub.Phone,
 		sub.SelectedPlan,
 		sub.SelectedMeals,
 		sub.SelectedDays,
 		sub.Allergies,
-		sub.TotalPrice,
+		regular.Total,
 		userID.(int),
+		plan.ID,
+		regular,
 	).Scan(&id)
 
+	if err == nil {
+		err = lifecycle.RecordCreated(ctx, tx, id, lifecycle.Pending, lifecycle.ActorUser, userID.(int))
+	}
+	if err == nil && sub.PromoCode != "" {
+		// The quote checked the code without holding it; another subscriber may have used it up since
+		_, err = promo.Reserve(ctx, tx, sub.PromoCode, userID.(int), plan.ID, id)
+		if promo.IsRejection(err) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subscription: " + err.Error(), "errors": []string{err.Error()}, "quote": quote})
+			return
+		}
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
 	if err != nil {
 		fmt.Printf("Error inserting subscription: %v\n", err) 
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create subscription"})
@@ -109,6 +175,84 @@ func SubscribeHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Subscription created, pending payment.",
 		"subscriptionId": id,
+		"quote": quote,
+	})
+}
+
+// quoteSubscription prices a subscription request for userID exactly as
+// SubscribeHandler would and collects every validation problem. The quote is
+// nil when the selection cannot be priced at all. err is only set for
+// internal failures.
+func quoteSubscription(ctx context.Context, sub Subscription, userID int) (Plan, *pricing.Quote, []string, error) {
+	validationErrors := make([]string, 0)
+
+	plan, err := findActivePlanByName(ctx, sub.SelectedPlan)
+	if errors.Is(err, errPlanNotFound) || errors.Is(err, errPlanRetired) {
+		validationErrors = append(validationErrors, err.Error())
+		return plan, nil, validationErrors, nil
+	}
+	if err != nil {
+		return plan, nil, nil, err
+	}
+
+	for _, e := range pricing.Validate(plan.PricingPlan(), sub.SelectedMeals, sub.SelectedDays) {
+		validationErrors = append(validationErrors, e.Error())
+	}
+	if len(validationErrors) > 0 {
+		return plan, nil, validationErrors, nil
+	}
+
+	// The client total is only a hint; the server price is the one we store and charge.
+	quote, err := pricing.Calculate(plan.PricingPlan(), sub.SelectedMeals, sub.SelectedDays)
+	if err != nil {
+		return plan, nil, append(validationErrors, err.Error()), nil
+	}
+	if sub.PromoCode != "" {
+		code, err := promo.Check(ctx, database.DB, sub.PromoCode, userID, plan.ID)
+		switch {
+		case promo.IsRejection(err):
+			validationErrors = append(validationErrors, err.Error())
+		case err != nil:
+			return plan, nil, nil, err
+		default:
+			quote = quote.WithDiscount(pricing.LineItem{
+				Code:        "PROMO",
+				Description: fmt.Sprintf("Promo %s on the first month", code.Code),
+				Amount:      code.Discount(quote.Subtotal),
+			})
+		}
+	}
+	if sub.TotalPrice != 0 && !quote.Matches(sub.TotalPrice) {
+		validationErrors = append(validationErrors, "total price does not match the server quote")
+	}
+	return plan, &quote, validationErrors, nil
+}
+
+// Previewing a subscription price without creating anything
+func QuoteSubscriptionHandler(c *gin.Context) {
+	var sub Subscription
+	if err := c.ShouldBindJSON(&sub); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data: " + err.Error()})
+		return
+	}
+
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization context not found"})
+		return
+	}
+
+	_, quote, validationErrors, err := quoteSubscription(context.Background(), sub, userID.(int))
+	if err != nil {
+		fmt.Printf("Error quoting subscription: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to price subscription"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"valid":  len(validationErrors) == 0,
+		"errors": validationErrors,
+		"quote":  quote,
 	})
 }
 
@@ -121,11 +265,18 @@ func UpdateSubscriptionStatusHandler(c *gin.Context) {
     }
 
     // Get the subscription ID from the URL parameter (e.g., /api/subscriptions/123/status)
-    subscriptionID := c.Param("id")
+    subscriptionID, err := strconv.Atoi(c.Param("id"))
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subscription ID format"})
+        return
+    }
 
     // Bind the new status from the request body
     var payload struct {
-        Status string `json:"status" binding:"required"` 
+        Status     string `json:"status" binding:"required"` 
+        Reason     string `json:"reason"`
+        PauseStart string `json:"pauseStart"`
+        PauseEnd   string `json:"pauseEnd"`
     }
 
     if err := c.ShouldBindJSON(&payload); err != nil {
@@ -138,94 +289,255 @@ func UpdateSubscriptionStatusHandler(c *gin.Context) {
 		return
 	}
 
-    sqlStatement := `
-        UPDATE subscriptions
-        SET status = $1
-        WHERE id = $2 AND user_id = $3`
+    req := lifecycle.Request{
+        SubscriptionID: subscriptionID,
+        UserID:         userID.(int),
+        To:             lifecycle.Status(payload.Status),
+        Actor:          lifecycle.ActorUser,
+        ActorUserID:    userID.(int),
+        Reason:         payload.Reason,
+    }
 
-    result, err := database.DB.Exec(context.Background(), sqlStatement, payload.Status, subscriptionID, userID)
-    if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update subscription status"})
+    // Pausing always takes a date range; the subscription resumes by itself when it ends
+    if req.To == lifecycle.Paused {
+        window, err := parsePauseWindow(payload.PauseStart, payload.PauseEnd)
+        if err == nil {
+            err = lifecycle.ValidatePause(window, time.Now())
+        }
+        if err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+
+        pausedNow, err := lifecycle.SchedulePause(context.Background(), database.DB, req, window)
+        if errors.Is(err, lifecycle.ErrNotFound) {
+            c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found or you do not have permission to modify it"})
+            return
+        }
+        if errors.Is(err, lifecycle.ErrIllegalTransition) {
+            c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+            return
+        }
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update subscription status"})
+            return
+        }
+
+        message := "Subscription pause scheduled from " + payload.PauseStart + " to " + payload.PauseEnd
+        if pausedNow {
+            message = "Subscription paused from " + payload.PauseStart + " to " + payload.PauseEnd
+        }
+        c.JSON(http.StatusOK, gin.H{"message": message})
         return
     }
 
-    if result.RowsAffected() == 0 {
+    _, err = lifecycle.Apply(context.Background(), database.DB, req)
+    if errors.Is(err, lifecycle.ErrNotFound) {
         c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found or you do not have permission to modify it"})
         return
     }
+    if errors.Is(err, lifecycle.ErrIllegalTransition) {
+        c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+        return
+    }
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update subscription status"})
+        return
+    }
+    if req.To == lifecycle.Cancelled {
+        cancelOpenOrders(subscriptionID)
+    }
 
     c.JSON(http.StatusOK, gin.H{"message": "Subscription status updated successfully to " + payload.Status})
 }
 
-func MidtransNotificationHandler(c *gin.Context) {
-    fmt.Println("--- Midtrans Webhook Received ---") // Log that the handler was hit
+// cancelOpenOrders voids the gateway orders of the periods dropped when a
+// subscription ends, so none of them can still be paid. The status change
+// stands if this fails; the error is only logged.
+func cancelOpenOrders(subscriptionID int) {
+	if err := ledger.CancelOutstanding(context.Background(), database.DB, subscriptionID, payments.Cancel); err != nil {
+		fmt.Printf("Error cancelling orders of subscription %d after it ended: %v\n", subscriptionID, err)
+	}
+}
 
-    var notificationPayload map[string]interface{}
-    if err := c.ShouldBindJSON(&notificationPayload); err != nil {
-        fmt.Println("Webhook Error: Could not bind JSON payload.", err)
-        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid notification payload"})
-        return
+func parsePauseWindow(start, end string) (delivery.Window, error) {
+    if start == "" || end == "" {
+        return delivery.Window{}, fmt.Errorf("%w: pauseStart and pauseEnd are required", lifecycle.ErrInvalidPause)
     }
-
-    // Safely get all required fields from the payload
-    orderId, _ := notificationPayload["order_id"].(string)
-    statusCode, _ := notificationPayload["status_code"].(string)
-    grossAmount, _ := notificationPayload["gross_amount"].(string)
-    signatureKey, _ := notificationPayload["signature_key"].(string)
-    transactionStatus, _ := notificationPayload["transaction_status"].(string)
-
-    fmt.Printf("Received Order ID: %s, Status: %s\n", orderId, transactionStatus)
-
-    // --- Signature Key Verification ---
-    serverKey := os.Getenv("MIDTRANS_SERVER_KEY")
-    stringToHash := orderId + statusCode + grossAmount + serverKey
-    
-    hasher := sha512.New()
-    hasher.Write([]byte(stringToHash))
-    
-    calculatedHash := hex.EncodeToString(hasher.Sum(nil))
-
-    fmt.Printf("Comparing Hashes:\n  - Signature from Midtrans: %s\n  - Calculated Signature: %s\n", signatureKey, calculatedHash)
-
-    if calculatedHash != signatureKey {
-        fmt.Println("Webhook Error: Invalid signature.")
-        c.JSON(http.StatusForbidden, gin.H{"error": "Invalid signature"})
-        return
+    startDate, err := delivery.ParseDate(start)
+    if err != nil {
+        return delivery.Window{}, fmt.Errorf("%w: invalid pauseStart format", lifecycle.ErrInvalidPause)
     }
-    
-    fmt.Println("Webhook Signature is VALID.")
-
-    if transactionStatus == "capture" || transactionStatus == "settlement" {
-        fmt.Printf("Processing successful payment for Order ID: %s\n", orderId)
-        
-        parts := strings.Split(orderId, "-")
-        if len(parts) < 2 {
-            fmt.Println("Webhook Error: Could not parse subscription ID from order_id.")
-            c.JSON(http.StatusOK, gin.H{"message": "OK, but order ID format is incorrect."})
-            return
-        }
+    endDate, err := delivery.ParseDate(end)
+    if err != nil {
+        return delivery.Window{}, fmt.Errorf("%w: invalid pauseEnd format", lifecycle.ErrInvalidPause)
+    }
+    return delivery.Window{Start: startDate, End: endDate}, nil
+}
 
-        subscriptionID, err := strconv.Atoi(parts[1])
-        if err != nil {
-            fmt.Println("Webhook Error: Could not convert subscription ID to int.", err)
-            c.JSON(http.StatusOK, gin.H{"message": "OK, but could not parse subscription ID."})
-            return
-        }
+// Cancels a pause the user scheduled that has not started yet
+func CancelScheduledPauseHandler(c *gin.Context) {
+	userID, _ := c.Get("userID")
 
-        sqlStatement := `UPDATE subscriptions SET status = 'active' WHERE id = $1 AND status = 'pending'`
-        result, err := database.DB.Exec(context.Background(), sqlStatement, subscriptionID)
-        if err != nil {
-            fmt.Println("Webhook Error: Database update failed.", err)
-            c.JSON(http.StatusOK, gin.H{"message": "OK, but DB update failed."})
-            return
-        }
+	subscriptionID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subscription ID format"})
+		return
+	}
 
-        if result.RowsAffected() > 0 {
-            fmt.Printf("SUCCESS: Subscription %d activated.\n", subscriptionID)
-        } else {
-            fmt.Printf("INFO: No 'pending' subscription found to activate for ID %d.\n", subscriptionID)
-        }
-    }
-		
-    c.JSON(http.StatusOK, gin.H{"message": "Notification processed successfully."})
+	err = lifecycle.CancelScheduledPause(context.Background(), database.DB, subscriptionID, userID.(int))
+	switch {
+	case errors.Is(err, lifecycle.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found or you do not have permission to modify it"})
+		return
+	case errors.Is(err, lifecycle.ErrNoScheduledPause):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		fmt.Printf("Error cancelling pause of subscription %d: %v\n", subscriptionID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel the pause"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Scheduled pause cancelled"})
+}
+
+// Status history of a subscription the user owns
+func GetSubscriptionHistoryHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	subscriptionID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subscription ID format"})
+		return
+	}
+
+	var owned bool
+	err = database.DB.QueryRow(context.Background(),
+		"SELECT EXISTS (SELECT 1 FROM subscriptions WHERE id = $1 AND user_id = $2)", subscriptionID, userID).Scan(&owned)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch subscription history"})
+		return
+	}
+	if !owned {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found or you do not have permission"})
+		return
+	}
+
+	events, err := lifecycle.History(context.Background(), database.DB, subscriptionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch subscription history"})
+		return
+	}
+	c.JSON(http.StatusOK, events)
+}
+
+// Changing the plan, meals or delivery days of a subscription the user owns
+func UpdateSubscriptionHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	subscriptionID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subscription ID format"})
+		return
+	}
+
+	var sub Subscription
+	if err := c.ShouldBindJSON(&sub); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data: " + err.Error()})
+		return
+	}
+
+	// Promo codes are for new subscriptions only
+	sub.PromoCode = ""
+	plan, quote, validationErrors, err := quoteSubscription(context.Background(), sub, userID.(int))
+	if err != nil {
+		fmt.Printf("Error quoting subscription: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to price subscription"})
+		return
+	}
+	if len(validationErrors) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subscription: " + validationErrors[0], "errors": validationErrors, "quote": quote})
+		return
+	}
+
+	result, err := billing.ChangePlan(context.Background(), database.DB, payments, billing.ChangeRequest{
+		SubscriptionID: subscriptionID,
+		UserID:         userID.(int),
+		PlanID:         plan.ID,
+		Plan:           plan.PricingPlan(),
+		MealTypes:      sub.SelectedMeals,
+		DeliveryDays:   sub.SelectedDays,
+	})
+	switch {
+	case errors.Is(err, lifecycle.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found or you do not have permission"})
+		return
+	case errors.Is(err, billing.ErrNoChange):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, billing.ErrNotChangeable), errors.Is(err, billing.ErrRenewalOpen):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		fmt.Printf("Error changing subscription %d: %v\n", subscriptionID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change subscription"})
+		return
+	}
+
+	// Upgrades take effect once the prorated difference is paid
+	var payment gin.H
+	if result.Checkout != nil {
+		payment = gin.H{
+			"snapToken":   result.Checkout.Charge.Token,
+			"redirectUrl": result.Checkout.Charge.RedirectURL,
+			"orderId":     result.Checkout.OrderID,
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"change":  result.Change,
+		"quote":   quote,
+		"payment": payment,
+	})
+}
+
+// Plan changes requested on a subscription the user owns
+func GetSubscriptionChangesHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	subscriptionID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subscription ID format"})
+		return
+	}
+
+	var owned bool
+	err = database.DB.QueryRow(context.Background(),
+		"SELECT EXISTS (SELECT 1 FROM subscriptions WHERE id = $1 AND user_id = $2)", subscriptionID, userID).Scan(&owned)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch subscription changes"})
+		return
+	}
+	if !owned {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found or you do not have permission"})
+		return
+	}
+
+	changes, err := lifecycle.Changes(context.Background(), database.DB, subscriptionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch subscription changes"})
+		return
+	}
+	c.JSON(http.StatusOK, changes)
 }
@@ -0,0 +1,273 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/Zeropeepo/sea-catering-backend/account"
+	"github.com/Zeropeepo/sea-catering-backend/database"
+	"github.com/Zeropeepo/sea-catering-backend/session"
+	"github.com/gin-gonic/gin"
+)
+
+type TwoFactorCode struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type TwoFactorLogin struct {
+	Challenge string `json:"challenge" binding:"required"`
+	// Code is from the authenticator app, or a recovery code
+	Code string `json:"code" binding:"required"`
+}
+
+type SecuritySettingsInput struct {
+	RequireAdminTwoFactor *bool `json:"requireAdminTwoFactor" binding:"required"`
+}
+
+// The logged in user's two-factor setup
+func GetTwoFactorStatusHandler(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	status, err := account.TwoFactor(context.Background(), database.DB, userID.(int))
+	if err != nil {
+		fmt.Printf("Error fetching two-factor status of user %v: %v\n", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch two-factor status"})
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+// Starts two-factor setup. The otpauth URI goes into a QR code for the
+// authenticator app; the secret is for typing in by hand.
+func EnrollTwoFactorHandler(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	secret, uri, err := account.StartEnrollment(context.Background(), database.DB, userID.(int))
+	if errors.Is(err, account.ErrTwoFactorEnabled) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, account.ErrEnrollmentDisabled) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error starting two-factor setup for user %v: %v\n", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start two-factor setup"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"secret":     secret,
+		"otpauthUri": uri,
+		"message":    "Add this account to your authenticator app, then confirm with a code from it",
+	})
+}
+
+// Turns two-factor authentication on with a code from the newly set up app
+func ConfirmTwoFactorHandler(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	var input TwoFactorCode
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data: " + err.Error()})
+		return
+	}
+
+	codes, err := account.ConfirmEnrollment(context.Background(), database.DB, userID.(int), input.Code)
+	switch {
+	case errors.Is(err, account.ErrTwoFactorEnabled):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, account.ErrNoEnrollment), errors.Is(err, account.ErrInvalidCode):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		fmt.Printf("Error confirming two-factor setup for user %v: %v\n", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to turn on two-factor authentication"})
+		return
+	}
+
+	fmt.Printf("User %v turned on two-factor authentication\n", userID)
+	c.JSON(http.StatusOK, gin.H{
+		"message":       "Two-factor authentication is on. Store these recovery codes somewhere safe; they will not be shown again.",
+		"recoveryCodes": codes,
+	})
+}
+
+// Turns two-factor authentication off. Users whose role requires it cannot.
+func DisableTwoFactorHandler(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	ctx := context.Background()
+
+	var input TwoFactorCode
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data: " + err.Error()})
+		return
+	}
+
+	status, err := account.TwoFactor(ctx, database.DB, userID.(int))
+	if err != nil {
+		fmt.Printf("Error fetching two-factor status of user %v: %v\n", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to turn off two-factor authentication"})
+		return
+	}
+	if status.Required {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Two-factor authentication is required for your role"})
+		return
+	}
+
+	err = account.DisableTwoFactor(ctx, database.DB, userID.(int), input.Code)
+	switch {
+	case errors.Is(err, account.ErrTwoFactorNotEnabled):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, account.ErrInvalidCode):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		fmt.Printf("Error turning off two-factor authentication for user %v: %v\n", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to turn off two-factor authentication"})
+		return
+	}
+
+	fmt.Printf("User %v turned off two-factor authentication\n", userID)
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication is off"})
+}
+
+// Replaces the recovery codes, given a code from the authenticator app
+func RegenerateRecoveryCodesHandler(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	var input TwoFactorCode
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data: " + err.Error()})
+		return
+	}
+
+	codes, err := account.RegenerateRecoveryCodes(context.Background(), database.DB, userID.(int), input.Code)
+	switch {
+	case errors.Is(err, account.ErrTwoFactorNotEnabled):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, account.ErrInvalidCode):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		fmt.Printf("Error replacing recovery codes for user %v: %v\n", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to replace recovery codes"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message":       "New recovery codes created; the old ones no longer work",
+		"recoveryCodes": codes,
+	})
+}
+
+// Second step of logging in for users with two-factor authentication: the
+// challenge from /login plus a code. Wrong codes count against the same
+// throttles as wrong passwords.
+func LoginTwoFactorHandler(c *gin.Context) {
+	var input TwoFactorLogin
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+
+	ctx := context.Background()
+	attempt := account.LoginAttempt{
+		IPAddress: c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+	}
+	// Only the address is known until the challenge is opened, so only it is
+	// counted up front. The account was checked when the challenge was
+	// issued, and each challenge allows only a few codes.
+	wait, err := authLimits.LoginIP.Take(ctx, attempt.IPAddress)
+	if err != nil {
+		fmt.Printf("Error checking login rate limit: %v\n", err)
+	}
+	if wait > 0 {
+		tooManyAttempts(c, wait)
+		return
+	}
+
+	user, err := account.CompleteChallenge(ctx, database.DB, input.Challenge, input.Code)
+	switch {
+	case errors.Is(err, account.ErrInvalidChallenge), errors.Is(err, account.ErrTwoFactorNotEnabled):
+		refundLogin(ctx, authLimits.LoginIP, attempt.IPAddress)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": account.ErrInvalidChallenge.Error()})
+		return
+	case errors.Is(err, account.ErrInvalidCode):
+		attempt.Email = user.Email
+		attempt.UserID = &user.ID
+		attempt.Outcome = account.LoginBadCode
+		recordLoginAttempt(attempt)
+		if _, err := authLimits.LoginAccount.Hit(ctx, attempt.Email); err != nil {
+			fmt.Printf("Error counting failed login: %v\n", err)
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		refundLogin(ctx, authLimits.LoginIP, attempt.IPAddress)
+		fmt.Printf("Error completing two-factor login: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not log in"})
+		return
+	}
+	attempt.Email = user.Email
+	attempt.UserID = &user.ID
+
+	tokens, err := session.Start(ctx, database.DB, user.ID, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		refundLogin(ctx, authLimits.LoginIP, attempt.IPAddress)
+		fmt.Println("Error: Could not generate token.", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate token"})
+		return
+	}
+
+	attempt.Outcome = account.LoginSucceeded
+	recordLoginAttempt(attempt)
+	loginSucceeded(ctx, attempt)
+	body := tokenResponse(c, tokens)
+	body["message"] = "Login successful!"
+	c.JSON(http.StatusOK, body)
+}
+
+func GetSecuritySettingsHandler(c *gin.Context) {
+	settings, err := account.GetSecuritySettings(context.Background(), database.DB)
+	if err != nil {
+		fmt.Printf("Error fetching security settings: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch security settings"})
+		return
+	}
+	c.JSON(http.StatusOK, settings)
+}
+
+// Switches site-wide security settings, such as requiring two-factor
+// authentication for every admin
+func UpdateSecuritySettingsHandler(c *gin.Context) {
+	adminID, _ := c.Get("userID")
+
+	var input SecuritySettingsInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data: " + err.Error()})
+		return
+	}
+
+	// Admins could not meet the requirement, and would be locked out of the admin API
+	if *input.RequireAdminTwoFactor && !account.CanEnroll() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": account.ErrEnrollmentDisabled.Error()})
+		return
+	}
+
+	settings, err := account.UpdateSecuritySettings(context.Background(), database.DB,
+		account.SecuritySettings{RequireAdminTwoFactor: *input.RequireAdminTwoFactor}, adminID.(int))
+	if err != nil {
+		fmt.Printf("Error updating security settings: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update security settings"})
+		return
+	}
+
+	fmt.Printf("User %v set require admin two-factor to %t\n", adminID, settings.RequireAdminTwoFactor)
+	c.JSON(http.StatusOK, settings)
+}
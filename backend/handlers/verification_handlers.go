@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/Zeropeepo/sea-catering-backend/account"
+	"github.com/Zeropeepo/sea-catering-backend/database"
+	"github.com/Zeropeepo/sea-catering-backend/mailer"
+	"github.com/gin-gonic/gin"
+)
+
+// Confirms an email address with the token from a verification email
+func VerifyEmailHandler(c *gin.Context) {
+	token := c.Query("token")
+	if token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Verification token is required"})
+		return
+	}
+
+	err := account.VerifyEmail(context.Background(), database.DB, token)
+	if errors.Is(err, account.ErrInvalidVerifyToken) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error verifying email: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify email"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Email verified successfully!"})
+}
+
+// Sends a new verification email to the logged in user
+func ResendVerificationHandler(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	user, token, err := account.ResendVerification(context.Background(), database.DB, userID.(int))
+	switch {
+	case errors.Is(err, account.ErrAlreadyVerified):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, account.ErrResendTooSoon):
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		fmt.Printf("Error creating verification token for user %v: %v\n", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send verification email"})
+		return
+	}
+
+	go sendVerification(user, token)
+	c.JSON(http.StatusOK, gin.H{"message": "Verification email sent"})
+}
+
+func sendVerification(user account.User, token string) {
+	link := appURL + "/verify-email?token=" + url.QueryEscape(token)
+	err := mail.Send(context.Background(), mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your SEA Catering email address",
+		Body: fmt.Sprintf("Hi %s,\n\n"+
+			"Welcome to SEA Catering! Please confirm that this is your email address by opening this link:\n\n"+
+			"%s\n\n"+
+			"You can subscribe to a meal plan once your address is verified. If you did not create an account, you can ignore this email.\n",
+			user.FullName, link),
+	})
+	if err != nil {
+		fmt.Printf("Error sending verification email to user %d: %v\n", user.ID, err)
+	}
+}
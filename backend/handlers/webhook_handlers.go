@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/Zeropeepo/sea-catering-backend/database"
+	"github.com/Zeropeepo/sea-catering-backend/ledger"
+	"github.com/gin-gonic/gin"
+)
+
+// midtransNotification holds the fields we read from a Midtrans HTTP notification
+type midtransNotification struct {
+	OrderID           string `json:"order_id"`
+	StatusCode        string `json:"status_code"`
+	GrossAmount       string `json:"gross_amount"`
+	SignatureKey      string `json:"signature_key"`
+	TransactionID     string `json:"transaction_id"`
+	TransactionStatus string `json:"transaction_status"`
+	FraudStatus       string `json:"fraud_status"`
+	PaymentType       string `json:"payment_type"`
+	RefundAmount      string `json:"refund_amount"`
+}
+
+// Midtrans retries a notification until it gets a 2xx, so anything we have
+// safely recorded gets a 200, even when it changed nothing. Only a failure on
+// our side returns 5xx to ask for a retry.
+func MidtransNotificationHandler(c *gin.Context) {
+	// Keep the raw body for the payments ledger
+	rawPayload, err := c.GetRawData()
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Request body too large"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid notification payload"})
+		return
+	}
+	var n midtransNotification
+	if err := json.Unmarshal(rawPayload, &n); err != nil || n.OrderID == "" || n.TransactionStatus == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid notification payload"})
+		return
+	}
+
+	// The signature is SHA512(order_id + status_code + gross_amount + server key)
+	hash := sha512.Sum512([]byte(n.OrderID + n.StatusCode + n.GrossAmount + os.Getenv("MIDTRANS_SERVER_KEY")))
+	expected := hex.EncodeToString(hash[:])
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(n.SignatureKey)) != 1 {
+		fmt.Printf("Webhook Error: invalid signature for order %s\n", n.OrderID)
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid signature"})
+		return
+	}
+
+	if !ledger.KnownStatus(n.TransactionStatus) {
+		fmt.Printf("Webhook Warning: order %s has unknown status %q\n", n.OrderID, n.TransactionStatus)
+	}
+
+	outcome, err := ledger.Process(context.Background(), database.DB, ledger.Notification{
+		OrderID:           n.OrderID,
+		TransactionID:     n.TransactionID,
+		TransactionStatus: n.TransactionStatus,
+		StatusCode:        n.StatusCode,
+		FraudStatus:       n.FraudStatus,
+		PaymentType:       n.PaymentType,
+		GrossAmount:       n.GrossAmount,
+		RefundAmount:      n.RefundAmount,
+		Raw:               rawPayload,
+	})
+	if err != nil {
+		fmt.Printf("Error processing notification for order %s: %v\n", n.OrderID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process notification"})
+		return
+	}
+
+	fmt.Printf("Webhook: order %s %s -> %s\n", n.OrderID, n.TransactionStatus, outcome)
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "outcome": outcome})
+}
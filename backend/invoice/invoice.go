@@ -0,0 +1,258 @@
+// Package invoice issues a numbered invoice for every paid order. An invoice
+// is a snapshot: it keeps the customer, plan and schedule as they were when
+// the payment went through, however the subscription changes later.
+package invoice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Zeropeepo/sea-catering-backend/pricing"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var ErrNotFound = errors.New("invoice not found")
+
+// DB is satisfied by *pgxpool.Pool and pgx.Tx.
+type DB interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// Item is one line of an invoice. Credits are lines with a negative amount.
+type Item struct {
+	Description string  `json:"description"`
+	Quantity    int     `json:"quantity"`
+	UnitPrice   float64 `json:"unitPrice"`
+	Amount      float64 `json:"amount"`
+}
+
+type Invoice struct {
+	ID             int64      `json:"id"`
+	Number         string     `json:"number"`
+	PaymentID      int64      `json:"paymentId"`
+	OrderID        string     `json:"orderId"`
+	SubscriptionID int        `json:"subscriptionId"`
+	UserID         int        `json:"userId"`
+	CustomerName   string     `json:"customerName"`
+	CustomerEmail  string     `json:"customerEmail"`
+	PlanName       string     `json:"planName"`
+	MealTypes      []string   `json:"mealTypes"`
+	DeliveryDays   []string   `json:"deliveryDays"`
+	PeriodStart    *time.Time `json:"periodStart"`
+	PeriodEnd      *time.Time `json:"periodEnd"`
+	Items          []Item     `json:"items"`
+	Subtotal       float64    `json:"subtotal"`
+	TaxRate        float64    `json:"taxRate"`
+	Tax            float64    `json:"tax"`
+	Total          float64    `json:"total"`
+	Currency       string     `json:"currency"`
+	IssuedAt       time.Time  `json:"issuedAt"`
+}
+
+const columns = `i.id, i.number, i.payment_id, p.order_id, i.subscription_id, i.user_id, i.customer_name, i.customer_email,
+	i.plan_name, i.meal_types, i.delivery_days, i.period_start, i.period_end, i.items, i.subtotal, i.tax_rate, i.tax, i.total, i.currency, i.issued_at`
+
+const joins = ` FROM invoices i JOIN payments p ON p.id = i.payment_id`
+
+func scan(row pgx.Row) (Invoice, error) {
+	var inv Invoice
+	err := row.Scan(&inv.ID, &inv.Number, &inv.PaymentID, &inv.OrderID, &inv.SubscriptionID, &inv.UserID, &inv.CustomerName, &inv.CustomerEmail,
+		&inv.PlanName, &inv.MealTypes, &inv.DeliveryDays, &inv.PeriodStart, &inv.PeriodEnd, &inv.Items, &inv.Subtotal, &inv.TaxRate, &inv.Tax, &inv.Total, &inv.Currency, &inv.IssuedAt)
+	return inv, err
+}
+
+// Issue creates the invoice for a paid order unless it already has one. It
+// belongs in the transaction that records the payment as paid, which must
+// hold the payment row locked.
+func Issue(ctx context.Context, tx pgx.Tx, paymentID int64) error {
+	var exists bool
+	if err := tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM invoices WHERE payment_id = $1)`, paymentID).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	var (
+		inv            Invoice
+		periodAmount   *float64
+		discount       *float64
+		periodTax      *float64
+		breakdown      *pricing.Quote
+		promoCode      *string
+		creditApplied  *float64
+		changePlanName *string
+		proration      *float64
+		prorationTax   *float64
+		newBreakdown   *pricing.Quote
+	)
+	// An upgrade is invoiced with the schedule it pays for, which the
+	// subscription only takes on once the payment has been applied.
+	err := tx.QueryRow(ctx, `
+		SELECT p.id, p.subscription_id, p.user_id, p.amount, p.currency, u.full_name, u.email,
+			COALESCE(sc.new_plan_name, s.plan_name), COALESCE(sc.new_meal_types, s.meal_types), COALESCE(sc.new_delivery_days, s.delivery_days),
+			COALESCE(bp.period_start, CASE WHEN sc.id IS NOT NULL THEN CURRENT_DATE END),
+			COALESCE(bp.period_end, CASE WHEN sc.id IS NOT NULL THEN s.current_period_end END),
+			bp.amount, bp.discount, bp.tax, bp.breakdown, pc.code, bp.credit_applied,
+			sc.new_plan_name, sc.proration, sc.proration_tax, sc.new_breakdown
+		FROM payments p
+		JOIN subscriptions s ON s.id = p.subscription_id
+		JOIN users u ON u.id = p.user_id
+		LEFT JOIN billing_periods bp ON bp.id = p.billing_period_id
+		LEFT JOIN subscription_changes sc ON sc.id = p.subscription_change_id
+		LEFT JOIN promo_redemptions pr ON pr.billing_period_id = bp.id
+		LEFT JOIN promo_codes pc ON pc.id = pr.promo_code_id
+		WHERE p.id = $1`, paymentID).Scan(&inv.PaymentID, &inv.SubscriptionID, &inv.UserID, &inv.Total, &inv.Currency, &inv.CustomerName, &inv.CustomerEmail,
+		&inv.PlanName, &inv.MealTypes, &inv.DeliveryDays, &inv.PeriodStart, &inv.PeriodEnd,
+		&periodAmount, &discount, &periodTax, &breakdown, &promoCode, &creditApplied,
+		&changePlanName, &proration, &prorationTax, &newBreakdown)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case periodAmount != nil:
+		inv.Items = breakdownItems(inv, breakdown, *periodAmount)
+		if *discount > 0 {
+			description := "Promo discount"
+			if promoCode != nil {
+				description += " (" + *promoCode + ")"
+			}
+			inv.Items = append(inv.Items, Item{Description: description, Quantity: 1, UnitPrice: -*discount, Amount: -*discount})
+		}
+		if *creditApplied > 0 {
+			inv.Items = append(inv.Items, Item{Description: "Account credit", Quantity: 1, UnitPrice: -*creditApplied, Amount: -*creditApplied})
+		}
+		inv.Tax = *periodTax
+		if breakdown != nil {
+			inv.TaxRate = breakdown.TaxRate
+		}
+	case changePlanName != nil:
+		description := "Upgrade to " + *changePlanName
+		if inv.PeriodEnd != nil {
+			description += " until " + inv.PeriodEnd.AddDate(0, 0, -1).Format("2 Jan 2006")
+		}
+		net := *proration - *prorationTax
+		inv.Items = []Item{{Description: description, Quantity: 1, UnitPrice: net, Amount: net}}
+		inv.Tax = *prorationTax
+		if newBreakdown != nil {
+			inv.TaxRate = newBreakdown.TaxRate
+		}
+	default:
+		// Orders from before billing periods were tracked paid for the subscription as a whole
+		inv.Items = []Item{planItem(inv, inv.Total)}
+	}
+	for _, item := range inv.Items {
+		inv.Subtotal += item.Amount
+	}
+
+	inv.IssuedAt = time.Now()
+	if inv.Number, err = nextNumber(ctx, tx, inv.IssuedAt.Year()); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO invoices (number, payment_id, subscription_id, user_id, customer_name, customer_email, plan_name,
+			meal_types, delivery_days, period_start, period_end, items, subtotal, tax_rate, tax, total, currency, issued_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18)`,
+		inv.Number, inv.PaymentID, inv.SubscriptionID, inv.UserID, inv.CustomerName, inv.CustomerEmail, inv.PlanName,
+		inv.MealTypes, inv.DeliveryDays, inv.PeriodStart, inv.PeriodEnd, inv.Items, inv.Subtotal, inv.TaxRate, inv.Tax, inv.Total, inv.Currency, inv.IssuedAt)
+	return err
+}
+
+// breakdownItems lists what a period was charged for. Periods opened before
+// fees were itemized only have their amount, which is all plan.
+func breakdownItems(inv Invoice, breakdown *pricing.Quote, amount float64) []Item {
+	if breakdown == nil {
+		return []Item{planItem(inv, amount)}
+	}
+	items := make([]Item, 0, len(breakdown.Items))
+	for _, line := range breakdown.Items {
+		if line.Code == "PLAN" {
+			items = append(items, planItem(inv, line.Amount))
+			continue
+		}
+		items = append(items, Item{Description: line.Description, Quantity: 1, UnitPrice: line.Amount, Amount: line.Amount})
+	}
+	return items
+}
+
+func planItem(inv Invoice, amount float64) Item {
+	description := fmt.Sprintf("Subscription: %s, %d meals/week", inv.PlanName, len(inv.MealTypes)*len(inv.DeliveryDays))
+	if inv.PeriodStart != nil && inv.PeriodEnd != nil {
+		description += fmt.Sprintf(" (%s - %s)", inv.PeriodStart.Format("2 Jan"), inv.PeriodEnd.AddDate(0, 0, -1).Format("2 Jan 2006"))
+	}
+	return Item{Description: description, Quantity: 1, UnitPrice: amount, Amount: amount}
+}
+
+// nextNumber hands out invoice numbers in sequence. The counter row stays
+// locked until tx ends, so numbers are never skipped or reused.
+func nextNumber(ctx context.Context, tx pgx.Tx, year int) (string, error) {
+	var n int
+	err := tx.QueryRow(ctx, `
+		INSERT INTO invoice_counters (year, last_number) VALUES ($1, 1)
+		ON CONFLICT (year) DO UPDATE SET last_number = invoice_counters.last_number + 1
+		RETURNING last_number`, year).Scan(&n)
+	return fmt.Sprintf("INV-%d-%06d", year, n), err
+}
+
+// Get returns one invoice.
+func Get(ctx context.Context, db DB, id int64) (Invoice, error) {
+	inv, err := scan(db.QueryRow(ctx, `SELECT `+columns+joins+` WHERE i.id = $1`, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return inv, ErrNotFound
+	}
+	return inv, err
+}
+
+// Filter narrows an invoice listing. Zero values match everything.
+type Filter struct {
+	UserID   int
+	From, To time.Time
+	Limit    int
+}
+
+// List returns invoices, newest first.
+func List(ctx context.Context, db DB, f Filter) ([]Invoice, error) {
+	if f.Limit <= 0 {
+		f.Limit = 50
+	}
+	query := `SELECT ` + columns + joins + ` WHERE true`
+	var args []any
+	add := func(clause string, arg any) {
+		args = append(args, arg)
+		query += fmt.Sprintf(" AND "+clause, len(args))
+	}
+	if f.UserID != 0 {
+		add("i.user_id = $%d", f.UserID)
+	}
+	if !f.From.IsZero() {
+		add("i.issued_at >= $%d", f.From)
+	}
+	if !f.To.IsZero() {
+		add("i.issued_at <= $%d", f.To)
+	}
+	args = append(args, f.Limit)
+	query += fmt.Sprintf(" ORDER BY i.issued_at DESC LIMIT $%d", len(args))
+
+	rows, err := db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invoices := make([]Invoice, 0)
+	for rows.Next() {
+		inv, err := scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		invoices = append(invoices, inv)
+	}
+	return invoices, rows.Err()
+}
@@ -0,0 +1,182 @@
+package invoice
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Page geometry in PDF points; A4 portrait.
+const (
+	pageWidth  = 595
+	pageHeight = 842
+	margin     = 50
+)
+
+// PDF renders the invoice as a one page PDF document. It only uses the
+// standard Helvetica fonts, so it needs no font files or external tools.
+func (inv Invoice) PDF() []byte {
+	var page pdfPage
+	y := pageHeight - margin - 20
+
+	page.text(margin, y, 20, true, "SEA Catering")
+	page.text(pageWidth-margin-150, y, 20, true, "INVOICE")
+	y -= 30
+	page.text(margin, y, 10, false, "Invoice number: "+inv.Number)
+	page.text(pageWidth-margin-150, y, 10, false, "Issued: "+inv.IssuedAt.Format("2 Jan 2006"))
+	y -= 14
+	page.text(margin, y, 10, false, "Order: "+inv.OrderID)
+
+	y -= 30
+	page.text(margin, y, 11, true, "Billed to")
+	y -= 15
+	page.text(margin, y, 10, false, inv.CustomerName)
+	y -= 14
+	page.text(margin, y, 10, false, inv.CustomerEmail)
+
+	y -= 30
+	page.text(margin, y, 11, true, "Delivery schedule")
+	y -= 15
+	page.text(margin, y, 10, false, "Plan: "+inv.PlanName)
+	y -= 14
+	page.text(margin, y, 10, false, "Meals: "+strings.Join(inv.MealTypes, ", "))
+	y -= 14
+	page.text(margin, y, 10, false, "Delivery days: "+strings.Join(inv.DeliveryDays, ", "))
+	if inv.PeriodStart != nil && inv.PeriodEnd != nil {
+		y -= 14
+		page.text(margin, y, 10, false, "Service period: "+inv.PeriodStart.Format("2 Jan 2006")+" - "+inv.PeriodEnd.AddDate(0, 0, -1).Format("2 Jan 2006"))
+	}
+
+	y -= 35
+	amountX := pageWidth - margin - 110
+	page.text(margin, y, 10, true, "Description")
+	page.text(amountX-60, y, 10, true, "Qty")
+	page.text(amountX, y, 10, true, "Amount")
+	y -= 6
+	page.line(margin, y, pageWidth-margin, y)
+	for _, item := range inv.Items {
+		y -= 16
+		page.text(margin, y, 10, false, truncate(item.Description, 70))
+		page.text(amountX-60, y, 10, false, strconv.Itoa(item.Quantity))
+		page.text(amountX, y, 10, false, formatAmount(inv.Currency, item.Amount))
+	}
+	y -= 8
+	page.line(margin, y, pageWidth-margin, y)
+
+	taxLabel := "Tax"
+	if inv.TaxRate > 0 {
+		taxLabel = fmt.Sprintf("Tax (PPN %g%%)", inv.TaxRate)
+	}
+	for _, row := range []struct {
+		label  string
+		amount float64
+		bold   bool
+	}{
+		{"Subtotal", inv.Subtotal, false},
+		{taxLabel, inv.Tax, false},
+		{"Total", inv.Total, true},
+	} {
+		y -= 16
+		page.text(amountX-100, y, 10, row.bold, row.label)
+		page.text(amountX, y, 10, row.bold, formatAmount(inv.Currency, row.amount))
+	}
+
+	page.text(margin, margin, 8, false, "Paid in full. Thank you for eating with SEA Catering.")
+	return page.render()
+}
+
+// pdfPage collects drawing operators for a single page.
+type pdfPage struct {
+	content bytes.Buffer
+}
+
+func (p *pdfPage) text(x, y int, size int, bold bool, s string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(&p.content, "BT /%s %d Tf %d %d Td (%s) Tj ET\n", font, size, x, y, escapePDF(s))
+}
+
+func (p *pdfPage) line(x1, y1, x2, y2 int) {
+	fmt.Fprintf(&p.content, "0.5 w %d %d m %d %d l S\n", x1, y1, x2, y2)
+}
+
+// render lays the page out as a complete PDF file with its cross-reference table.
+func (p *pdfPage) render() []byte {
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 4 0 R /F2 5 0 R >> >> /Contents 6 0 R >>", pageWidth, pageHeight),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", p.content.Len(), p.content.String()),
+	}
+
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return out.Bytes()
+}
+
+// escapePDF makes s safe inside a PDF string literal. Characters outside
+// Latin-1 have no glyph in the standard fonts and are replaced.
+func escapePDF(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 0x20:
+			b.WriteByte(' ')
+		case r < 0x80:
+			b.WriteRune(r)
+		case r <= 0xff:
+			fmt.Fprintf(&b, "\\%03o", r)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+func truncate(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n-3]) + "..."
+	}
+	return s
+}
+
+// formatAmount writes whole rupiah with dot thousands separators, as in "Rp 1.032.000".
+func formatAmount(currency string, amount float64) string {
+	prefix := currency + " "
+	if currency == "IDR" {
+		prefix = "Rp "
+	}
+	if amount < 0 {
+		prefix = "-" + prefix
+		amount = -amount
+	}
+	digits := strconv.FormatFloat(amount, 'f', 0, 64)
+	var b strings.Builder
+	for i, d := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteByte('.')
+		}
+		b.WriteRune(d)
+	}
+	return prefix + b.String()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Zeropeepo/sea-catering-backend/account"
+	"github.com/Zeropeepo/sea-catering-backend/billing"
+	"github.com/Zeropeepo/sea-catering-backend/config"
+	"github.com/Zeropeepo/sea-catering-backend/database"
+	"github.com/Zeropeepo/sea-catering-backend/gateway"
+	"github.com/Zeropeepo/sea-catering-backend/ledger"
+	"github.com/Zeropeepo/sea-catering-backend/lifecycle"
+	"github.com/Zeropeepo/sea-catering-backend/ratelimit"
+	"github.com/Zeropeepo/sea-catering-backend/scheduler"
+	"github.com/Zeropeepo/sea-catering-backend/session"
+)
+
+// registerJobs wires the recurring work of the backend into the scheduler.
+func registerJobs(s *scheduler.Scheduler, payments gateway.PaymentGateway, limits ratelimit.Store) error {
+	// Start and end date-bounded pauses
+	err := s.Register("apply-pause-windows", "*/15 * * * *", func(ctx context.Context) error {
+		started, resumed, err := lifecycle.ApplyPauseWindows(ctx, database.DB)
+		if started > 0 || resumed > 0 {
+			fmt.Printf("Pause windows: %d paused, %d resumed\n", started, resumed)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// Bill the next month a few days before the current one ends
+	renewalLeadDays := config.Int("RENEWAL_LEAD_DAYS", 3)
+	err = s.Register("renew-subscriptions", "0 * * * *", func(ctx context.Context) error {
+		renewed, err := billing.Renew(ctx, database.DB, payments, renewalLeadDays)
+		if renewed > 0 {
+			fmt.Printf("Opened %d renewal billing periods\n", renewed)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// Move unpaid renewals to past_due and, after the grace period, suspended
+	graceDays := config.Int("BILLING_GRACE_DAYS", 7)
+	err = s.Register("enforce-billing-periods", "5 * * * *", func(ctx context.Context) error {
+		pastDue, suspended, err := lifecycle.EnforceBillingPeriods(ctx, database.DB, graceDays)
+		if pastDue > 0 || suspended > 0 {
+			fmt.Printf("Billing periods: %d past due, %d suspended\n", pastDue, suspended)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// Forget logins that ended or expired a month ago
+	err = s.Register("purge-sessions", "30 3 * * *", func(ctx context.Context) error {
+		purged, err := session.Purge(ctx, database.DB, time.Now().AddDate(0, 0, -30))
+		if purged > 0 {
+			fmt.Printf("Purged %d old sessions\n", purged)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// Keep three months of login attempts; counters shared in Postgres and
+	// spent two-factor challenges are dropped once idle
+	err = s.Register("purge-login-attempts", "45 3 * * *", func(ctx context.Context) error {
+		purged, err := account.PurgeLoginAttempts(ctx, database.DB, time.Now().AddDate(0, -3, 0))
+		if purged > 0 {
+			fmt.Printf("Purged %d old login attempts\n", purged)
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := account.PurgeChallenges(ctx, database.DB); err != nil {
+			return err
+		}
+		if store, ok := limits.(*ratelimit.Postgres); ok {
+			_, err = store.Purge(ctx)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// Give up on subscriptions whose Snap popup was closed without paying
+	pendingTTL := time.Duration(config.Int("PENDING_SUBSCRIPTION_TTL_HOURS", 24)) * time.Hour
+	return s.Register("expire-pending-subscriptions", "*/10 * * * *", func(ctx context.Context) error {
+		cancelOrders := func(ctx context.Context, subscriptionID int) error {
+			return ledger.CancelOutstanding(ctx, database.DB, subscriptionID, payments.Cancel)
+		}
+		expired, err := lifecycle.ExpirePending(ctx, database.DB, pendingTTL, cancelOrders)
+		if expired > 0 {
+			fmt.Printf("Expired %d pending subscriptions\n", expired)
+		}
+		return err
+	})
+}
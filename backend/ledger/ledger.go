@@ -0,0 +1,170 @@
+// Package ledger records every payment order we create with the payment
+// gateway and keeps it in step with the gateway's notifications.
+package ledger
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// StatusCreated marks an order we have a Snap token for but that the gateway
+// has not reported on yet. Every other status is the gateway's own
+// transaction_status.
+const StatusCreated = "created"
+
+var ErrNotFound = errors.New("payment not found")
+
+type Payment struct {
+	ID                   int64           `json:"id"`
+	OrderID              string          `json:"orderId"`
+	SubscriptionID       int             `json:"subscriptionId"`
+	BillingPeriodID      *int64          `json:"billingPeriodId"`
+	SubscriptionChangeID *int64          `json:"subscriptionChangeId"`
+	UserID               int             `json:"userId"`
+	Amount               float64         `json:"amount"`
+	Currency             string          `json:"currency"`
+	Gateway              string          `json:"gateway"`
+	GatewayStatus        string          `json:"gatewayStatus"`
+	TransactionID        *string         `json:"transactionId"`
+	PaymentType          *string         `json:"paymentType"`
+	RawPayload           json.RawMessage `json:"rawPayload,omitempty"`
+	CreatedAt            time.Time       `json:"createdAt"`
+	UpdatedAt            time.Time       `json:"updatedAt"`
+}
+
+// DB is satisfied by *pgxpool.Pool and pgx.Tx.
+type DB interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+const columns = `id, order_id, subscription_id, billing_period_id, subscription_change_id, user_id, amount, currency, gateway, gateway_status,
+	transaction_id, payment_type, raw_payload, created_at, updated_at`
+
+func scan(row pgx.Row) (Payment, error) {
+	var p Payment
+	var raw []byte
+	err := row.Scan(&p.ID, &p.OrderID, &p.SubscriptionID, &p.BillingPeriodID, &p.SubscriptionChangeID, &p.UserID, &p.Amount, &p.Currency, &p.Gateway, &p.GatewayStatus,
+		&p.TransactionID, &p.PaymentType, &raw, &p.CreatedAt, &p.UpdatedAt)
+	if raw != nil {
+		p.RawPayload = raw
+	}
+	return p, err
+}
+
+// Create records a new order at the moment its payment token is issued.
+func Create(ctx context.Context, db DB, p Payment) (Payment, error) {
+	if p.Currency == "" {
+		p.Currency = "IDR"
+	}
+	return scan(db.QueryRow(ctx, `
+		INSERT INTO payments (order_id, subscription_id, billing_period_id, subscription_change_id, user_id, amount, currency, gateway, gateway_status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING `+columns,
+		p.OrderID, p.SubscriptionID, p.BillingPeriodID, p.SubscriptionChangeID, p.UserID, p.Amount, p.Currency, p.Gateway, StatusCreated))
+}
+
+// Get looks up a payment by its order ID.
+func Get(ctx context.Context, db DB, orderID string) (Payment, error) {
+	p, err := scan(db.QueryRow(ctx, `SELECT `+columns+` FROM payments WHERE order_id = $1`, orderID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return p, ErrNotFound
+	}
+	return p, err
+}
+
+// ForSubscription lists the payments of one subscription, newest first.
+func ForSubscription(ctx context.Context, db DB, subscriptionID int) ([]Payment, error) {
+	return list(ctx, db, `SELECT `+columns+` FROM payments WHERE subscription_id = $1 ORDER BY created_at DESC`, subscriptionID)
+}
+
+// Filter narrows an admin listing. Zero values are ignored.
+type Filter struct {
+	Status         string
+	SubscriptionID int
+	From, To       time.Time
+	Limit          int
+}
+
+// List returns payments across all subscriptions, newest first.
+func List(ctx context.Context, db DB, f Filter) ([]Payment, error) {
+	if f.Limit <= 0 {
+		f.Limit = 50
+	}
+	query := `SELECT ` + columns + ` FROM payments WHERE true`
+	var args []any
+	add := func(clause string, arg any) {
+		args = append(args, arg)
+		query += fmt.Sprintf(" AND "+clause, len(args))
+	}
+	if f.Status != "" {
+		add("gateway_status = $%d", f.Status)
+	}
+	if f.SubscriptionID != 0 {
+		add("subscription_id = $%d", f.SubscriptionID)
+	}
+	if !f.From.IsZero() {
+		add("created_at >= $%d", f.From)
+	}
+	if !f.To.IsZero() {
+		add("created_at <= $%d", f.To)
+	}
+	args = append(args, f.Limit)
+	query += fmt.Sprintf(" ORDER BY created_at DESC LIMIT $%d", len(args))
+	return list(ctx, db, query, args...)
+}
+
+// Outstanding returns the orders of a subscription that could still be paid.
+func Outstanding(ctx context.Context, db DB, subscriptionID int) ([]Payment, error) {
+	return list(ctx, db, `SELECT `+columns+` FROM payments WHERE subscription_id = $1 AND gateway_status IN ('created', 'pending')`, subscriptionID)
+}
+
+// SetStatus records a status we decided on ourselves, such as cancelling an
+// order or a token request that failed.
+func SetStatus(ctx context.Context, db DB, orderID, status string) error {
+	_, err := db.Exec(ctx, `UPDATE payments SET gateway_status = $2, updated_at = now() WHERE order_id = $1`, orderID, status)
+	return err
+}
+
+func list(ctx context.Context, db DB, query string, args ...any) ([]Payment, error) {
+	rows, err := db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	payments := make([]Payment, 0)
+	for rows.Next() {
+		p, err := scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		payments = append(payments, p)
+	}
+	return payments, rows.Err()
+}
+
+// CancelOutstanding voids every open order of a subscription with the gateway
+// and records the cancellation. It stops at the first gateway error.
+func CancelOutstanding(ctx context.Context, db DB, subscriptionID int, cancel func(ctx context.Context, orderID string) error) error {
+	open, err := Outstanding(ctx, db, subscriptionID)
+	if err != nil {
+		return err
+	}
+	for _, p := range open {
+		if err := cancel(ctx, p.OrderID); err != nil {
+			return err
+		}
+		if err := SetStatus(ctx, db, p.OrderID, "cancel"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/Zeropeepo/sea-catering-backend/invoice"
+	"github.com/Zeropeepo/sea-catering-backend/lifecycle"
+	"github.com/Zeropeepo/sea-catering-backend/promo"
+	"github.com/jackc/pgx/v5"
+)
+
+// Notification is a verified gateway callback about one order.
+type Notification struct {
+	OrderID           string
+	TransactionID     string
+	TransactionStatus string
+	StatusCode        string
+	FraudStatus       string
+	PaymentType       string
+	GrossAmount       string
+	RefundAmount      string
+	Raw               []byte
+}
+
+// Outcome says what Process did with a notification.
+type Outcome string
+
+const (
+	OutcomeApplied        Outcome = "applied"
+	OutcomeDuplicate      Outcome = "duplicate"
+	OutcomeStale          Outcome = "stale"
+	OutcomeUnknownOrder   Outcome = "unknown_order"
+	OutcomeAmountMismatch Outcome = "amount_mismatch"
+	// OutcomeNeedsReview means money was taken for a subscription that can no
+	// longer be activated, for example one that expired in the meantime.
+	OutcomeNeedsReview Outcome = "needs_review"
+)
+
+// statusRank orders the gateway's transaction statuses. A notification only
+// moves an order forward; anything ranked at or below the stored status
+// arrived late and is kept for the record but not applied.
+var statusRank = map[string]int{
+	StatusCreated:        0,
+	"pending":            1,
+	"authorize":          2,
+	"capture":            3,
+	"settlement":         4,
+	"deny":               4,
+	"cancel":             4,
+	"expire":             4,
+	"failure":            4,
+	"partial_refund":     5,
+	"partial_chargeback": 5,
+	"refund":             6,
+	"chargeback":         6,
+}
+
+// KnownStatus reports whether status is a transaction status we handle.
+func KnownStatus(status string) bool {
+	_, ok := statusRank[status]
+	return ok
+}
+
+// TxDB is satisfied by *pgxpool.Pool and pgx.Tx.
+type TxDB interface {
+	DB
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+// Process records a notification and applies it exactly once. Redelivered
+// notifications, ones that arrive after a later status, and ones whose amount
+// does not match the order are stored but change nothing.
+func Process(ctx context.Context, db TxDB, n Notification) (Outcome, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	outcome, err := process(ctx, tx, n)
+	if err != nil {
+		return "", err
+	}
+	return outcome, tx.Commit(ctx)
+}
+
+func process(ctx context.Context, tx pgx.Tx, n Notification) (Outcome, error) {
+	// Partial refunds share a transaction ID and status, so the amount tells them apart
+	dedupeKey := n.TransactionID + ":" + n.TransactionStatus
+	if n.TransactionStatus == "partial_refund" || n.TransactionStatus == "partial_chargeback" {
+		dedupeKey += ":" + n.RefundAmount
+	}
+
+	var notificationID int64
+	err := tx.QueryRow(ctx, `
+		INSERT INTO payment_notifications (order_id, dedupe_key, transaction_id, transaction_status, status_code, fraud_status, gross_amount, raw_payload)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (order_id, dedupe_key) DO NOTHING
+		RETURNING id`,
+		n.OrderID, dedupeKey, n.TransactionID, n.TransactionStatus, n.StatusCode, n.FraudStatus, n.GrossAmount, n.Raw).Scan(&notificationID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return OutcomeDuplicate, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	outcome, err := apply(ctx, tx, n)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(ctx, `UPDATE payment_notifications SET outcome = $1 WHERE id = $2`, outcome, notificationID)
+	return outcome, err
+}
+
+func apply(ctx context.Context, tx pgx.Tx, n Notification) (Outcome, error) {
+	p, err := scan(tx.QueryRow(ctx, `SELECT `+columns+` FROM payments WHERE order_id = $1 FOR UPDATE`, n.OrderID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return OutcomeUnknownOrder, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	gross, err := strconv.ParseFloat(n.GrossAmount, 64)
+	if err != nil || math.Abs(gross-p.Amount) >= 0.01 {
+		fmt.Printf("Payments: order %s reported %q but %.2f was charged\n", n.OrderID, n.GrossAmount, p.Amount)
+		return OutcomeAmountMismatch, nil
+	}
+
+	newRank, known := statusRank[n.TransactionStatus]
+	if !known {
+		return OutcomeStale, nil
+	}
+	repeatable := n.TransactionStatus == p.GatewayStatus &&
+		(n.TransactionStatus == "partial_refund" || n.TransactionStatus == "partial_chargeback")
+	if newRank <= statusRank[p.GatewayStatus] && !repeatable {
+		return OutcomeStale, nil
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE payments
+		SET gateway_status = $2,
+			transaction_id = COALESCE(NULLIF($3, ''), transaction_id),
+			payment_type = COALESCE(NULLIF($4, ''), payment_type),
+			raw_payload = $5,
+			updated_at = now()
+		WHERE id = $1`,
+		p.ID, n.TransactionStatus, n.TransactionID, n.PaymentType, n.Raw)
+	if err != nil {
+		return "", err
+	}
+
+	// Money was taken, so the customer is owed an invoice even if the subscription needs review
+	if n.TransactionStatus == "settlement" || n.TransactionStatus == "capture" && (n.FraudStatus == "" || n.FraudStatus == "accept") {
+		if err := invoice.Issue(ctx, tx, p.ID); err != nil {
+			return "", fmt.Errorf("issue invoice for %s: %w", p.OrderID, err)
+		}
+	}
+
+	return applyToSubscription(ctx, tx, p, n)
+}
+
+// applyToSubscription moves the subscription along with its payment.
+func applyToSubscription(ctx context.Context, tx pgx.Tx, p Payment, n Notification) (Outcome, error) {
+	var to lifecycle.Status
+	switch n.TransactionStatus {
+	case "settlement":
+		to = lifecycle.Active
+	case "capture":
+		// Card captures flagged by fraud detection wait for a later settlement or deny
+		if n.FraudStatus != "" && n.FraudStatus != "accept" {
+			return OutcomeApplied, nil
+		}
+		to = lifecycle.Active
+	case "refund", "chargeback":
+		// Giving back an upgrade charge leaves the subscription running
+		if p.SubscriptionChangeID != nil {
+			return OutcomeApplied, nil
+		}
+		to = lifecycle.Cancelled
+	default:
+		// pending, authorize, deny, cancel, expire, failure and partial refunds
+		// leave the subscription as it is; an unpaid one expires on its own
+		return OutcomeApplied, nil
+	}
+
+	if to == lifecycle.Active && p.SubscriptionChangeID != nil {
+		applied, err := lifecycle.ApplyChange(ctx, tx, *p.SubscriptionChangeID, &p.ID)
+		if err != nil {
+			return "", err
+		}
+		if !applied {
+			// A card payment is captured and then settled; the capture already applied the change
+			again, err := lifecycle.ChangePaidBy(ctx, tx, *p.SubscriptionChangeID, p.ID)
+			if err != nil {
+				return "", err
+			}
+			if again {
+				return OutcomeApplied, nil
+			}
+			// The customer asked for something else before this upgrade was paid
+			fmt.Printf("Payments: order %s paid for change %d, which is no longer pending\n", p.OrderID, *p.SubscriptionChangeID)
+			return OutcomeNeedsReview, nil
+		}
+		return OutcomeApplied, nil
+	}
+
+	if to == lifecycle.Active && p.BillingPeriodID != nil {
+		paid, err := lifecycle.PayPeriod(ctx, tx, *p.BillingPeriodID, &p.ID)
+		if err != nil {
+			return "", err
+		}
+		if !paid {
+			// A card payment is captured and then settled; the capture already paid the period
+			again, err := lifecycle.PaidBy(ctx, tx, *p.BillingPeriodID, p.ID)
+			if err != nil {
+				return "", err
+			}
+			if again {
+				return OutcomeApplied, nil
+			}
+			// Another order already paid this period, or it was voided when the subscription ended
+			fmt.Printf("Payments: order %s paid billing period %d, which is no longer open\n", p.OrderID, *p.BillingPeriodID)
+			return OutcomeNeedsReview, nil
+		}
+		if err := promo.Redeem(ctx, tx, *p.BillingPeriodID, &p.ID); err != nil {
+			return "", err
+		}
+	}
+
+	from, err := lifecycle.Apply(ctx, tx, lifecycle.Request{
+		SubscriptionID: p.SubscriptionID,
+		To:             to,
+		Actor:          lifecycle.ActorWebhook,
+		Reason:         "payment " + p.OrderID + " " + n.TransactionStatus,
+	})
+	if errors.Is(err, lifecycle.ErrIllegalTransition) {
+		// A subscription that is already running or already over needs nothing more
+		if to == lifecycle.Active && (from == lifecycle.Active || from == lifecycle.Paused) ||
+			to == lifecycle.Cancelled && (from == lifecycle.Cancelled || from == lifecycle.Expired) {
+			return OutcomeApplied, nil
+		}
+		fmt.Printf("Payments: order %s is %s but subscription %d is %s\n", p.OrderID, n.TransactionStatus, p.SubscriptionID, from)
+		return OutcomeNeedsReview, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return OutcomeApplied, nil
+}
@@ -0,0 +1,293 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/Zeropeepo/sea-catering-backend/gateway"
+	"github.com/Zeropeepo/sea-catering-backend/lifecycle"
+	"github.com/Zeropeepo/sea-catering-backend/pricing"
+	"github.com/Zeropeepo/sea-catering-backend/promo"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	RefundRequested = "requested"
+	RefundSucceeded = "succeeded"
+	RefundFailed    = "failed"
+)
+
+var (
+	ErrNotRefundable  = errors.New("payment has not been captured")
+	ErrRefundTooLarge = errors.New("refund exceeds the amount left to refund")
+	ErrInvalidRefund  = errors.New("refund amount must be a positive whole number of rupiah")
+	ErrRefundNotFound = errors.New("refund not found")
+	ErrRefundFinished = errors.New("refund is no longer in flight")
+)
+
+type Refund struct {
+	ID          int64     `json:"id"`
+	PaymentID   int64     `json:"paymentId"`
+	RefundKey   string    `json:"refundKey"`
+	Amount      float64   `json:"amount"`
+	Reason      string    `json:"reason"`
+	Status      string    `json:"status"`
+	Error       string    `json:"error"`
+	AdminUserID *int      `json:"adminUserId"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+const refundColumns = `id, payment_id, refund_key, amount, reason, status, error, admin_user_id, created_at, updated_at`
+
+func scanRefund(row pgx.Row) (Refund, error) {
+	var r Refund
+	err := row.Scan(&r.ID, &r.PaymentID, &r.RefundKey, &r.Amount, &r.Reason, &r.Status, &r.Error, &r.AdminUserID, &r.CreatedAt, &r.UpdatedAt)
+	return r, err
+}
+
+// capturedStatuses are the gateway statuses under which money has been taken.
+var capturedStatuses = map[string]bool{"capture": true, "settlement": true, "partial_refund": true}
+
+// RefundRequest asks for part or all of an order back. A zero Amount refunds
+// whatever has not been refunded yet.
+type RefundRequest struct {
+	OrderID     string
+	Amount      float64
+	Reason      string
+	AdminUserID int
+}
+
+// IssueRefund records a refund, sends it to the gateway and records the
+// result. Refunds still in flight count against the captured amount, so two
+// concurrent requests cannot refund more than was paid. Once a period's
+// order is fully refunded the period is marked refunded and the subscription
+// is cancelled, in the same transaction that records the refund as succeeded.
+// A gateway failure is recorded on the refund and returned. A refund left
+// requested, because recording the result failed, is finished by RetryRefund.
+func IssueRefund(ctx context.Context, db TxDB, payments gateway.PaymentGateway, req RefundRequest) (Refund, error) {
+	refund, payment, err := reserveRefund(ctx, db, req)
+	if err != nil {
+		return refund, err
+	}
+	return sendRefund(ctx, db, payments, refund, payment, req.AdminUserID)
+}
+
+// RetryRefund sends a refund that is still requested to the gateway again
+// and records the result. The refund key makes this safe when the first
+// attempt did reach the gateway: the provider applies each key once.
+func RetryRefund(ctx context.Context, db TxDB, payments gateway.PaymentGateway, refundKey string, adminUserID int) (Refund, error) {
+	refund, err := scanRefund(db.QueryRow(ctx, `SELECT `+refundColumns+` FROM refunds WHERE refund_key = $1`, refundKey))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return refund, ErrRefundNotFound
+	}
+	if err != nil {
+		return refund, err
+	}
+	if refund.Status != RefundRequested {
+		return refund, ErrRefundFinished
+	}
+	payment, err := scan(db.QueryRow(ctx, `SELECT `+columns+` FROM payments WHERE id = $1`, refund.PaymentID))
+	if err != nil {
+		return refund, err
+	}
+	return sendRefund(ctx, db, payments, refund, payment, adminUserID)
+}
+
+func sendRefund(ctx context.Context, db TxDB, payments gateway.PaymentGateway, refund Refund, payment Payment, adminUserID int) (Refund, error) {
+	gatewayErr := payments.Refund(ctx, gateway.RefundRequest{
+		OrderID: payment.OrderID,
+		Key:     refund.RefundKey,
+		Amount:  pricing.Rupiah(refund.Amount),
+		Reason:  refund.Reason,
+	})
+	if gatewayErr != nil {
+		failed, err := finishRefund(ctx, db, refund.ID, RefundFailed, gatewayErr.Error())
+		if errors.Is(err, pgx.ErrNoRows) {
+			return refund, ErrRefundFinished
+		}
+		if err != nil {
+			fmt.Printf("Error recording failed refund %s: %v\n", refund.RefundKey, err)
+			return refund, gatewayErr
+		}
+		return failed, gatewayErr
+	}
+	return completeRefund(ctx, db, refund, payment, adminUserID)
+}
+
+// completeRefund records a refund the gateway accepted and, if it leaves the
+// order fully refunded, settles the subscription, all in one transaction.
+func completeRefund(ctx context.Context, db TxDB, refund Refund, payment Payment, adminUserID int) (Refund, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return refund, err
+	}
+	defer tx.Rollback(ctx)
+
+	done, err := finishRefund(ctx, tx, refund.ID, RefundSucceeded, "")
+	if errors.Is(err, pgx.ErrNoRows) {
+		return refund, ErrRefundFinished
+	}
+	if err != nil {
+		return refund, err
+	}
+
+	refunded, err := refundedAmount(ctx, tx, payment.ID)
+	if err != nil {
+		return refund, err
+	}
+	// Only the subscription's own charges end it; refunding an upgrade does not
+	if refunded >= payment.Amount && payment.SubscriptionChangeID == nil {
+		if err := settleFullRefund(ctx, tx, payment, done, adminUserID); err != nil {
+			return refund, err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return refund, err
+	}
+	return done, nil
+}
+
+func reserveRefund(ctx context.Context, db TxDB, req RefundRequest) (Refund, Payment, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return Refund{}, Payment{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	payment, err := scan(tx.QueryRow(ctx, `SELECT `+columns+` FROM payments WHERE order_id = $1 FOR UPDATE`, req.OrderID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Refund{}, payment, ErrNotFound
+	}
+	if err != nil {
+		return Refund{}, payment, err
+	}
+	if !capturedStatuses[payment.GatewayStatus] {
+		return Refund{}, payment, ErrNotRefundable
+	}
+
+	refunded, err := refundedAmount(ctx, tx, payment.ID)
+	if err != nil {
+		return Refund{}, payment, err
+	}
+	remaining := payment.Amount - refunded
+
+	amount := req.Amount
+	if amount == 0 {
+		amount = remaining
+	}
+	if amount <= 0 || amount != math.Trunc(amount) {
+		return Refund{}, payment, ErrInvalidRefund
+	}
+	if amount > remaining {
+		return Refund{}, payment, fmt.Errorf("%w: %.0f requested, %.0f left", ErrRefundTooLarge, amount, remaining)
+	}
+
+	var count int
+	if err := tx.QueryRow(ctx, `SELECT COUNT(*) FROM refunds WHERE payment_id = $1`, payment.ID).Scan(&count); err != nil {
+		return Refund{}, payment, err
+	}
+
+	var adminUserID *int
+	if req.AdminUserID != 0 {
+		adminUserID = &req.AdminUserID
+	}
+	refund, err := scanRefund(tx.QueryRow(ctx, `
+		INSERT INTO refunds (payment_id, refund_key, amount, reason, admin_user_id)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING `+refundColumns,
+		payment.ID, fmt.Sprintf("%s-R%d", payment.OrderID, count+1), amount, req.Reason, adminUserID))
+	if err != nil {
+		return Refund{}, payment, err
+	}
+	return refund, payment, tx.Commit(ctx)
+}
+
+// finishRefund moves a requested refund to its final status. A refund that
+// was already finished, by a retry racing the first attempt, is not found.
+func finishRefund(ctx context.Context, db DB, refundID int64, status, message string) (Refund, error) {
+	return scanRefund(db.QueryRow(ctx, `
+		UPDATE refunds SET status = $2, error = $3, updated_at = now()
+		WHERE id = $1 AND status = $4
+		RETURNING `+refundColumns, refundID, status, message, RefundRequested))
+}
+
+// refundedAmount sums refunds that succeeded or may still succeed.
+func refundedAmount(ctx context.Context, db DB, paymentID int64) (float64, error) {
+	var total float64
+	err := db.QueryRow(ctx, `SELECT COALESCE(SUM(amount), 0) FROM refunds WHERE payment_id = $1 AND status <> $2`, paymentID, RefundFailed).Scan(&total)
+	return total, err
+}
+
+// settleFullRefund takes back the period an order paid for, and any credit
+// it earned a referrer, and ends the subscription.
+func settleFullRefund(ctx context.Context, tx pgx.Tx, payment Payment, refund Refund, adminUserID int) error {
+	if payment.BillingPeriodID != nil {
+		if err := lifecycle.RefundPeriod(ctx, tx, *payment.BillingPeriodID); err != nil {
+			return err
+		}
+		if err := promo.ReverseReferralCredit(ctx, tx, *payment.BillingPeriodID); err != nil {
+			return err
+		}
+	}
+	_, err := lifecycle.Apply(ctx, tx, lifecycle.Request{
+		SubscriptionID: payment.SubscriptionID,
+		To:             lifecycle.Cancelled,
+		Actor:          lifecycle.ActorAdmin,
+		ActorUserID:    adminUserID,
+		Reason:         fmt.Sprintf("payment %s refunded: %s", payment.OrderID, refund.Reason),
+	})
+	if err != nil && !errors.Is(err, lifecycle.ErrIllegalTransition) {
+		return err
+	}
+	return nil
+}
+
+// Refunds lists the refunds of an order, oldest first.
+func Refunds(ctx context.Context, db DB, orderID string) ([]Refund, error) {
+	rows, err := db.Query(ctx, `
+		SELECT `+refundColumns+` FROM refunds
+		WHERE payment_id = (SELECT id FROM payments WHERE order_id = $1)
+		ORDER BY created_at`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refunds := make([]Refund, 0)
+	for rows.Next() {
+		r, err := scanRefund(rows)
+		if err != nil {
+			return nil, err
+		}
+		refunds = append(refunds, r)
+	}
+	return refunds, rows.Err()
+}
+
+// StuckRefunds lists refunds still requested after olderThan, oldest first.
+// They were sent to the gateway, or were about to be, but their result was
+// never recorded; RetryRefund finishes them.
+func StuckRefunds(ctx context.Context, db DB, olderThan time.Duration) ([]Refund, error) {
+	rows, err := db.Query(ctx, `
+		SELECT `+refundColumns+` FROM refunds
+		WHERE status = $1 AND created_at < $2
+		ORDER BY created_at`, RefundRequested, time.Now().Add(-olderThan))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refunds := make([]Refund, 0)
+	for rows.Next() {
+		r, err := scanRefund(rows)
+		if err != nil {
+			return nil, err
+		}
+		refunds = append(refunds, r)
+	}
+	return refunds, rows.Err()
+}
@@ -0,0 +1,271 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/Zeropeepo/sea-catering-backend/delivery"
+	"github.com/Zeropeepo/sea-catering-backend/pricing"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	PeriodOpen = "open"
+	PeriodPaid = "paid"
+	PeriodVoid = "void"
+	// PeriodRefunded is a paid period whose payment was given back in full.
+	PeriodRefunded = "refunded"
+)
+
+var ErrNoOpenPeriod = errors.New("no open billing period")
+
+// Period is one month of service. Start is its first day and End the first
+// day after it. Amount is the subtotal before discount and tax; Breakdown has
+// its lines, and is nil for periods billed before fees and tax existed. The
+// current period of a subscription is the paid one that covers today;
+// current_period_end is therefore the day it is paid up to.
+type Period struct {
+	ID             int64          `json:"id"`
+	SubscriptionID int            `json:"subscriptionId"`
+	Start          time.Time      `json:"periodStart"`
+	End            time.Time      `json:"periodEnd"`
+	Amount         float64        `json:"amount"`
+	Discount       float64        `json:"discount"`
+	Tax            float64        `json:"tax"`
+	CreditApplied  float64        `json:"creditApplied"`
+	Breakdown      *pricing.Quote `json:"breakdown"`
+	Status         string         `json:"status"`
+	PaidAt         *time.Time     `json:"paidAt"`
+	CreatedAt      time.Time      `json:"createdAt"`
+}
+
+// Total is what the period costs: the subtotal less discount, plus tax.
+func (p Period) Total() float64 {
+	return p.Amount - p.Discount + p.Tax
+}
+
+// AmountDue is what is left to pay once credit has been taken off the total.
+func (p Period) AmountDue() float64 {
+	return p.Total() - p.CreditApplied
+}
+
+// PeriodEnd returns the end of the period starting on start. Like Postgres'
+// interval '1 month', a start on the 31st ends on the last day of a shorter
+// month rather than spilling into the one after.
+func PeriodEnd(start time.Time) time.Time {
+	end := start.AddDate(0, 1, 0)
+	if end.Day() != start.Day() {
+		end = end.AddDate(0, 0, -end.Day())
+	}
+	return end
+}
+
+const periodColumns = `id, subscription_id, period_start, period_end, amount, discount, tax, credit_applied, breakdown, status, paid_at, created_at`
+
+func scanPeriod(row pgx.Row) (Period, error) {
+	var p Period
+	err := row.Scan(&p.ID, &p.SubscriptionID, &p.Start, &p.End, &p.Amount, &p.Discount, &p.Tax, &p.CreditApplied, &p.Breakdown, &p.Status, &p.PaidAt, &p.CreatedAt)
+	return p, err
+}
+
+// OpenPeriod bills a subscription for the period starting on start at the
+// price in quote, discounts included. Whole rupiah of the subscription's
+// credit balance are applied, up to the quote's total.
+func OpenPeriod(ctx context.Context, tx pgx.Tx, subscriptionID int, start time.Time, quote pricing.Quote) (Period, error) {
+	var balance float64
+	err := tx.QueryRow(ctx, `SELECT credit_balance FROM subscriptions WHERE id = $1 FOR UPDATE`, subscriptionID).Scan(&balance)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Period{}, ErrNotFound
+	}
+	if err != nil {
+		return Period{}, err
+	}
+
+	credit := math.Min(math.Floor(balance), quote.Total)
+	if credit > 0 {
+		_, err := tx.Exec(ctx, `UPDATE subscriptions SET credit_balance = credit_balance - $1 WHERE id = $2`, credit, subscriptionID)
+		if err != nil {
+			return Period{}, err
+		}
+	}
+
+	start = delivery.Day(start)
+	return scanPeriod(tx.QueryRow(ctx, `
+		INSERT INTO billing_periods (subscription_id, period_start, period_end, amount, discount, tax, credit_applied, breakdown)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING `+periodColumns,
+		subscriptionID, start, PeriodEnd(start), quote.Subtotal, quote.DiscountTotal(), quote.Tax, math.Max(credit, 0), quote))
+}
+
+// OpenPeriodFor returns the unpaid period of a subscription.
+func OpenPeriodFor(ctx context.Context, db Querier, subscriptionID int) (Period, error) {
+	p, err := scanPeriod(db.QueryRow(ctx, `
+		SELECT `+periodColumns+` FROM billing_periods
+		WHERE subscription_id = $1 AND status = 'open'
+		ORDER BY period_start LIMIT 1`, subscriptionID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return p, ErrNoOpenPeriod
+	}
+	return p, err
+}
+
+// PayPeriod marks a period paid by paymentID, or by credit when it is nil,
+// and, if it has already begun, makes it the subscription's current period. A
+// period paid so late that it has already ended starts again from today
+// instead. It reports false if the period was not open, for example because
+// it was already paid or voided.
+func PayPeriod(ctx context.Context, tx pgx.Tx, periodID int64, paymentID *int64) (bool, error) {
+	var subscriptionID int
+	var start, end time.Time
+	err := tx.QueryRow(ctx, `
+		UPDATE billing_periods SET status = 'paid', paid_at = now(), payment_id = $2
+		WHERE id = $1 AND status = 'open'
+		RETURNING subscription_id, period_start, period_end`, periodID, paymentID).Scan(&subscriptionID, &start, &end)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	today := delivery.Day(time.Now())
+	if !end.After(today) {
+		start, end = today, PeriodEnd(today)
+		_, err := tx.Exec(ctx, `UPDATE billing_periods SET period_start = $2, period_end = $3 WHERE id = $1`, periodID, start, end)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE subscriptions SET current_period_start = $2, current_period_end = $3
+		WHERE id = $1 AND $2 <= $4 AND (current_period_end IS NULL OR current_period_end <= $2)`,
+		subscriptionID, start, end, today)
+	return true, err
+}
+
+// PaidBy reports whether a period was paid by paymentID, as when a card
+// payment is captured and later settled.
+func PaidBy(ctx context.Context, db Querier, periodID, paymentID int64) (bool, error) {
+	var paid bool
+	err := db.QueryRow(ctx, `
+		SELECT EXISTS (SELECT 1 FROM billing_periods WHERE id = $1 AND payment_id = $2 AND status IN ('paid', 'refunded'))`,
+		periodID, paymentID).Scan(&paid)
+	return paid, err
+}
+
+// RefundPeriod marks a paid period refunded so it no longer counts as revenue.
+func RefundPeriod(ctx context.Context, tx pgx.Tx, periodID int64) error {
+	_, err := tx.Exec(ctx, `UPDATE billing_periods SET status = 'refunded' WHERE id = $1 AND status = 'paid'`, periodID)
+	return err
+}
+
+// VoidOpenPeriods drops the unpaid periods of a subscription, when it ends or
+// when its price changes before the first payment. Credit the periods had
+// taken goes back to the subscription's balance.
+func VoidOpenPeriods(ctx context.Context, tx pgx.Tx, subscriptionID int) error {
+	_, err := tx.Exec(ctx, `
+		WITH voided AS (
+			UPDATE billing_periods SET status = 'void'
+			WHERE subscription_id = $1 AND status = 'open'
+			RETURNING credit_applied
+		)
+		UPDATE subscriptions SET credit_balance = credit_balance + (SELECT COALESCE(SUM(credit_applied), 0) FROM voided)
+		WHERE id = $1`, subscriptionID)
+	return err
+}
+
+// Periods lists the billing periods of a subscription, newest first.
+func Periods(ctx context.Context, db Querier, subscriptionID int) ([]Period, error) {
+	rows, err := db.Query(ctx, `SELECT `+periodColumns+` FROM billing_periods WHERE subscription_id = $1 ORDER BY period_start DESC`, subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	periods := make([]Period, 0)
+	for rows.Next() {
+		p, err := scanPeriod(rows)
+		if err != nil {
+			return nil, err
+		}
+		periods = append(periods, p)
+	}
+	return periods, rows.Err()
+}
+
+// EnforceBillingPeriods moves subscriptions into periods paid in advance once
+// they begin, marks active subscriptions whose period ended unpaid as past
+// due, and suspends those still unpaid graceDays after that. It is safe to run
+// repeatedly.
+func EnforceBillingPeriods(ctx context.Context, db DB, graceDays int) (pastDue, suspended int, err error) {
+	today := delivery.Day(time.Now())
+
+	_, err = db.Exec(ctx, `
+		UPDATE subscriptions s SET current_period_start = bp.period_start, current_period_end = bp.period_end
+		FROM billing_periods bp
+		WHERE bp.subscription_id = s.id AND bp.status = 'paid'
+			AND bp.period_start = s.current_period_end AND bp.period_start <= $1`, today)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	overdue, err := selectIDs(ctx, db, `SELECT id FROM subscriptions WHERE status = 'active' AND current_period_end <= $1`, today)
+	if err != nil {
+		return 0, 0, err
+	}
+	cutoff := today.AddDate(0, 0, -graceDays)
+	lapsed, err := selectIDs(ctx, db, `SELECT id FROM subscriptions WHERE status = 'past_due' AND current_period_end <= $1`, cutoff)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var errs []error
+	for _, id := range overdue {
+		changed, err := applyIfUnpaid(ctx, db, id, Active, PastDue, today, "renewal not paid")
+		if err != nil {
+			errs = append(errs, fmt.Errorf("mark subscription %d past due: %w", id, err))
+		} else if changed {
+			pastDue++
+		}
+	}
+	for _, id := range lapsed {
+		changed, err := applyIfUnpaid(ctx, db, id, PastDue, Suspended, cutoff, fmt.Sprintf("renewal not paid after %d days", graceDays))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("suspend subscription %d: %w", id, err))
+		} else if changed {
+			suspended++
+		}
+	}
+	return pastDue, suspended, errors.Join(errs...)
+}
+
+// applyIfUnpaid moves a subscription from one status to another if, once it is
+// locked, it is still in that status and paid up to no later than cutoff. A
+// payment landing between the select and the lock leaves it alone.
+func applyIfUnpaid(ctx context.Context, db Beginner, subscriptionID int, from, to Status, cutoff time.Time, reason string) (bool, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	var status Status
+	var paidUntil *time.Time
+	err = tx.QueryRow(ctx, `SELECT status, current_period_end FROM subscriptions WHERE id = $1 FOR UPDATE`, subscriptionID).Scan(&status, &paidUntil)
+	if err != nil {
+		return false, err
+	}
+	if status != from || paidUntil == nil || paidUntil.After(cutoff) {
+		return false, nil
+	}
+
+	req := Request{SubscriptionID: subscriptionID, To: to, Actor: ActorScheduler, Reason: reason}
+	if err := transition(ctx, tx, status, req); err != nil {
+		return false, err
+	}
+	return true, tx.Commit(ctx)
+}
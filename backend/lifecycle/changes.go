@@ -0,0 +1,126 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/Zeropeepo/sea-catering-backend/pricing"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// ChangePending is an upgrade waiting for its prorated charge to be paid.
+	ChangePending = "pending"
+	ChangeApplied = "applied"
+	// ChangeSuperseded is an unpaid upgrade replaced by a newer change request.
+	ChangeSuperseded = "superseded"
+)
+
+// Change is a switch of plan, meals or delivery days on a subscription.
+// Proration is what the rest of the current period costs on top of what was
+// paid for it: positive for an upgrade, negative for a downgrade credit.
+// ProrationTax is the part of it that is tax.
+type Change struct {
+	ID              int64          `json:"id"`
+	SubscriptionID  int            `json:"subscriptionId"`
+	UserID          *int           `json:"userId"`
+	OldPlanID       *int           `json:"oldPlanId"`
+	NewPlanID       int            `json:"newPlanId"`
+	NewPlanName     string         `json:"newPlanName"`
+	OldMealTypes    []string       `json:"oldMealTypes"`
+	NewMealTypes    []string       `json:"newMealTypes"`
+	OldDeliveryDays []string       `json:"oldDeliveryDays"`
+	NewDeliveryDays []string       `json:"newDeliveryDays"`
+	OldAmount       float64        `json:"oldAmount"`
+	NewAmount       float64        `json:"newAmount"`
+	NewBreakdown    *pricing.Quote `json:"newBreakdown"`
+	Proration       float64        `json:"proration"`
+	ProrationTax    float64        `json:"prorationTax"`
+	Status          string         `json:"status"`
+	CreatedAt       time.Time      `json:"createdAt"`
+	AppliedAt       *time.Time     `json:"appliedAt"`
+}
+
+const changeColumns = `id, subscription_id, user_id, old_plan_id, new_plan_id, new_plan_name, old_meal_types, new_meal_types,
+	old_delivery_days, new_delivery_days, old_amount, new_amount, new_breakdown, proration, proration_tax, status, created_at, applied_at`
+
+func scanChange(row pgx.Row) (Change, error) {
+	var c Change
+	err := row.Scan(&c.ID, &c.SubscriptionID, &c.UserID, &c.OldPlanID, &c.NewPlanID, &c.NewPlanName, &c.OldMealTypes, &c.NewMealTypes,
+		&c.OldDeliveryDays, &c.NewDeliveryDays, &c.OldAmount, &c.NewAmount, &c.NewBreakdown, &c.Proration, &c.ProrationTax, &c.Status, &c.CreatedAt, &c.AppliedAt)
+	return c, err
+}
+
+// RecordChange stores a pending change request. The old side is read from the
+// subscription, which the caller should have locked. Earlier upgrades still
+// waiting for payment are superseded.
+func RecordChange(ctx context.Context, tx pgx.Tx, c Change) (Change, error) {
+	_, err := tx.Exec(ctx, `UPDATE subscription_changes SET status = $2 WHERE subscription_id = $1 AND status = $3`,
+		c.SubscriptionID, ChangeSuperseded, ChangePending)
+	if err != nil {
+		return Change{}, err
+	}
+
+	return scanChange(tx.QueryRow(ctx, `
+		INSERT INTO subscription_changes (subscription_id, user_id, old_plan_id, new_plan_id, new_plan_name,
+			old_meal_types, new_meal_types, old_delivery_days, new_delivery_days, old_amount, new_amount, new_breakdown,
+			proration, proration_tax, status)
+		SELECT s.id, $2, s.plan_id, $3, $4, s.meal_types, $5, s.delivery_days, $6, $7, $8, $9, $10, $11, $12
+		FROM subscriptions s WHERE s.id = $1
+		RETURNING `+changeColumns,
+		c.SubscriptionID, c.UserID, c.NewPlanID, c.NewPlanName, c.NewMealTypes, c.NewDeliveryDays,
+		c.OldAmount, c.NewAmount, c.NewBreakdown, c.Proration, c.ProrationTax, ChangePending))
+}
+
+// ApplyChange puts a pending change into effect, paid by paymentID, or by
+// nothing when it is nil. It reports false if the change is no longer
+// pending, for example because a newer request superseded it.
+func ApplyChange(ctx context.Context, tx pgx.Tx, changeID int64, paymentID *int64) (bool, error) {
+	c, err := scanChange(tx.QueryRow(ctx, `
+		UPDATE subscription_changes SET status = $2, applied_at = now(), payment_id = $4
+		WHERE id = $1 AND status = $3
+		RETURNING `+changeColumns, changeID, ChangeApplied, ChangePending, paymentID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE subscriptions
+		SET plan_id = $2, plan_name = $3, meal_types = $4, delivery_days = $5, total_price = $6, price_breakdown = $7, updated_at = now()
+		WHERE id = $1`,
+		c.SubscriptionID, c.NewPlanID, c.NewPlanName, c.NewMealTypes, c.NewDeliveryDays, c.NewAmount, c.NewBreakdown)
+	return true, err
+}
+
+// ChangePaidBy reports whether a change was applied by paymentID, as when a
+// card payment is captured and later settled.
+func ChangePaidBy(ctx context.Context, db Querier, changeID, paymentID int64) (bool, error) {
+	var paid bool
+	err := db.QueryRow(ctx, `
+		SELECT EXISTS (SELECT 1 FROM subscription_changes WHERE id = $1 AND payment_id = $2 AND status = $3)`,
+		changeID, paymentID, ChangeApplied).Scan(&paid)
+	return paid, err
+}
+
+// Changes lists the change requests of a subscription, newest first.
+func Changes(ctx context.Context, db Querier, subscriptionID int) ([]Change, error) {
+	rows, err := db.Query(ctx, `SELECT `+changeColumns+` FROM subscription_changes WHERE subscription_id = $1 ORDER BY created_at DESC`, subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := make([]Change, 0)
+	for rows.Next() {
+		c, err := scanChange(rows)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
@@ -0,0 +1,73 @@
+package lifecycle
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Event is one row of a subscription's status history. OldStatus is nil for
+// the event that records the subscription being created.
+type Event struct {
+	ID          int64     `json:"id"`
+	OldStatus   *Status   `json:"oldStatus"`
+	NewStatus   Status    `json:"newStatus"`
+	Actor       Actor     `json:"actor"`
+	ActorUserID *int      `json:"actorUserId"`
+	Reason      string    `json:"reason"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// Execer is satisfied by *pgxpool.Pool and pgx.Tx.
+type Execer interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+// Querier is satisfied by *pgxpool.Pool and pgx.Tx.
+type Querier interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// RecordCreated writes the first history entry for a new subscription. Call it
+// in the same transaction as the INSERT.
+func RecordCreated(ctx context.Context, db Execer, subscriptionID int, status Status, actor Actor, actorUserID int) error {
+	return recordEvent(ctx, db, subscriptionID, nil, status, actor, actorUserID, "created")
+}
+
+func recordEvent(ctx context.Context, db Execer, subscriptionID int, from *Status, to Status, actor Actor, actorUserID int, reason string) error {
+	var actorID *int
+	if actorUserID != 0 {
+		actorID = &actorUserID
+	}
+	_, err := db.Exec(ctx, `
+		INSERT INTO subscription_events (subscription_id, old_status, new_status, actor, actor_user_id, reason)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		subscriptionID, from, to, actor, actorID, reason)
+	return err
+}
+
+// History returns the status changes of a subscription, oldest first.
+func History(ctx context.Context, db Querier, subscriptionID int) ([]Event, error) {
+	rows, err := db.Query(ctx, `
+		SELECT id, old_status, new_status, actor, actor_user_id, reason, created_at
+		FROM subscription_events
+		WHERE subscription_id = $1
+		ORDER BY created_at ASC, id ASC`, subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]Event, 0)
+	for rows.Next() {
+		var e Event
+		if err := rows.Scan(&e.ID, &e.OldStatus, &e.NewStatus, &e.Actor, &e.ActorUserID, &e.Reason, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
@@ -0,0 +1,50 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ExpirePending moves subscriptions to expired once they have been pending for
+// longer than ttl since their latest payment order, or since they were created
+// if they have none, so an order opened near the deadline is not voided while
+// the customer is paying it. cancelOrders is called first to void any outstanding payment
+// orders; if it fails the subscription stays pending and is retried on the
+// next run, so a payment that is still in flight can never land on an expired
+// row.
+func ExpirePending(ctx context.Context, db DB, ttl time.Duration, cancelOrders func(ctx context.Context, subscriptionID int) error) (int, error) {
+	candidates, err := selectIDs(ctx, db, `
+		SELECT s.id FROM subscriptions s
+		WHERE s.status = 'pending'
+		AND COALESCE((SELECT MAX(p.created_at) FROM payments p WHERE p.subscription_id = s.id), s.created_at) < $1`, time.Now().Add(-ttl))
+	if err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	var errs []error
+	for _, id := range candidates {
+		if err := cancelOrders(ctx, id); err != nil {
+			errs = append(errs, fmt.Errorf("cancel orders for subscription %d: %w", id, err))
+			continue
+		}
+		_, err := Apply(ctx, db, Request{
+			SubscriptionID: id,
+			To:             Expired,
+			Actor:          ActorScheduler,
+			Reason:         fmt.Sprintf("unpaid after %s", ttl),
+		})
+		if errors.Is(err, ErrIllegalTransition) {
+			// Paid or cancelled since we looked
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("expire subscription %d: %w", id, err))
+			continue
+		}
+		expired++
+	}
+	return expired, errors.Join(errs...)
+}
@@ -0,0 +1,179 @@
+// Package lifecycle owns the subscription state machine. Every status change,
+// whether it comes from a user, an admin, the payment webhook or a background
+// job, goes through Apply so the rules live in one place.
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type Status string
+
+const (
+	Pending   Status = "pending"
+	Active    Status = "active"
+	Paused    Status = "paused"
+	Cancelled Status = "cancelled"
+	Expired   Status = "expired"
+	// PastDue and Suspended mark a renewal that has not been paid, first
+	// within the grace period and then after it.
+	PastDue   Status = "past_due"
+	Suspended Status = "suspended"
+)
+
+// Actor identifies who asked for a transition.
+type Actor string
+
+const (
+	ActorUser      Actor = "user"
+	ActorAdmin     Actor = "admin"
+	ActorWebhook   Actor = "webhook"
+	ActorScheduler Actor = "scheduler"
+	// ActorBilling settles a billing period without a gateway payment, such
+	// as one covered entirely by credit.
+	ActorBilling Actor = "billing"
+)
+
+var (
+	ErrNotFound          = errors.New("subscription not found")
+	ErrIllegalTransition = errors.New("illegal status transition")
+)
+
+type rule struct {
+	from, to Status
+	actors   []Actor
+}
+
+// rules lists every allowed transition and who may trigger it. Anything not
+// listed is illegal; in particular cancelled and expired have no outgoing
+// transitions.
+var rules = []rule{
+	{Pending, Active, []Actor{ActorWebhook, ActorBilling}},
+	{Active, Paused, []Actor{ActorUser, ActorAdmin, ActorScheduler}},
+	{Paused, Active, []Actor{ActorUser, ActorAdmin, ActorScheduler}},
+	{Pending, Cancelled, []Actor{ActorUser, ActorAdmin}},
+	// The webhook cancels on a full refund or chargeback
+	{Active, Cancelled, []Actor{ActorUser, ActorAdmin, ActorWebhook}},
+	{Paused, Cancelled, []Actor{ActorUser, ActorAdmin, ActorWebhook}},
+	{Pending, Expired, []Actor{ActorScheduler}},
+	{Active, PastDue, []Actor{ActorScheduler}},
+	{PastDue, Suspended, []Actor{ActorScheduler}},
+	{PastDue, Active, []Actor{ActorWebhook, ActorBilling}},
+	{Suspended, Active, []Actor{ActorWebhook, ActorBilling}},
+	{PastDue, Cancelled, []Actor{ActorUser, ActorAdmin, ActorWebhook}},
+	{Suspended, Cancelled, []Actor{ActorUser, ActorAdmin, ActorWebhook}},
+}
+
+// TransitionError explains why a transition was refused.
+type TransitionError struct {
+	From, To Status
+	Actor    Actor
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("%s cannot move a subscription from %s to %s", e.Actor, e.From, e.To)
+}
+
+func (e *TransitionError) Unwrap() error { return ErrIllegalTransition }
+
+// Check reports whether actor may move a subscription from one status to another.
+func Check(from, to Status, actor Actor) error {
+	for _, r := range rules {
+		if r.from != from || r.to != to {
+			continue
+		}
+		for _, a := range r.actors {
+			if a == actor {
+				return nil
+			}
+		}
+	}
+	return &TransitionError{From: from, To: to, Actor: actor}
+}
+
+// Beginner is satisfied by both *pgxpool.Pool and pgx.Tx, so Apply can run on
+// its own or inside a caller's transaction.
+type Beginner interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+// Request describes a status change. UserID restricts the change to
+// subscriptions owned by that user; leave it zero for admin and system actors.
+// ActorUserID is recorded in the history for user and admin actors.
+type Request struct {
+	SubscriptionID int
+	UserID         int
+	To             Status
+	Actor          Actor
+	ActorUserID    int
+	Reason         string
+}
+
+// Apply locks the subscription, validates the transition, stores the new
+// status and records the change in subscription_events. It returns the status
+// the subscription had before the change.
+func Apply(ctx context.Context, db Beginner, req Request) (Status, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	from, err := lockStatus(ctx, tx, req.SubscriptionID, req.UserID)
+	if err != nil {
+		return "", err
+	}
+	if err := transition(ctx, tx, from, req); err != nil {
+		return from, err
+	}
+	return from, tx.Commit(ctx)
+}
+
+// lockStatus reads a subscription's status and holds a row lock on it until
+// the transaction ends.
+func lockStatus(ctx context.Context, tx pgx.Tx, subscriptionID, userID int) (Status, error) {
+	query := `SELECT status FROM subscriptions WHERE id = $1 FOR UPDATE`
+	args := []any{subscriptionID}
+	if userID != 0 {
+		query = `SELECT status FROM subscriptions WHERE id = $1 AND user_id = $2 FOR UPDATE`
+		args = append(args, userID)
+	}
+
+	var status Status
+	if err := tx.QueryRow(ctx, query, args...).Scan(&status); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", ErrNotFound
+		}
+		return "", err
+	}
+	return status, nil
+}
+
+// transition validates and stores a change on a row already locked by lockStatus.
+func transition(ctx context.Context, tx pgx.Tx, from Status, req Request) error {
+	if err := Check(from, req.To, req.Actor); err != nil {
+		return err
+	}
+
+	if from == Paused && req.To == Active {
+		if err := endPause(ctx, tx, req.SubscriptionID); err != nil {
+			return err
+		}
+	}
+
+	if req.To == Cancelled || req.To == Expired {
+		if err := VoidOpenPeriods(ctx, tx, req.SubscriptionID); err != nil {
+			return err
+		}
+	}
+
+	_, err := tx.Exec(ctx, `UPDATE subscriptions SET status = $1, updated_at = now() WHERE id = $2`, req.To, req.SubscriptionID)
+	if err != nil {
+		return err
+	}
+	return recordEvent(ctx, tx, req.SubscriptionID, &from, req.To, req.Actor, req.ActorUserID, req.Reason)
+}
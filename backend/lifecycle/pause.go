@@ -0,0 +1,194 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Zeropeepo/sea-catering-backend/delivery"
+	"github.com/Zeropeepo/sea-catering-backend/pricing"
+	"github.com/jackc/pgx/v5"
+)
+
+// MaxPauseDays caps how long a single pause may last.
+const MaxPauseDays = 90
+
+var (
+	ErrInvalidPause     = errors.New("invalid pause window")
+	ErrNoScheduledPause = errors.New("no pause is scheduled to start later; a pause that has begun is ended by resuming")
+)
+
+// DB is what the background helpers need: a pool that can both query and
+// start transactions.
+type DB interface {
+	Beginner
+	Querier
+	Execer
+}
+
+// ValidatePause checks a pause window requested on the given day.
+func ValidatePause(w delivery.Window, today time.Time) error {
+	start, end := delivery.Day(w.Start), delivery.Day(w.End)
+	if start.Before(delivery.Day(today)) {
+		return fmt.Errorf("%w: pauseStart cannot be in the past", ErrInvalidPause)
+	}
+	if end.Before(start) {
+		return fmt.Errorf("%w: pauseEnd cannot be before pauseStart", ErrInvalidPause)
+	}
+	if end.Sub(start) >= MaxPauseDays*24*time.Hour {
+		return fmt.Errorf("%w: a pause cannot be longer than %d days", ErrInvalidPause, MaxPauseDays)
+	}
+	return nil
+}
+
+// SchedulePause stores a pause window on an active subscription. If the window
+// has already started the subscription is paused straight away. It reports
+// whether the subscription is paused now.
+func SchedulePause(ctx context.Context, db Beginner, req Request, w delivery.Window) (bool, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	from, err := lockStatus(ctx, tx, req.SubscriptionID, req.UserID)
+	if err != nil {
+		return false, err
+	}
+	if err := Check(from, Paused, req.Actor); err != nil {
+		return false, err
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE subscriptions SET pause_start = $1, pause_end = $2, updated_at = now() WHERE id = $3`,
+		delivery.Day(w.Start), delivery.Day(w.End), req.SubscriptionID)
+	if err != nil {
+		return false, err
+	}
+
+	pausedNow := !delivery.Day(w.Start).After(delivery.Day(time.Now()))
+	if pausedNow {
+		req.To = Paused
+		if err := transition(ctx, tx, from, req); err != nil {
+			return false, err
+		}
+	}
+	return pausedNow, tx.Commit(ctx)
+}
+
+// CancelScheduledPause drops a pause window that has not begun yet. A pause
+// can be moved by scheduling it again; one that has begun is ended by
+// resuming instead, so the days already skipped are credited. userID limits
+// the change to the owner's subscription; zero allows any.
+func CancelScheduledPause(ctx context.Context, db Beginner, subscriptionID, userID int) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	status, err := lockStatus(ctx, tx, subscriptionID, userID)
+	if err != nil {
+		return err
+	}
+	tag, err := tx.Exec(ctx, `
+		UPDATE subscriptions SET pause_start = NULL, pause_end = NULL, updated_at = now()
+		WHERE id = $1 AND pause_start > $2`, subscriptionID, delivery.Day(time.Now()))
+	if err != nil {
+		return err
+	}
+	if status != Active || tag.RowsAffected() == 0 {
+		return ErrNoScheduledPause
+	}
+	return tx.Commit(ctx)
+}
+
+// endPause credits the deliveries skipped so far and clears the pause window.
+// A pause without dates, such as one set by an admin, earns no credit.
+func endPause(ctx context.Context, tx pgx.Tx, subscriptionID int) error {
+	var start, end *time.Time
+	var pricePerMeal float64
+	var mealTypes, deliveryDays []string
+	err := tx.QueryRow(ctx, `
+		SELECT s.pause_start, s.pause_end, COALESCE(p.price_per_meal, 0), s.meal_types, s.delivery_days
+		FROM subscriptions s LEFT JOIN plans p ON p.id = s.plan_id
+		WHERE s.id = $1`, subscriptionID).Scan(&start, &end, &pricePerMeal, &mealTypes, &deliveryDays)
+	if err != nil {
+		return err
+	}
+
+	credit := 0.0
+	if start != nil && end != nil {
+		first, last := delivery.Date(*start), delivery.Day(time.Now()).AddDate(0, 0, -1)
+		if end := delivery.Date(*end); end.Before(last) {
+			last = end
+		}
+		if !last.Before(first) {
+			credit = pricing.PauseCredit(pricePerMeal, mealTypes, deliveryDays, delivery.Window{Start: first, End: last})
+		}
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE subscriptions
+		SET pause_start = NULL, pause_end = NULL, credit_balance = credit_balance + $1
+		WHERE id = $2`, credit, subscriptionID)
+	return err
+}
+
+// ApplyPauseWindows pauses subscriptions whose pause window has begun and
+// resumes those whose window has ended. It is safe to run repeatedly.
+func ApplyPauseWindows(ctx context.Context, db DB) (started, resumed int, err error) {
+	today := delivery.Day(time.Now())
+
+	// Windows that passed entirely while the job was not running are dropped
+	_, err = db.Exec(ctx, `UPDATE subscriptions SET pause_start = NULL, pause_end = NULL WHERE status = 'active' AND pause_end < $1`, today)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	toStart, err := selectIDs(ctx, db, `SELECT id FROM subscriptions WHERE status = 'active' AND pause_start <= $1 AND pause_end >= $1`, today)
+	if err != nil {
+		return 0, 0, err
+	}
+	toResume, err := selectIDs(ctx, db, `SELECT id FROM subscriptions WHERE status = 'paused' AND pause_end < $1`, today)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var errs []error
+	for _, id := range toStart {
+		_, err := Apply(ctx, db, Request{SubscriptionID: id, To: Paused, Actor: ActorScheduler, Reason: "scheduled pause started"})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("pause subscription %d: %w", id, err))
+			continue
+		}
+		started++
+	}
+	for _, id := range toResume {
+		_, err := Apply(ctx, db, Request{SubscriptionID: id, To: Active, Actor: ActorScheduler, Reason: "pause window ended"})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("resume subscription %d: %w", id, err))
+			continue
+		}
+		resumed++
+	}
+	return started, resumed, errors.Join(errs...)
+}
+
+func selectIDs(ctx context.Context, db Querier, query string, args ...any) ([]int, error) {
+	rows, err := db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]int, 0)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -0,0 +1,69 @@
+// Package mailer sends the emails the backend needs, such as password
+// resets. Which sender is used is chosen at startup; during development the
+// file sender writes every message to disk instead of sending it.
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Zeropeepo/sea-catering-backend/config"
+)
+
+var ErrInvalidHeader = errors.New("email header contains a line break")
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends messages.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// FromConfig returns the mailer selected by MAILER.
+func FromConfig() (Mailer, error) {
+	from := config.String("MAIL_FROM", "SEA Catering <no-reply@seacatering.local>")
+
+	switch name := config.String("MAILER", "file"); name {
+	case "file":
+		return NewFile(config.String("MAIL_DIR", "mail"), from), nil
+	case "smtp":
+		host := config.String("SMTP_HOST", "")
+		if host == "" {
+			return nil, errors.New("MAILER=smtp requires SMTP_HOST")
+		}
+		return NewSMTP(host, config.Int("SMTP_PORT", 587), os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), from)
+	default:
+		return nil, fmt.Errorf("unknown MAILER %q", name)
+	}
+}
+
+// format renders msg as an RFC 5322 message.
+func format(from string, msg Message) ([]byte, error) {
+	for _, header := range []string{from, msg.To, msg.Subject} {
+		if strings.ContainsAny(header, "\r\n") {
+			return nil, ErrInvalidHeader
+		}
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return b.Bytes(), nil
+}
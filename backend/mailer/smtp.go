@@ -0,0 +1,47 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+)
+
+// SMTP sends through a mail server, upgrading to TLS with STARTTLS when the
+// server offers it.
+type SMTP struct {
+	addr     string
+	auth     smtp.Auth
+	from     string
+	envelope string
+}
+
+func NewSMTP(host string, port int, username, password, from string) (*SMTP, error) {
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MAIL_FROM %q: %w", from, err)
+	}
+	s := &SMTP{
+		addr:     net.JoinHostPort(host, strconv.Itoa(port)),
+		from:     from,
+		envelope: sender.Address,
+	}
+	if username != "" {
+		s.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return s, nil
+}
+
+func (s *SMTP) Send(ctx context.Context, msg Message) error {
+	to, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return err
+	}
+	data, err := format(s.from, msg)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(s.addr, s.auth, s.envelope, []string{to.Address}, data)
+}
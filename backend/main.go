@@ -1,12 +1,29 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/Zeropeepo/sea-catering-backend/account"
+	"github.com/Zeropeepo/sea-catering-backend/config"
 	"github.com/Zeropeepo/sea-catering-backend/database"
+	"github.com/Zeropeepo/sea-catering-backend/gateway"
 	"github.com/Zeropeepo/sea-catering-backend/handlers"
+	"github.com/Zeropeepo/sea-catering-backend/mailer"
 	"github.com/Zeropeepo/sea-catering-backend/middleware"
+	"github.com/Zeropeepo/sea-catering-backend/pricing"
+	"github.com/Zeropeepo/sea-catering-backend/promo"
+	"github.com/Zeropeepo/sea-catering-backend/ratelimit"
+	"github.com/Zeropeepo/sea-catering-backend/rbac"
+	"github.com/Zeropeepo/sea-catering-backend/scheduler"
+	"github.com/Zeropeepo/sea-catering-backend/session"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
@@ -25,41 +42,216 @@ func main() {
 	}
 	defer database.DB.Close()
 
+	if err := database.Migrate(); err != nil {
+		log.Fatalf("Failed to migrate the database: %v", err)
+	}
+
+	payments, err := gateway.FromConfig()
+	if err != nil {
+		log.Fatalf("Failed to set up the payment gateway: %v", err)
+	}
+	handlers.SetPaymentGateway(payments)
+
+	fees := pricing.Fees{
+		TaxRate:     config.Float("TAX_RATE_PERCENT", 0),
+		DeliveryFee: config.Float("DELIVERY_FEE", 0),
+		ServiceFee:  config.Float("SERVICE_FEE", 0),
+	}
+	if fees.TaxRate < 0 || fees.DeliveryFee < 0 || fees.ServiceFee < 0 {
+		log.Fatalf("TAX_RATE_PERCENT, DELIVERY_FEE and SERVICE_FEE cannot be negative")
+	}
+	pricing.SetFees(fees)
+	referralPercent, referralReward := config.Float("REFERRAL_DISCOUNT_PERCENT", 10), config.Float("REFERRAL_REWARD", 50000)
+	if referralPercent <= 0 || referralPercent > 100 || referralReward < 0 {
+		log.Fatalf("REFERRAL_DISCOUNT_PERCENT must be above 0 and at most 100, and REFERRAL_REWARD cannot be negative")
+	}
+	promo.SetReferralTerms(referralPercent, referralReward)
+	cookieOptions, err := session.CookieOptionsFromConfig()
+	if err != nil {
+		log.Fatalf("Failed to set up session cookies: %v", err)
+	}
+	session.SetCookieOptions(cookieOptions)
+	mail, err := mailer.FromConfig()
+	if err != nil {
+		log.Fatalf("Failed to set up the mailer: %v", err)
+	}
+	handlers.SetMailer(mail, config.String("APP_URL", "http://localhost:3000"))
+	account.SetResetLifetime(config.Duration("PASSWORD_RESET_TTL", 30*time.Minute))
+	account.SetVerificationLifetime(config.Duration("EMAIL_VERIFICATION_TTL", 48*time.Hour))
+	// Sealed with JWT_SECRET, two-factor secrets would be lost whenever it is
+	// rotated. Without a key of their own, existing ones still work but
+	// nobody new can enroll.
+	if key := config.String("TWO_FACTOR_KEY", ""); key != "" {
+		account.SetSecretKey(key)
+	} else {
+		fmt.Println("Warning: TWO_FACTOR_KEY is not set; two-factor setup is turned off until it is")
+		account.SetFallbackSecretKey(os.Getenv("JWT_SECRET"))
+	}
+	session.SetLifetimes(config.Duration("ACCESS_TOKEN_TTL", 15*time.Minute), config.Duration("REFRESH_TOKEN_TTL", 30*24*time.Hour))
+
+	limits, err := ratelimit.StoreFromConfig(database.DB)
+	if err != nil {
+		log.Fatalf("Failed to set up rate limiting: %v", err)
+	}
+	// Failed logins back off from a second up; enough of them on one account lock it for a while
+	lockoutFor := config.Duration("LOGIN_LOCKOUT_DURATION", 15*time.Minute)
+	handlers.SetAuthLimits(handlers.AuthLimits{
+		LoginIP: ratelimit.New("login-ip", limits, ratelimit.Policy{
+			Free: 20, BaseDelay: time.Second, MaxDelay: 5 * time.Minute, ForgetAfter: time.Hour,
+		}),
+		LoginAccount: ratelimit.New("login-account", limits, ratelimit.Policy{
+			Free: 3, BaseDelay: time.Second, MaxDelay: time.Minute,
+			LockoutAfter: config.Int("LOGIN_LOCKOUT_ATTEMPTS", 10), LockoutFor: lockoutFor,
+			ForgetAfter: max(time.Hour, lockoutFor),
+		}),
+		RegisterIP: ratelimit.New("register-ip", limits, ratelimit.Policy{
+			Free: 5, BaseDelay: time.Minute, MaxDelay: time.Hour, ForgetAfter: 6 * time.Hour,
+		}),
+	})
+
+	roles := rbac.NewCache(database.DB, config.Duration("ROLE_CACHE_TTL", time.Minute))
+	handlers.SetRoleCache(roles)
+	can := func(perms ...rbac.Permission) gin.HandlerFunc {
+		return middleware.RequirePermission(roles, perms...)
+	}
+
+	jobs := scheduler.New(database.DB)
+	if err := registerJobs(jobs, payments, limits); err != nil {
+		log.Fatalf("Failed to register background jobs: %v", err)
+	}
+	if !config.Bool("SCHEDULER_DISABLED", false) {
+		jobs.Start()
+	}
+
 	router := gin.Default()
+	// Only these proxies may set X-Forwarded-For; with none, ClientIP is the peer address
+	if err := router.SetTrustedProxies(config.List("TRUSTED_PROXIES")); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+	webhookAllowlist := config.List("MIDTRANS_WEBHOOK_ALLOWED_IPS")
+	webhookMaxBody := int64(config.Int("WEBHOOK_MAX_BODY_BYTES", 64<<10))
+	requireVerifiedEmail := config.Bool("REQUIRE_EMAIL_VERIFICATION", true)
 
-	config := cors.DefaultConfig()
-	config.AllowOrigins = []string{"http://localhost:3000"}
-	config.AllowMethods = []string{"POST", "GET", "OPTIONS", "PUT", "DELETE"}
-	config.AllowHeaders = []string{"Origin", "Content-Type", "Authorization", "X-CSRF-Token"}
-	router.Use(cors.New(config))
+	corsConfig := cors.DefaultConfig()
+	corsConfig.AllowOrigins = []string{"http://localhost:3000"}
+	corsConfig.AllowMethods = []string{"POST", "GET", "OPTIONS", "PUT", "DELETE"}
+	corsConfig.AllowHeaders = []string{"Origin", "Content-Type", "Authorization", "X-CSRF-Token"}
+	// Cookies are only sent cross-origin when the response allows credentials
+	corsConfig.AllowCredentials = session.CookieMode()
+	router.Use(cors.New(corsConfig))
 
 	api := router.Group("/api")
 	{
 		api.GET("/testimonials", handlers.GetTestimonialsHandler)
+		api.GET("/plans", handlers.GetPlansHandler)
+		api.GET("/plans/:id", handlers.GetPlanHandler)
 		api.POST("/register", handlers.RegisterHandler)
 		api.POST("/login", handlers.LoginHandler)
+		api.POST("/login/2fa", handlers.LoginTwoFactorHandler)
+		api.POST("/token/refresh", handlers.RefreshTokenHandler)
+		api.POST("/password/forgot", handlers.ForgotPasswordHandler)
+		api.POST("/password/reset", handlers.ResetPasswordHandler)
+		api.GET("/verify-email", handlers.VerifyEmailHandler)
+	}
+
+	// Gateway callbacks carry no user token; they are verified by signature instead
+	webhooks := api.Group("/midtrans")
+	webhooks.Use(middleware.IPAllowlist(webhookAllowlist), middleware.BodyLimit(webhookMaxBody))
+	{
+		webhooks.POST("/notification", handlers.MidtransNotificationHandler)
+	}
+
+	if _, ok := payments.(*gateway.Fake); ok {
+		fmt.Println("Using the fake payment gateway; no real payments will be taken")
+		api.POST("/fake-gateway/orders/:orderId/:status", handlers.FakeGatewayNotifyHandler)
 	}
 
+	// Anything that takes a payment needs a verified email address
+	verified := middleware.RequireVerifiedEmail(requireVerifiedEmail)
+
 	protected := api.Group("/")
 	protected.Use(middleware.AuthMiddleware())
 	{
-		protected.POST("/subscribe", handlers.SubscribeHandler)
+		protected.POST("/subscribe", verified, handlers.SubscribeHandler)
+		protected.POST("/subscriptions/quote", handlers.QuoteSubscriptionHandler)
 		protected.POST("/testimonials", handlers.CreateTestimonialsHandler)
 		protected.GET("/me", handlers.GetUserProfileHandler)
+		protected.POST("/logout", handlers.LogoutHandler)
+		protected.POST("/logout/all", handlers.LogoutAllHandler)
+		protected.POST("/verify-email/resend", handlers.ResendVerificationHandler)
+		protected.GET("/2fa", handlers.GetTwoFactorStatusHandler)
+		protected.POST("/2fa/enroll", handlers.EnrollTwoFactorHandler)
+		protected.POST("/2fa/confirm", handlers.ConfirmTwoFactorHandler)
+		protected.POST("/2fa/disable", handlers.DisableTwoFactorHandler)
+		protected.POST("/2fa/recovery-codes", handlers.RegenerateRecoveryCodesHandler)
 		protected.GET("/subscriptions", handlers.GetUserSubscriptionsHandler)
+		protected.PUT("/subscriptions/:id", verified, handlers.UpdateSubscriptionHandler)
+		protected.GET("/subscriptions/:id/changes", handlers.GetSubscriptionChangesHandler)
 		protected.PUT("/subscriptions/:id/status", handlers.UpdateSubscriptionStatusHandler)
+		protected.DELETE("/subscriptions/:id/pause", handlers.CancelScheduledPauseHandler)
+		protected.GET("/subscriptions/:id/history", handlers.GetSubscriptionHistoryHandler)
 		protected.POST("/subscriptions/:id/ai-recommendation", handlers.GetAIRecommendationHandler)
 
-		protected.POST("/midtrans/notification", handlers.MidtransNotificationHandler)
-		protected.POST("/subscriptions/:id/create-payment", handlers.CreatePaymentHandler)
+		protected.POST("/subscriptions/:id/create-payment", verified, handlers.CreatePaymentHandler)
+		protected.GET("/subscriptions/:id/payments", handlers.GetSubscriptionPaymentsHandler)
+		protected.GET("/subscriptions/:id/billing-periods", handlers.GetSubscriptionBillingPeriodsHandler)
+		protected.GET("/referral-code", handlers.GetReferralCodeHandler)
+		protected.GET("/invoices", handlers.GetUserInvoicesHandler)
+		protected.GET("/invoices/:id", handlers.GetInvoiceHandler)
 	}
 
+	// Staff roles get into the admin API; each route then asks for its own permission
 	admin := api.Group("/admin")
-	admin.Use(middleware.AdminMiddleware()) // Protect this whole group
+	admin.Use(middleware.AuthMiddleware(), can(rbac.StaffAccess), middleware.RequireTwoFactor())
 	{
-		admin.GET("/dashboard-stats", handlers.GetAdminDashboardHandler)
+		admin.GET("/dashboard-stats", can(rbac.DashboardRead), handlers.GetAdminDashboardHandler)
+		admin.PUT("/subscriptions/:id/status", can(rbac.SubscriptionsManage), handlers.AdminUpdateSubscriptionStatusHandler)
+		admin.GET("/subscriptions/:id/history", can(rbac.SubscriptionsReadAll), handlers.AdminGetSubscriptionHistoryHandler)
+		admin.GET("/jobs/runs", can(rbac.JobsRead), handlers.GetJobRunsHandler)
+		admin.GET("/login-attempts", can(rbac.SecurityRead), handlers.GetLoginAttemptsHandler)
+		admin.GET("/payments", can(rbac.PaymentsReadAll), handlers.GetAdminPaymentsHandler)
+		admin.POST("/payments/:orderId/refund", can(rbac.PaymentsRefund), handlers.RefundPaymentHandler)
+		admin.GET("/payments/:orderId/refunds", can(rbac.PaymentsReadAll), handlers.GetPaymentRefundsHandler)
+		admin.GET("/refunds/stuck", can(rbac.PaymentsReadAll), handlers.GetStuckRefundsHandler)
+		admin.POST("/refunds/:refundKey/retry", can(rbac.PaymentsRefund), handlers.RetryRefundHandler)
+		admin.GET("/invoices", can(rbac.InvoicesReadAll), handlers.GetAdminInvoicesHandler)
+		admin.GET("/invoices/:id", can(rbac.InvoicesReadAll), handlers.AdminGetInvoiceHandler)
+		admin.GET("/plans", can(rbac.MenuWrite), handlers.GetAdminPlansHandler)
+		admin.POST("/plans", can(rbac.MenuWrite), handlers.CreatePlanHandler)
+		admin.PUT("/plans/:id", can(rbac.MenuWrite), handlers.UpdatePlanHandler)
+		admin.DELETE("/plans/:id", can(rbac.MenuWrite), handlers.RetirePlanHandler)
+		admin.GET("/promo-codes", can(rbac.PromosWrite), handlers.GetAdminPromoCodesHandler)
+		admin.POST("/promo-codes", can(rbac.PromosWrite), handlers.CreatePromoCodeHandler)
+		admin.PUT("/promo-codes/:id", can(rbac.PromosWrite), handlers.UpdatePromoCodeHandler)
+		admin.DELETE("/promo-codes/:id", can(rbac.PromosWrite), handlers.DeactivatePromoCodeHandler)
+		admin.GET("/promo-codes/:id/redemptions", can(rbac.PromosWrite), handlers.GetPromoCodeRedemptionsHandler)
+		admin.GET("/roles", can(rbac.UsersManageRoles), handlers.GetRolesHandler)
+		admin.GET("/users", can(rbac.UsersManageRoles), handlers.GetAdminUsersHandler)
+		admin.PUT("/users/:id/role", can(rbac.UsersManageRoles), handlers.UpdateUserRoleHandler)
+		admin.GET("/security-settings", can(rbac.SecurityManage), handlers.GetSecuritySettingsHandler)
+		admin.PUT("/security-settings", can(rbac.SecurityManage), handlers.UpdateSecuritySettingsHandler)
 	}
 
+	srv := &http.Server{Addr: ":8080", Handler: router}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Server failed: %v", err)
+		}
+	}()
 	fmt.Println(`Backend server is running on ${import.meta.env.VITE_DEPLOY_API_URL}`)
-	router.Run(":8080")
+
+	// Wait for Ctrl+C or a container stop, then let requests and jobs finish
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	fmt.Println("Shutting down...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		fmt.Printf("Error shutting down HTTP server: %v\n", err)
+	}
+	if err := jobs.Stop(shutdownCtx); err != nil {
+		fmt.Printf("Error stopping background jobs: %v\n", err)
+	}
 }
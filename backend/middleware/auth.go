@@ -3,91 +3,75 @@ package middleware
 import (
 	"fmt"
 	"net/http"
-	"os"
 	"strings"
 	"context"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/Zeropeepo/sea-catering-backend/database"
+	"github.com/Zeropeepo/sea-catering-backend/session"
 )
 
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		// API clients keep sending a Bearer token even in cookie mode
 		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
+		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
+		fromCookie := false
+		switch {
+		case authHeader != "":
+			if tokenString == authHeader {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Bearer token not found"})
+				return
+			}
+		case session.CookieMode():
+			cookie, err := c.Cookie(session.AccessCookie)
+			if err != nil || cookie == "" {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Not logged in"})
+				return
+			}
+			tokenString = cookie
+			fromCookie = true
+		default:
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
 			return
 		}
 
-		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-		if tokenString == authHeader {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Bearer token not found"})
+		claims, err := session.ParseAccessToken(tokenString)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
 			return
 		}
 
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			return []byte(os.Getenv("JWT_SECRET")), nil
-		})
-
-		if err != nil || !token.Valid {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
+		// A valid signature is not enough once the user has logged out
+		active, err := session.Active(context.Background(), database.DB, claims.SessionID, claims.UserID)
+		if err != nil {
+			fmt.Printf("Error checking session %d: %v\n", claims.SessionID, err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Could not verify session"})
 			return
 		}
+		if !active {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Session has been revoked"})
+			return
+		}
+		c.Set("userID", claims.UserID)
+		c.Set("sessionID", claims.SessionID)
 
-		// Extract claims and pass UserID to the context 
-		if claims, ok := token.Claims.(jwt.MapClaims); ok {
-			if userIDFloat, ok := claims["sub"].(float64); ok {
-				userID := int(userIDFloat)
-				c.Set("userID", userID)
-			} else {
-                c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid user ID in token"})
-                return
-            }
-
-            // Perform CSRF check for state-changing methods
-            if c.Request.Method != "GET" {
-                headerCsrf := c.GetHeader("X-CSRF-Token")
-                claimCsrf, ok := claims["csrf"].(string)
-                if !ok || headerCsrf == "" || headerCsrf != claimCsrf {
-                    c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "CSRF token mismatch"})
-                    return
-                }
-            }
-		} else {
-            c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Could not parse token claims"})
-            return
-        }
+		// Perform CSRF check for state-changing methods
+		if c.Request.Method != "GET" {
+			headerCsrf := c.GetHeader("X-CSRF-Token")
+			if claims.CSRF == "" || headerCsrf == "" || headerCsrf != claims.CSRF {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "CSRF token mismatch"})
+				return
+			}
+			// Double submit: the header must also match the CSRF cookie
+			if fromCookie {
+				if cookieCsrf, _ := c.Cookie(session.CSRFCookie); cookieCsrf != headerCsrf {
+					c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "CSRF token mismatch"})
+					return
+				}
+			}
+		}
 
 		c.Next()
 	}
 }
-
-func AdminMiddleware() gin.HandlerFunc {
-    return func(c *gin.Context) {
-        AuthMiddleware()(c)
-        if c.IsAborted() {
-            return
-        }
-
-        userID, _ := c.Get("userID")
-        var role string
-
-        err := database.DB.QueryRow(context.Background(), "SELECT role FROM users WHERE id = $1", userID).Scan(&role)
-        if err != nil {
-            c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Could not verify user role"})
-            return
-        }
-
-        if role != "admin" {
-            c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
-            return
-        }
-
-        // Proceed handler if all check are done
-        c.Next()
-    }
-}
\ No newline at end of file
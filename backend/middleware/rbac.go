@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/Zeropeepo/sea-catering-backend/rbac"
+	"github.com/gin-gonic/gin"
+)
+
+// RequirePermission only lets through users whose role grants every one of
+// perms. It runs after AuthMiddleware and puts the role in the context as
+// "role".
+func RequirePermission(roles *rbac.Cache, perms ...rbac.Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, _ := c.Get("userID")
+		role, err := roles.Role(context.Background(), userID.(int))
+		if err != nil {
+			fmt.Printf("Error looking up role of user %v: %v\n", userID, err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Could not verify user role"})
+			return
+		}
+
+		for _, p := range perms {
+			if !role.Can(p) {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "You do not have permission to do this", "permission": p})
+				return
+			}
+		}
+		c.Set("role", role)
+		c.Next()
+	}
+}
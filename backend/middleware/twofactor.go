@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/Zeropeepo/sea-catering-backend/account"
+	"github.com/Zeropeepo/sea-catering-backend/database"
+	"github.com/gin-gonic/gin"
+)
+
+// RequireTwoFactor keeps users whose role must use two-factor
+// authentication, but who have not turned it on, out until they do. It runs
+// after RequirePermission. Setting up two-factor lives outside the admin
+// API, so nobody is locked out of enrolling.
+func RequireTwoFactor() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, _ := c.Get("userID")
+		status, err := account.TwoFactor(context.Background(), database.DB, userID.(int))
+		if err != nil {
+			fmt.Printf("Error fetching two-factor status of user %v: %v\n", userID, err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Could not verify two-factor status"})
+			return
+		}
+		if status.Required && !status.Enabled {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error":             "Two-factor authentication is required for your role. Set it up at /api/2fa/enroll.",
+				"twoFactorRequired": true,
+			})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,36 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/Zeropeepo/sea-catering-backend/account"
+	"github.com/Zeropeepo/sea-catering-backend/database"
+	"github.com/gin-gonic/gin"
+)
+
+// RequireVerifiedEmail stops users who have not verified their email
+// address. It runs after AuthMiddleware. When required is false, as during
+// local development, it lets everyone through.
+func RequireVerifiedEmail(required bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !required {
+			c.Next()
+			return
+		}
+
+		userID, _ := c.Get("userID")
+		verified, err := account.EmailVerified(context.Background(), database.DB, userID.(int))
+		if err != nil {
+			fmt.Printf("Error checking email verification of user %v: %v\n", userID, err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Could not verify email status"})
+			return
+		}
+		if !verified {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Please verify your email address first"})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,48 @@
+package pricing
+
+import "math"
+
+// Fees are what is charged on top of the meals. They are set once at startup.
+type Fees struct {
+	// TaxRate is PPN as a percentage of the subtotal after discounts.
+	TaxRate float64
+	// DeliveryFee is charged for every delivery day, each week of the month.
+	DeliveryFee float64
+	// ServiceFee is a flat charge per month.
+	ServiceFee float64
+}
+
+var fees Fees
+
+func SetFees(f Fees) {
+	fees = f
+}
+
+func CurrentFees() Fees {
+	return fees
+}
+
+// Round rounds an amount to whole rupiah, halves away from zero. Rupiah has
+// no coins below one, and Midtrans rejects amounts that are not whole, so
+// every line of a quote is rounded on its own before it is added up.
+func Round(amount float64) float64 {
+	return math.Round(amount)
+}
+
+// Rupiah converts a rounded amount to what the gateway charges. Converting
+// with int64 directly would truncate amounts that picked up float noise.
+func Rupiah(amount float64) int64 {
+	return int64(Round(amount))
+}
+
+// TaxOn is the tax on a taxable amount at rate percent.
+func TaxOn(taxable, rate float64) float64 {
+	return Round(taxable * rate / 100)
+}
+
+// SplitTax separates the tax contained in an amount that already includes
+// it, such as the difference between two totals.
+func SplitTax(gross, rate float64) (net, tax float64) {
+	net = Round(gross * 100 / (100 + rate))
+	return net, gross - net
+}
@@ -0,0 +1,192 @@
+// Package pricing computes subscription totals on the server so the amount we
+// store and charge never depends on what the client sends.
+package pricing
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/Zeropeepo/sea-catering-backend/delivery"
+)
+
+// WeeksPerMonth is the factor used to turn a weekly delivery schedule into a
+// monthly price. It matches the figure shown on the subscription page.
+const WeeksPerMonth = 4.3
+
+// MealTypes and DeliveryDays list the values a subscription may contain.
+var (
+	MealTypes    = []string{"Breakfast", "Lunch", "Dinner"}
+	DeliveryDays = []string{"Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday", "Sunday"}
+)
+
+var (
+	ErrNoMealTypes        = errors.New("at least one meal type is required")
+	ErrNoDeliveryDays     = errors.New("at least one delivery day is required")
+	ErrInvalidMealType    = errors.New("invalid meal type")
+	ErrInvalidDeliveryDay = errors.New("invalid delivery day")
+	ErrDuplicateMealType  = errors.New("duplicate meal type")
+	ErrDuplicateDay       = errors.New("duplicate delivery day")
+)
+
+// Plan is the part of a catalog plan that affects its price.
+type Plan struct {
+	Name         string
+	PricePerMeal float64
+	MealTypes    []string
+}
+
+// LineItem is one row of an itemized quote.
+type LineItem struct {
+	Code        string  `json:"code"`
+	Description string  `json:"description"`
+	Amount      float64 `json:"amount"`
+}
+
+// Quote is the server-side price of a subscription.
+type Quote struct {
+	PlanName      string     `json:"planName"`
+	PricePerMeal  float64    `json:"pricePerMeal"`
+	MealsPerWeek  int        `json:"mealsPerWeek"`
+	WeeksPerMonth float64    `json:"weeksPerMonth"`
+	Items         []LineItem `json:"items"`
+	Subtotal      float64    `json:"subtotal"`
+	Discounts     []LineItem `json:"discounts"`
+	TaxRate       float64    `json:"taxRate"`
+	Tax           float64    `json:"tax"`
+	Total         float64    `json:"total"`
+}
+
+// Validate returns every problem with a selection, so callers can show them
+// all at once instead of one per round trip.
+func Validate(plan Plan, mealTypes, deliveryDays []string) []error {
+	allowedMeals := plan.MealTypes
+	if len(allowedMeals) == 0 {
+		allowedMeals = MealTypes
+	}
+	var errs []error
+	if err := validateSelection(mealTypes, allowedMeals, ErrNoMealTypes, ErrInvalidMealType, ErrDuplicateMealType); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateSelection(deliveryDays, DeliveryDays, ErrNoDeliveryDays, ErrInvalidDeliveryDay, ErrDuplicateDay); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// Calculate prices a plan for the given meal types and delivery days, with
+// the configured fees and tax. Every amount is in whole rupiah because that
+// is what Midtrans charges.
+func Calculate(plan Plan, mealTypes, deliveryDays []string) (Quote, error) {
+	if errs := Validate(plan, mealTypes, deliveryDays); len(errs) > 0 {
+		return Quote{}, errs[0]
+	}
+
+	mealsPerWeek := len(mealTypes) * len(deliveryDays)
+	items := []LineItem{
+		{
+			Code:        "PLAN",
+			Description: fmt.Sprintf("%s: %d meals/week x %.1f weeks", plan.Name, mealsPerWeek, WeeksPerMonth),
+			Amount:      Round(plan.PricePerMeal * float64(mealsPerWeek) * WeeksPerMonth),
+		},
+	}
+	if fees.DeliveryFee > 0 {
+		items = append(items, LineItem{
+			Code:        "DELIVERY",
+			Description: fmt.Sprintf("Delivery: %d days/week x %.1f weeks", len(deliveryDays), WeeksPerMonth),
+			Amount:      Round(fees.DeliveryFee * float64(len(deliveryDays)) * WeeksPerMonth),
+		})
+	}
+	if fees.ServiceFee > 0 {
+		items = append(items, LineItem{Code: "SERVICE", Description: "Service fee", Amount: Round(fees.ServiceFee)})
+	}
+
+	q := Quote{
+		PlanName:      plan.Name,
+		PricePerMeal:  plan.PricePerMeal,
+		MealsPerWeek:  mealsPerWeek,
+		WeeksPerMonth: WeeksPerMonth,
+		Items:         items,
+		Discounts:     []LineItem{},
+		TaxRate:       fees.TaxRate,
+	}
+	for _, item := range items {
+		q.Subtotal += item.Amount
+	}
+	q.settle()
+	return q, nil
+}
+
+// DiscountTotal is the sum of the quote's discounts.
+func (q Quote) DiscountTotal() float64 {
+	var total float64
+	for _, d := range q.Discounts {
+		total += d.Amount
+	}
+	return total
+}
+
+// settle works out tax and total once the subtotal and discounts are known.
+// Tax is charged on what is left after discounts.
+func (q *Quote) settle() {
+	taxable := q.Subtotal - q.DiscountTotal()
+	q.Tax = TaxOn(taxable, q.TaxRate)
+	q.Total = taxable + q.Tax
+}
+
+// WithDiscount returns the quote with a discount taken off its subtotal,
+// before tax. The discount's Amount is what comes off, so it is positive; it
+// never takes the subtotal below zero.
+func (q Quote) WithDiscount(d LineItem) Quote {
+	d.Amount = math.Min(Round(d.Amount), q.Subtotal-q.DiscountTotal())
+	q.Discounts = append(slices.Clone(q.Discounts), d)
+	q.settle()
+	return q
+}
+
+// Undiscounted returns the quote without its discounts: the regular monthly price.
+func (q Quote) Undiscounted() Quote {
+	q.Discounts = []LineItem{}
+	q.settle()
+	return q
+}
+
+// Matches reports whether a client-supplied total agrees with the quote.
+// A one rupiah tolerance absorbs floating point noise from the browser.
+func (q Quote) Matches(clientTotal float64) bool {
+	return math.Abs(q.Total-clientTotal) <= 1
+}
+
+func validateSelection(values, allowed []string, errEmpty, errInvalid, errDuplicate error) error {
+	if len(values) == 0 {
+		return errEmpty
+	}
+	seen := make(map[string]bool, len(values))
+	for _, v := range values {
+		if !contains(allowed, v) {
+			return fmt.Errorf("%w: %q", errInvalid, v)
+		}
+		if seen[v] {
+			return fmt.Errorf("%w: %q", errDuplicate, v)
+		}
+		seen[v] = true
+	}
+	return nil
+}
+
+func contains(list []string, v string) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
+
+// PauseCredit is the amount owed back for deliveries skipped during a pause.
+// Only days that would actually have had a delivery count.
+func PauseCredit(pricePerMeal float64, mealTypes, deliveryDays []string, pause delivery.Window) float64 {
+	skipped := len(delivery.Dates(deliveryDays, pause.Start, pause.End))
+	return math.Round(pricePerMeal * float64(len(mealTypes)*skipped))
+}
@@ -0,0 +1,277 @@
+// Package promo manages promo codes. A code takes a percentage or a fixed
+// amount off the first billing period of a new subscription. It is reserved
+// when the subscription is created and redeemed once that period is paid.
+// Referral codes are promo codes owned by a customer, who earns credit when
+// someone else's first period is paid with theirs.
+package promo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	Percent = "percent"
+	Fixed   = "fixed"
+)
+
+const (
+	// RedemptionReserved holds a code for a subscription that has not paid yet.
+	RedemptionReserved = "reserved"
+	RedemptionRedeemed = "redeemed"
+)
+
+var (
+	ErrNotFound      = errors.New("promo code not found")
+	ErrDuplicateCode = errors.New("promo code already exists")
+	ErrInvalidCode   = errors.New("invalid promo code")
+
+	ErrInactive              = errors.New("promo code is no longer active")
+	ErrNotStarted            = errors.New("promo code is not valid yet")
+	ErrExpired               = errors.New("promo code has expired")
+	ErrUsedUp                = errors.New("promo code has been fully redeemed")
+	ErrUserLimit             = errors.New("you have already used this promo code")
+	ErrPlanNotEligible       = errors.New("promo code does not apply to this plan")
+	ErrFirstSubscriptionOnly = errors.New("promo code is only for your first subscription")
+	ErrOwnReferral           = errors.New("you cannot use your own referral code")
+)
+
+// DB is satisfied by *pgxpool.Pool and pgx.Tx.
+type DB interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// Code is a promo code. Nil limits and an empty PlanIDs mean no restriction.
+// ReferrerUserID is set on referral codes, to the customer who hands it out.
+type Code struct {
+	ID                    int        `json:"id"`
+	Code                  string     `json:"code"`
+	Description           string     `json:"description"`
+	Kind                  string     `json:"kind"`
+	Value                 float64    `json:"value"`
+	StartsAt              *time.Time `json:"startsAt"`
+	EndsAt                *time.Time `json:"endsAt"`
+	MaxRedemptions        *int       `json:"maxRedemptions"`
+	MaxPerUser            *int       `json:"maxPerUser"`
+	PlanIDs               []int      `json:"planIds"`
+	FirstSubscriptionOnly bool       `json:"firstSubscriptionOnly"`
+	ReferrerUserID        *int       `json:"referrerUserId"`
+	IsActive              bool       `json:"isActive"`
+	CreatedAt             time.Time  `json:"createdAt"`
+	UpdatedAt             time.Time  `json:"updatedAt"`
+}
+
+const columns = `id, code, description, kind, value, starts_at, ends_at, max_redemptions, max_per_user,
+	plan_ids, first_subscription_only, referrer_user_id, is_active, created_at, updated_at`
+
+func scan(row pgx.Row) (Code, error) {
+	var c Code
+	err := row.Scan(&c.ID, &c.Code, &c.Description, &c.Kind, &c.Value, &c.StartsAt, &c.EndsAt, &c.MaxRedemptions, &c.MaxPerUser,
+		&c.PlanIDs, &c.FirstSubscriptionOnly, &c.ReferrerUserID, &c.IsActive, &c.CreatedAt, &c.UpdatedAt)
+	return c, err
+}
+
+// Normalize is how codes are stored and looked up, so customers may type
+// them in any case.
+func Normalize(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// Discount is what the code takes off amount, in whole rupiah and never
+// more than amount itself.
+func (c Code) Discount(amount float64) float64 {
+	d := c.Value
+	if c.Kind == Percent {
+		d = math.Round(amount * c.Value / 100)
+	}
+	return math.Min(math.Round(d), amount)
+}
+
+// Validate checks a code an admin is about to save.
+func (c Code) Validate() error {
+	switch {
+	case c.Code == "" || strings.ContainsAny(c.Code, " \t"):
+		return fmt.Errorf("%w: code must be a single word", ErrInvalidCode)
+	case c.Kind != Percent && c.Kind != Fixed:
+		return fmt.Errorf("%w: kind must be %q or %q", ErrInvalidCode, Percent, Fixed)
+	case c.Value <= 0 || c.Kind == Percent && c.Value > 100:
+		return fmt.Errorf("%w: value out of range", ErrInvalidCode)
+	case c.StartsAt != nil && c.EndsAt != nil && !c.EndsAt.After(*c.StartsAt):
+		return fmt.Errorf("%w: endsAt must be after startsAt", ErrInvalidCode)
+	case c.MaxRedemptions != nil && *c.MaxRedemptions < 1, c.MaxPerUser != nil && *c.MaxPerUser < 1:
+		return fmt.Errorf("%w: limits must be at least 1", ErrInvalidCode)
+	}
+	return nil
+}
+
+// Find looks a code up by what the customer typed.
+func Find(ctx context.Context, db DB, code string) (Code, error) {
+	c, err := scan(db.QueryRow(ctx, `SELECT `+columns+` FROM promo_codes WHERE code = $1`, Normalize(code)))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c, ErrNotFound
+	}
+	return c, err
+}
+
+// Check finds a code and reports whether userID may use it on planID now.
+func Check(ctx context.Context, db DB, code string, userID, planID int) (Code, error) {
+	c, err := Find(ctx, db, code)
+	if err != nil {
+		return c, err
+	}
+	return c, eligible(ctx, db, c, userID, planID, time.Now())
+}
+
+func eligible(ctx context.Context, db DB, c Code, userID, planID int, now time.Time) error {
+	switch {
+	case !c.IsActive:
+		return ErrInactive
+	case c.StartsAt != nil && now.Before(*c.StartsAt):
+		return ErrNotStarted
+	case c.EndsAt != nil && !now.Before(*c.EndsAt):
+		return ErrExpired
+	case len(c.PlanIDs) > 0 && !slices.Contains(c.PlanIDs, planID):
+		return ErrPlanNotEligible
+	case c.ReferrerUserID != nil && *c.ReferrerUserID == userID:
+		return ErrOwnReferral
+	}
+
+	// Reservations only count while their subscription can still be paid for
+	var total, byUser int
+	err := db.QueryRow(ctx, `
+		SELECT COUNT(*), COUNT(*) FILTER (WHERE r.user_id = $2)
+		FROM promo_redemptions r
+		JOIN subscriptions s ON s.id = r.subscription_id
+		WHERE r.promo_code_id = $1 AND (r.status = $3 OR s.status = 'pending')`,
+		c.ID, userID, RedemptionRedeemed).Scan(&total, &byUser)
+	if err != nil {
+		return err
+	}
+	if c.MaxRedemptions != nil && total >= *c.MaxRedemptions {
+		return ErrUsedUp
+	}
+	if c.MaxPerUser != nil && byUser >= *c.MaxPerUser {
+		return ErrUserLimit
+	}
+
+	if c.FirstSubscriptionOnly {
+		var subscribed bool
+		err := db.QueryRow(ctx, `
+			SELECT EXISTS (
+				SELECT 1 FROM subscriptions s
+				WHERE s.user_id = $1 AND (s.status IN ('active', 'paused', 'past_due', 'suspended')
+					OR EXISTS (SELECT 1 FROM subscription_events e WHERE e.subscription_id = s.id AND e.new_status = 'active'))
+			)`, userID).Scan(&subscribed)
+		if err != nil {
+			return err
+		}
+		if subscribed {
+			return ErrFirstSubscriptionOnly
+		}
+	}
+	return nil
+}
+
+// IsRejection reports whether err says a code cannot be used, as opposed to
+// a failure to find out.
+func IsRejection(err error) bool {
+	for _, target := range []error{ErrNotFound, ErrInactive, ErrNotStarted, ErrExpired, ErrUsedUp, ErrUserLimit, ErrPlanNotEligible, ErrFirstSubscriptionOnly, ErrOwnReferral} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// List returns every code, active ones first.
+func List(ctx context.Context, db DB) ([]Code, error) {
+	rows, err := db.Query(ctx, `SELECT `+columns+` FROM promo_codes ORDER BY is_active DESC, created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	codes := make([]Code, 0)
+	for rows.Next() {
+		c, err := scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, c)
+	}
+	return codes, rows.Err()
+}
+
+// Create stores a new code.
+func Create(ctx context.Context, db DB, c Code) (Code, error) {
+	c.Code = Normalize(c.Code)
+	if err := c.Validate(); err != nil {
+		return Code{}, err
+	}
+	return saved(scan(db.QueryRow(ctx, `
+		INSERT INTO promo_codes (code, description, kind, value, starts_at, ends_at, max_redemptions, max_per_user,
+			plan_ids, first_subscription_only, is_active)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		RETURNING `+columns,
+		c.Code, c.Description, c.Kind, c.Value, c.StartsAt, c.EndsAt, c.MaxRedemptions, c.MaxPerUser,
+		planIDs(c.PlanIDs), c.FirstSubscriptionOnly, c.IsActive)))
+}
+
+// Update replaces a code's settings. Reservations already made keep the
+// code, but are discounted by its new terms when their period opens.
+func Update(ctx context.Context, db DB, c Code) (Code, error) {
+	c.Code = Normalize(c.Code)
+	if err := c.Validate(); err != nil {
+		return Code{}, err
+	}
+	return saved(scan(db.QueryRow(ctx, `
+		UPDATE promo_codes
+		SET code = $2, description = $3, kind = $4, value = $5, starts_at = $6, ends_at = $7, max_redemptions = $8,
+			max_per_user = $9, plan_ids = $10, first_subscription_only = $11, is_active = $12, updated_at = now()
+		WHERE id = $1
+		RETURNING `+columns,
+		c.ID, c.Code, c.Description, c.Kind, c.Value, c.StartsAt, c.EndsAt, c.MaxRedemptions,
+		c.MaxPerUser, planIDs(c.PlanIDs), c.FirstSubscriptionOnly, c.IsActive)))
+}
+
+// Deactivate stops a code from being used again. Codes are never deleted so
+// past redemptions keep pointing at them.
+func Deactivate(ctx context.Context, db DB, id int) error {
+	tag, err := db.Exec(ctx, `UPDATE promo_codes SET is_active = false, updated_at = now() WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func saved(c Code, err error) (Code, error) {
+	var pgErr *pgconn.PgError
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return c, ErrNotFound
+	case errors.As(err, &pgErr) && pgErr.Code == "23505":
+		return c, ErrDuplicateCode
+	}
+	return c, err
+}
+
+// planIDs keeps an unrestricted code's plan list from being stored as NULL.
+func planIDs(ids []int) []int {
+	if ids == nil {
+		return []int{}
+	}
+	return ids
+}
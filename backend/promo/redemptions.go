@@ -0,0 +1,155 @@
+package promo
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var ErrNoReservation = errors.New("subscription has no promo code waiting to be redeemed")
+
+// Redemption is one use of a code by a subscription. The discount and
+// billing period are filled in when the first period is opened, and the
+// payment when that period is paid. ReferrerCredit is what the owner of a
+// referral code earned by it.
+type Redemption struct {
+	ID              int64      `json:"id"`
+	PromoCodeID     int        `json:"promoCodeId"`
+	UserID          int        `json:"userId"`
+	SubscriptionID  int        `json:"subscriptionId"`
+	BillingPeriodID *int64     `json:"billingPeriodId"`
+	PaymentID       *int64     `json:"paymentId"`
+	Discount        float64    `json:"discount"`
+	ReferrerCredit  float64    `json:"referrerCredit"`
+	Status          string     `json:"status"`
+	CreatedAt       time.Time  `json:"createdAt"`
+	RedeemedAt      *time.Time `json:"redeemedAt"`
+}
+
+const redemptionColumns = `id, promo_code_id, user_id, subscription_id, billing_period_id, payment_id, discount, referrer_credit, status, created_at, redeemed_at`
+
+func scanRedemption(row pgx.Row) (Redemption, error) {
+	var r Redemption
+	err := row.Scan(&r.ID, &r.PromoCodeID, &r.UserID, &r.SubscriptionID, &r.BillingPeriodID, &r.PaymentID, &r.Discount, &r.ReferrerCredit, &r.Status, &r.CreatedAt, &r.RedeemedAt)
+	return r, err
+}
+
+// Reserve holds a code for a new subscription. The code row stays locked
+// until tx ends, so concurrent subscribers cannot take it past its limits.
+func Reserve(ctx context.Context, tx pgx.Tx, code string, userID, planID, subscriptionID int) (Redemption, error) {
+	c, err := scan(tx.QueryRow(ctx, `SELECT `+columns+` FROM promo_codes WHERE code = $1 FOR UPDATE`, Normalize(code)))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Redemption{}, ErrNotFound
+	}
+	if err != nil {
+		return Redemption{}, err
+	}
+	if err := eligible(ctx, tx, c, userID, planID, time.Now()); err != nil {
+		return Redemption{}, err
+	}
+
+	return scanRedemption(tx.QueryRow(ctx, `
+		INSERT INTO promo_redemptions (promo_code_id, user_id, subscription_id)
+		VALUES ($1, $2, $3)
+		RETURNING `+redemptionColumns, c.ID, userID, subscriptionID))
+}
+
+// Reserved returns the code a subscription has reserved and not yet redeemed.
+func Reserved(ctx context.Context, db DB, subscriptionID int) (Redemption, Code, error) {
+	r, err := scanRedemption(db.QueryRow(ctx, `
+		SELECT `+redemptionColumns+` FROM promo_redemptions
+		WHERE subscription_id = $1 AND status = $2`, subscriptionID, RedemptionReserved))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return r, Code{}, ErrNoReservation
+	}
+	if err != nil {
+		return r, Code{}, err
+	}
+	c, err := scan(db.QueryRow(ctx, `SELECT `+columns+` FROM promo_codes WHERE id = $1`, r.PromoCodeID))
+	return r, c, err
+}
+
+// Attach records which billing period a reservation discounts, and by how much.
+func Attach(ctx context.Context, db DB, redemptionID, periodID int64, discount float64) error {
+	_, err := db.Exec(ctx, `UPDATE promo_redemptions SET billing_period_id = $2, discount = $3 WHERE id = $1`,
+		redemptionID, periodID, discount)
+	return err
+}
+
+// Redeem marks the reservation on a billing period as used once the period
+// is paid. paymentID is nil for a period settled entirely from credit. A
+// referral code earns its owner credit on their newest running subscription;
+// an owner without one earns nothing.
+func Redeem(ctx context.Context, db DB, periodID int64, paymentID *int64) error {
+	var (
+		redemptionID int64
+		referrerID   *int
+	)
+	err := db.QueryRow(ctx, `
+		UPDATE promo_redemptions r SET status = $3, payment_id = $2, redeemed_at = now()
+		FROM promo_codes c
+		WHERE r.billing_period_id = $1 AND r.status = $4 AND c.id = r.promo_code_id
+		RETURNING r.id, c.referrer_user_id`,
+		periodID, paymentID, RedemptionRedeemed, RedemptionReserved).Scan(&redemptionID, &referrerID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil || referrerID == nil || referralReward <= 0 {
+		return err
+	}
+
+	_, err = db.Exec(ctx, `
+		WITH credited AS (
+			UPDATE subscriptions SET credit_balance = credit_balance + $3, updated_at = now()
+			WHERE id = (
+				SELECT id FROM subscriptions
+				WHERE user_id = $2 AND status IN ('active', 'paused', 'past_due', 'suspended')
+				ORDER BY created_at DESC LIMIT 1)
+			RETURNING id)
+		UPDATE promo_redemptions SET referrer_credit = $3, referrer_subscription_id = (SELECT id FROM credited)
+		WHERE id = $1 AND EXISTS (SELECT 1 FROM credited)`,
+		redemptionID, *referrerID, referralReward)
+	return err
+}
+
+// ReverseReferralCredit takes back the credit a referral earned its owner
+// when the period it paid for is refunded. Credit the owner has already
+// spent on a period of their own stays spent; the balance does not go below
+// zero.
+func ReverseReferralCredit(ctx context.Context, db DB, periodID int64) error {
+	_, err := db.Exec(ctx, `
+		WITH reversed AS (
+			UPDATE promo_redemptions r SET referrer_credit = 0
+			FROM (
+				SELECT id, referrer_credit, referrer_subscription_id FROM promo_redemptions
+				WHERE billing_period_id = $1 AND referrer_credit > 0
+				FOR UPDATE) earned
+			WHERE r.id = earned.id
+			RETURNING earned.referrer_credit, earned.referrer_subscription_id)
+		UPDATE subscriptions s
+		SET credit_balance = GREATEST(s.credit_balance - reversed.referrer_credit, 0), updated_at = now()
+		FROM reversed
+		WHERE s.id = reversed.referrer_subscription_id`, periodID)
+	return err
+}
+
+// Redemptions lists the uses of a code, newest first.
+func Redemptions(ctx context.Context, db DB, codeID int) ([]Redemption, error) {
+	rows, err := db.Query(ctx, `SELECT `+redemptionColumns+` FROM promo_redemptions WHERE promo_code_id = $1 ORDER BY created_at DESC`, codeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	redemptions := make([]Redemption, 0)
+	for rows.Next() {
+		r, err := scanRedemption(rows)
+		if err != nil {
+			return nil, err
+		}
+		redemptions = append(redemptions, r)
+	}
+	return redemptions, rows.Err()
+}
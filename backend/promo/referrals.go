@@ -0,0 +1,68 @@
+package promo
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+)
+
+// Referral terms, set at startup
+var (
+	referralPercent float64 = 10
+	referralReward  float64
+)
+
+// SetReferralTerms sets what a referral code takes off a new customer's
+// first month, in percent, and the credit in rupiah its owner earns once
+// that month is paid. Codes already handed out keep their discount.
+func SetReferralTerms(percent, reward float64) {
+	referralPercent = percent
+	referralReward = reward
+}
+
+// ReferralReward is the credit a referral earns its owner.
+func ReferralReward() float64 {
+	return referralReward
+}
+
+// ReferralCode returns the user's referral code, making one the first time
+// it is asked for. It is for first subscriptions only, once per customer.
+func ReferralCode(ctx context.Context, db DB, userID int) (Code, error) {
+	// A new code can clash with an existing one; try a few
+	for range 3 {
+		code, err := newReferralCode()
+		if err != nil {
+			return Code{}, err
+		}
+		c, err := saved(scan(db.QueryRow(ctx, `
+			INSERT INTO promo_codes (code, description, kind, value, max_per_user, first_subscription_only, referrer_user_id)
+			VALUES ($1, 'Referral', $2, $3, 1, true, $4)
+			ON CONFLICT (referrer_user_id) DO UPDATE SET referrer_user_id = EXCLUDED.referrer_user_id
+			RETURNING `+columns, code, Percent, referralPercent, userID)))
+		if !errors.Is(err, ErrDuplicateCode) {
+			return c, err
+		}
+	}
+	return Code{}, ErrDuplicateCode
+}
+
+// Referrals counts the paid first periods that used the user's referral
+// code, leaving out refunded ones, and the credit they earned the user.
+func Referrals(ctx context.Context, db DB, userID int) (count int, credit float64, err error) {
+	err = db.QueryRow(ctx, `
+		SELECT COUNT(*), COALESCE(SUM(r.referrer_credit), 0)
+		FROM promo_redemptions r
+		JOIN promo_codes c ON c.id = r.promo_code_id
+		JOIN billing_periods bp ON bp.id = r.billing_period_id
+		WHERE c.referrer_user_id = $1 AND r.status = $2 AND bp.status <> 'refunded'`, userID, RedemptionRedeemed).Scan(&count, &credit)
+	return count, credit, err
+}
+
+func newReferralCode() (string, error) {
+	b := make([]byte, 5)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "REF" + base32.StdEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,72 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Memory keeps counts in the process. Keys idle for MaxAge are swept out
+// as it goes, at most once a minute.
+type Memory struct {
+	mu        sync.Mutex
+	keys      map[string]State
+	lastSweep time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{keys: make(map[string]State)}
+}
+
+func (m *Memory) Get(ctx context.Context, key string) (State, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.keys[key], nil
+}
+
+func (m *Memory) Hit(ctx context.Context, key string, now, forgetBefore time.Time) (State, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if now.Sub(m.lastSweep) > time.Minute {
+		for k, state := range m.keys {
+			if now.Sub(state.LastHit) > MaxAge {
+				delete(m.keys, k)
+			}
+		}
+		m.lastSweep = now
+	}
+
+	state := m.keys[key]
+	if state.LastHit.Before(forgetBefore) {
+		state = State{}
+	}
+	state.Hits++
+	state.PrevHit, state.LastHit = state.LastHit, now
+	m.keys[key] = state
+	return state, nil
+}
+
+func (m *Memory) Refund(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if state, ok := m.keys[key]; ok && state.Hits > 0 {
+		state.Hits--
+		if state.Hits == 0 {
+			delete(m.keys, key)
+			return nil
+		}
+		if !state.PrevHit.IsZero() {
+			state.LastHit, state.PrevHit = state.PrevHit, time.Time{}
+		}
+		m.keys[key] = state
+	}
+	return nil
+}
+
+func (m *Memory) Reset(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.keys, key)
+	return nil
+}
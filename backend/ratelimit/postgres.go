@@ -0,0 +1,72 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// DB is satisfied by *pgxpool.Pool and pgx.Tx.
+type DB interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// Postgres keeps counts in the rate_limits table, so every instance of the
+// backend sees the same attempts.
+type Postgres struct {
+	db DB
+}
+
+func NewPostgres(db DB) *Postgres {
+	return &Postgres{db: db}
+}
+
+func (p *Postgres) Get(ctx context.Context, key string) (State, error) {
+	var s State
+	err := p.db.QueryRow(ctx, `SELECT hits, last_hit_at FROM rate_limits WHERE bucket = $1`, key).Scan(&s.Hits, &s.LastHit)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return State{}, nil
+	}
+	return s, err
+}
+
+// Hit is a single upsert, so concurrent attempts are all counted.
+func (p *Postgres) Hit(ctx context.Context, key string, now, forgetBefore time.Time) (State, error) {
+	var (
+		s       State
+		prevHit *time.Time
+	)
+	err := p.db.QueryRow(ctx, `
+		INSERT INTO rate_limits (bucket, hits, last_hit_at) VALUES ($1, 1, $2)
+		ON CONFLICT (bucket) DO UPDATE SET
+			hits = CASE WHEN rate_limits.last_hit_at < $3 THEN 1 ELSE rate_limits.hits + 1 END,
+			prev_hit_at = CASE WHEN rate_limits.last_hit_at < $3 THEN NULL ELSE rate_limits.last_hit_at END,
+			last_hit_at = $2
+		RETURNING hits, last_hit_at, prev_hit_at`, key, now, forgetBefore).Scan(&s.Hits, &s.LastHit, &prevHit)
+	if prevHit != nil {
+		s.PrevHit = *prevHit
+	}
+	return s, err
+}
+
+func (p *Postgres) Refund(ctx context.Context, key string) error {
+	_, err := p.db.Exec(ctx, `
+		UPDATE rate_limits SET hits = hits - 1, last_hit_at = COALESCE(prev_hit_at, last_hit_at), prev_hit_at = NULL
+		WHERE bucket = $1 AND hits > 0`, key)
+	return err
+}
+
+func (p *Postgres) Reset(ctx context.Context, key string) error {
+	_, err := p.db.Exec(ctx, `DELETE FROM rate_limits WHERE bucket = $1`, key)
+	return err
+}
+
+// Purge deletes keys that have been idle for MaxAge.
+func (p *Postgres) Purge(ctx context.Context) (int64, error) {
+	tag, err := p.db.Exec(ctx, `DELETE FROM rate_limits WHERE last_hit_at < $1`, time.Now().Add(-MaxAge))
+	return tag.RowsAffected(), err
+}
@@ -0,0 +1,164 @@
+// Package ratelimit slows down repeated attempts, such as password guesses.
+// Every counted attempt on a key makes the next one wait longer, and enough
+// of them lock the key out for a while. Keys are forgotten after a quiet
+// period, or reset explicitly after a success.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Zeropeepo/sea-catering-backend/config"
+)
+
+// MaxAge is how long a store keeps a key that is not hit. Policies forget
+// attempts sooner than this.
+const MaxAge = 24 * time.Hour
+
+// State is what a store knows about a key. PrevHit is the hit before
+// LastHit, kept so a refund can put LastHit back; it is zero when unknown.
+type State struct {
+	Hits    int
+	LastHit time.Time
+	PrevHit time.Time
+}
+
+// Store keeps attempt counts. The memory store suits a single instance; the
+// Postgres store shares counts between instances.
+type Store interface {
+	Get(ctx context.Context, key string) (State, error)
+	// Hit counts an attempt at now, starting over if the previous one was
+	// before forgetBefore.
+	Hit(ctx context.Context, key string, now, forgetBefore time.Time) (State, error)
+	// Refund takes back the latest attempt and puts the time of the last
+	// hit back to the one before it.
+	Refund(ctx context.Context, key string) error
+	Reset(ctx context.Context, key string) error
+}
+
+// StoreFromConfig returns the store selected by RATE_LIMIT_STORE.
+func StoreFromConfig(db DB) (Store, error) {
+	switch name := config.String("RATE_LIMIT_STORE", "memory"); name {
+	case "memory":
+		return NewMemory(), nil
+	case "postgres":
+		return NewPostgres(db), nil
+	default:
+		return nil, fmt.Errorf("unknown RATE_LIMIT_STORE %q", name)
+	}
+}
+
+// Policy says how long a key waits after a number of attempts.
+type Policy struct {
+	// Free attempts cost nothing; each one after that doubles the wait,
+	// starting at BaseDelay and going no higher than MaxDelay.
+	Free      int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// After LockoutAfter attempts the key waits LockoutFor instead.
+	LockoutAfter int
+	LockoutFor   time.Duration
+	// Attempts are forgotten once the key has been quiet this long.
+	ForgetAfter time.Duration
+}
+
+// Delay is the wait that follows the given number of attempts.
+func (p Policy) Delay(hits int) time.Duration {
+	switch {
+	case p.LockoutAfter > 0 && hits >= p.LockoutAfter:
+		return p.LockoutFor
+	case hits < p.Free:
+		return 0
+	}
+	delay := p.BaseDelay
+	for i := p.Free; i < hits && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, p.MaxDelay)
+}
+
+// Limiter applies a policy to the keys of one kind of attempt.
+type Limiter struct {
+	name   string
+	store  Store
+	policy Policy
+}
+
+// New returns a limiter. The name keeps its keys apart from other limiters
+// sharing the store.
+func New(name string, store Store, policy Policy) *Limiter {
+	return &Limiter{name: name, store: store, policy: policy}
+}
+
+// Wait returns how long key must wait before its next attempt.
+func (l *Limiter) Wait(ctx context.Context, key string) (time.Duration, error) {
+	state, err := l.store.Get(ctx, l.name+":"+key)
+	if err != nil {
+		return 0, err
+	}
+	return l.wait(state, time.Now()), nil
+}
+
+// Hit counts an attempt and returns how long key must wait before the next.
+func (l *Limiter) Hit(ctx context.Context, key string) (time.Duration, error) {
+	now := time.Now()
+	state, err := l.store.Hit(ctx, l.name+":"+key, now, now.Add(-l.policy.ForgetAfter))
+	if err != nil {
+		return 0, err
+	}
+	return l.wait(state, now), nil
+}
+
+// Take counts an attempt before it is made and returns how long key must
+// wait; a non-zero wait refuses the attempt, which is then not counted.
+// Counting first means concurrent attempts see each other, where Wait
+// followed by Hit lets all of them through. Give the attempt back with
+// Refund if it turns out not to count, such as a login that succeeds.
+func (l *Limiter) Take(ctx context.Context, key string) (time.Duration, error) {
+	now := time.Now()
+	forgetBefore := now.Add(-l.policy.ForgetAfter)
+	before, err := l.store.Get(ctx, l.name+":"+key)
+	if err != nil {
+		return 0, err
+	}
+	if wait := l.wait(before, now); wait > 0 {
+		return wait, nil
+	}
+	if before.LastHit.Before(forgetBefore) {
+		before.Hits = 0
+	}
+
+	after, err := l.store.Hit(ctx, l.name+":"+key, now, forgetBefore)
+	if err != nil {
+		return 0, err
+	}
+	// Attempts counted since the check raced this one; it waits behind them
+	if after.Hits > before.Hits+1 {
+		if wait := l.policy.Delay(after.Hits - 1); wait > 0 {
+			return wait, l.Refund(ctx, key)
+		}
+	}
+	return 0, nil
+}
+
+// Refund gives back an attempt counted by Take or Hit, so it neither adds to
+// the count nor restarts the wait that earlier attempts earned. Only the
+// latest hit can be taken back exactly: if another attempt was counted after
+// the refunded one, it is that attempt's time that is lost, which can only
+// shorten the wait by one step.
+func (l *Limiter) Refund(ctx context.Context, key string) error {
+	return l.store.Refund(ctx, l.name+":"+key)
+}
+
+// Reset forgets the attempts of key.
+func (l *Limiter) Reset(ctx context.Context, key string) error {
+	return l.store.Reset(ctx, l.name+":"+key)
+}
+
+func (l *Limiter) wait(state State, now time.Time) time.Duration {
+	if state.Hits == 0 || now.Sub(state.LastHit) > l.policy.ForgetAfter {
+		return 0
+	}
+	return max(state.LastHit.Add(l.policy.Delay(state.Hits)).Sub(now), 0)
+}
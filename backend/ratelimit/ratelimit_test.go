@@ -0,0 +1,168 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testPolicy = Policy{
+	Free:         3,
+	BaseDelay:    time.Second,
+	MaxDelay:     10 * time.Second,
+	LockoutAfter: 8,
+	LockoutFor:   15 * time.Minute,
+	ForgetAfter:  time.Hour,
+}
+
+func TestPolicyDelay(t *testing.T) {
+	tests := []struct {
+		name string
+		hits int
+		want time.Duration
+	}{
+		{"no attempts", 0, 0},
+		{"last free attempt", 2, 0},
+		{"first counted attempt", 3, time.Second},
+		{"doubles", 4, 2 * time.Second},
+		{"doubles again", 6, 8 * time.Second},
+		{"capped at MaxDelay", 7, 10 * time.Second},
+		{"locked out", 8, 15 * time.Minute},
+		{"stays locked out", 20, 15 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := testPolicy.Delay(tt.hits); got != tt.want {
+				t.Errorf("Delay(%d) = %v, want %v", tt.hits, got, tt.want)
+			}
+		})
+	}
+
+	noLockout := testPolicy
+	noLockout.LockoutAfter = 0
+	if got := noLockout.Delay(20); got != noLockout.MaxDelay {
+		t.Errorf("Delay(20) without lockout = %v, want %v", got, noLockout.MaxDelay)
+	}
+}
+
+func TestTake(t *testing.T) {
+	tests := []struct {
+		name     string
+		seed     int // hits counted just before the attempt
+		wantWait bool
+		wantHits int
+	}{
+		{"first attempt", 0, false, 1},
+		{"last free attempt", 2, false, 3},
+		{"waits once the free attempts are used", 3, true, 3},
+		{"locked out", 8, true, 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := NewMemory()
+			l := New("login", store, testPolicy)
+			now := time.Now()
+			for i := 0; i < tt.seed; i++ {
+				if _, err := store.Hit(ctx, "login:k", now, now.Add(-time.Hour)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			wait, err := l.Take(ctx, "k")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (wait > 0) != tt.wantWait {
+				t.Errorf("Take waited %v, want wait: %v", wait, tt.wantWait)
+			}
+			state, _ := store.Get(ctx, "login:k")
+			if state.Hits != tt.wantHits {
+				t.Errorf("hits = %d, want %d", state.Hits, tt.wantHits)
+			}
+		})
+	}
+}
+
+func TestTakeConcurrent(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemory()
+	l := New("login", store, testPolicy)
+
+	const callers = 50
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		allowed int
+	)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wait, err := l.Take(ctx, "k")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if wait == 0 {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed < 1 || allowed > testPolicy.Free {
+		t.Errorf("%d of %d concurrent attempts allowed, want 1 to %d", allowed, callers, testPolicy.Free)
+	}
+	state, _ := store.Get(ctx, "login:k")
+	if state.Hits != allowed {
+		t.Errorf("hits = %d, want one per allowed attempt (%d)", state.Hits, allowed)
+	}
+}
+
+func TestTakeRefund(t *testing.T) {
+	tests := []struct {
+		name string
+		seed int // hits counted a minute before the attempts
+	}{
+		{"no earlier attempts", 0},
+		{"one earlier attempt", 1},
+		{"two earlier attempts", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := NewMemory()
+			l := New("login", store, testPolicy)
+			earlier := time.Now().Add(-time.Minute)
+			for i := 0; i < tt.seed; i++ {
+				if _, err := store.Hit(ctx, "login:k", earlier, earlier.Add(-time.Hour)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, _ := store.Get(ctx, "login:k")
+
+			// Refunded attempts, such as successful logins, leave the key as it was
+			for i := 0; i < 5; i++ {
+				wait, err := l.Take(ctx, "k")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if wait > 0 {
+					t.Fatalf("attempt %d waited %v", i, wait)
+				}
+				if err := l.Refund(ctx, "k"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, _ := store.Get(ctx, "login:k")
+			if got.Hits != want.Hits || !got.LastHit.Equal(want.LastHit) {
+				t.Errorf("after refunds: hits %d at %v, want %d at %v", got.Hits, got.LastHit, want.Hits, want.LastHit)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+// Package rbac decides what each user may do. A user has one role, stored
+// in users.role, and each role grants a fixed set of permissions. Handlers
+// ask for permissions, never for roles, so roles can be reshaped here
+// without touching the routes.
+package rbac
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+type Role string
+
+const (
+	Customer     Role = "customer"
+	Admin        Role = "admin"
+	KitchenStaff Role = "kitchen_staff"
+	Courier      Role = "courier"
+	Finance      Role = "finance"
+)
+
+type Permission string
+
+const (
+	// StaffAccess lets a user into the admin API at all; each route also
+	// asks for its own permission.
+	StaffAccess          Permission = "staff:access"
+	DashboardRead        Permission = "dashboard:read"
+	SubscriptionsReadAll Permission = "subscriptions:read_all"
+	SubscriptionsManage  Permission = "subscriptions:manage"
+	PaymentsReadAll      Permission = "payments:read_all"
+	PaymentsRefund       Permission = "payments:refund"
+	InvoicesReadAll      Permission = "invoices:read_all"
+	MenuWrite            Permission = "menu:write"
+	PromosWrite          Permission = "promos:write"
+	JobsRead             Permission = "jobs:read"
+	SecurityRead         Permission = "security:read"
+	SecurityManage       Permission = "security:manage"
+	UsersManageRoles     Permission = "users:manage_roles"
+)
+
+// Roles lists every role with its permissions. Customers need none: what
+// they can do with their own account is checked by ownership instead.
+var Roles = map[Role][]Permission{
+	Customer: {},
+	Admin: {
+		StaffAccess, DashboardRead, SubscriptionsReadAll, SubscriptionsManage, PaymentsReadAll, PaymentsRefund,
+		InvoicesReadAll, MenuWrite, PromosWrite, JobsRead, SecurityRead, SecurityManage, UsersManageRoles,
+	},
+	KitchenStaff: {StaffAccess, SubscriptionsReadAll, MenuWrite},
+	Courier:      {StaffAccess, SubscriptionsReadAll},
+	Finance:      {StaffAccess, DashboardRead, SubscriptionsReadAll, PaymentsReadAll, PaymentsRefund, InvoicesReadAll, PromosWrite},
+}
+
+var (
+	ErrUnknownRole  = errors.New("unknown role")
+	ErrUserNotFound = errors.New("user not found")
+)
+
+// Valid reports whether r is a known role.
+func (r Role) Valid() bool {
+	_, ok := Roles[r]
+	return ok
+}
+
+// Can reports whether the role grants p.
+func (r Role) Can(p Permission) bool {
+	return slices.Contains(Roles[r], p)
+}
+
+// DB is satisfied by *pgxpool.Pool and pgx.Tx.
+type DB interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// Cache remembers user roles for a short while, so checking a permission
+// does not cost a query on every request. A role change made through
+// SetRole shows at once on this instance and within the TTL on others.
+type Cache struct {
+	db  DB
+	ttl time.Duration
+
+	mu    sync.Mutex
+	roles map[int]cachedRole
+}
+
+type cachedRole struct {
+	role    Role
+	expires time.Time
+}
+
+func NewCache(db DB, ttl time.Duration) *Cache {
+	return &Cache{db: db, ttl: ttl, roles: make(map[int]cachedRole)}
+}
+
+// Role returns a user's role.
+func (c *Cache) Role(ctx context.Context, userID int) (Role, error) {
+	now := time.Now()
+	c.mu.Lock()
+	cached, ok := c.roles[userID]
+	c.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.role, nil
+	}
+
+	var role Role
+	err := c.db.QueryRow(ctx, `SELECT role FROM users WHERE id = $1`, userID).Scan(&role)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrUserNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	// Drop expired entries now and then so the map stays the size of the active users
+	if len(c.roles) > 10000 {
+		for id, r := range c.roles {
+			if now.After(r.expires) {
+				delete(c.roles, id)
+			}
+		}
+	}
+	c.roles[userID] = cachedRole{role: role, expires: now.Add(c.ttl)}
+	c.mu.Unlock()
+	return role, nil
+}
+
+// SetRole changes a user's role.
+func (c *Cache) SetRole(ctx context.Context, userID int, role Role) error {
+	if !role.Valid() {
+		return fmt.Errorf("%w %q", ErrUnknownRole, role)
+	}
+	tag, err := c.db.Exec(ctx, `UPDATE users SET role = $2, updated_at = now() WHERE id = $1`, userID, role)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrUserNotFound
+	}
+
+	c.mu.Lock()
+	delete(c.roles, userID)
+	c.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,190 @@
+// Package scheduler runs recurring background jobs inside the backend process.
+//
+// Every replica runs the same scheduler. A job fires at most once per
+// scheduled minute across all of them: the run is claimed by inserting a
+// job_runs row keyed on (job_name, scheduled_for), and a Postgres advisory
+// lock keeps a slow run from overlapping with the next one.
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// JobFunc does the work of a job. It should return promptly once ctx is done.
+type JobFunc func(ctx context.Context) error
+
+type job struct {
+	name     string
+	schedule Schedule
+	run      JobFunc
+
+	mu      sync.Mutex
+	running bool
+}
+
+type Scheduler struct {
+	pool     *pgxpool.Pool
+	instance string
+	jobs     []*job
+
+	cancel context.CancelFunc
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func New(pool *pgxpool.Pool) *Scheduler {
+	instance, _ := os.Hostname()
+	return &Scheduler{pool: pool, instance: fmt.Sprintf("%s/%d", instance, os.Getpid())}
+}
+
+// Register adds a job under a unique name with a cron schedule.
+func (s *Scheduler) Register(name, spec string, run JobFunc) error {
+	schedule, err := Parse(spec)
+	if err != nil {
+		return fmt.Errorf("job %s: %v", name, err)
+	}
+	for _, j := range s.jobs {
+		if j.name == name {
+			return fmt.Errorf("job %s is already registered", name)
+		}
+	}
+	s.jobs = append(s.jobs, &job{name: name, schedule: schedule, run: run})
+	return nil
+}
+
+// Start begins checking the schedules at the top of every minute.
+func (s *Scheduler) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.done = make(chan struct{})
+
+	go func() {
+		defer close(s.done)
+		for {
+			now := time.Now()
+			next := now.Truncate(time.Minute).Add(time.Minute)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(next.Sub(now)):
+			}
+			for _, j := range s.jobs {
+				if j.schedule.Matches(next) {
+					s.dispatch(ctx, j, next)
+				}
+			}
+		}
+	}()
+}
+
+// Stop stops scheduling new runs, cancels the context of running jobs and
+// waits for them to return or for ctx to expire.
+func (s *Scheduler) Stop(ctx context.Context) error {
+	if s.cancel == nil {
+		return nil
+	}
+	s.cancel()
+	<-s.done
+
+	finished := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Scheduler) dispatch(ctx context.Context, j *job, slot time.Time) {
+	j.mu.Lock()
+	if j.running {
+		j.mu.Unlock()
+		fmt.Printf("Scheduler: skipping %s at %s, previous run still in progress\n", j.name, slot.Format(time.RFC3339))
+		return
+	}
+	j.running = true
+	j.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer func() {
+			j.mu.Lock()
+			j.running = false
+			j.mu.Unlock()
+		}()
+		if err := s.execute(ctx, j, slot); err != nil {
+			fmt.Printf("Scheduler: job %s failed: %v\n", j.name, err)
+		}
+	}()
+}
+
+func (s *Scheduler) execute(ctx context.Context, j *job, slot time.Time) (err error) {
+	conn, err := s.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	// Advisory locks belong to the session, so lock and unlock on the same connection
+	key := lockKey(j.name)
+	var locked bool
+	if err := conn.QueryRow(ctx, `SELECT pg_try_advisory_lock($1)`, key).Scan(&locked); err != nil {
+		return err
+	}
+	if !locked {
+		return nil
+	}
+	defer conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, key)
+
+	var runID int64
+	err = conn.QueryRow(ctx, `
+		INSERT INTO job_runs (job_name, scheduled_for, instance)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (job_name, scheduled_for) DO NOTHING
+		RETURNING id`, j.name, slot, s.instance).Scan(&runID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// Another replica already ran this slot
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+		status, message := "succeeded", ""
+		if err != nil {
+			status, message = "failed", err.Error()
+		}
+		_, dbErr := conn.Exec(context.Background(), `
+			UPDATE job_runs SET status = $1, error = $2, finished_at = now() WHERE id = $3`,
+			status, message, runID)
+		if dbErr != nil {
+			fmt.Printf("Scheduler: could not record run %d of %s: %v\n", runID, j.name, dbErr)
+		}
+	}()
+
+	return j.run(ctx)
+}
+
+func lockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("scheduler:" + name))
+	return int64(h.Sum64())
+}
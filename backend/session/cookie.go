@@ -0,0 +1,108 @@
+package session
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Zeropeepo/sea-catering-backend/config"
+)
+
+// Cookie names used in cookie mode. The CSRF cookie is readable by the
+// frontend, which copies it into the X-CSRF-Token header; a cross-site form
+// sends the cookies along but cannot read them, so the two never match.
+const (
+	AccessCookie  = "sea_access"
+	RefreshCookie = "sea_refresh"
+	CSRFCookie    = "sea_csrf"
+)
+
+// The refresh token is only ever sent to the refresh endpoint.
+const refreshCookiePath = "/api/token"
+
+// CookieOptions configure cookie mode, in which tokens travel in HttpOnly
+// cookies instead of the response body and the Authorization header.
+type CookieOptions struct {
+	Enabled  bool
+	Secure   bool
+	SameSite http.SameSite
+	Domain   string
+}
+
+var cookieOptions CookieOptions
+
+func SetCookieOptions(o CookieOptions) {
+	cookieOptions = o
+}
+
+// CookieMode reports whether logins are handed out as cookies.
+func CookieMode() bool {
+	return cookieOptions.Enabled
+}
+
+// CookieOptionsFromConfig reads AUTH_MODE and the cookie settings.
+func CookieOptionsFromConfig() (CookieOptions, error) {
+	o := CookieOptions{
+		Secure: config.Bool("COOKIE_SECURE", true),
+		Domain: config.String("COOKIE_DOMAIN", ""),
+	}
+	switch mode := config.String("AUTH_MODE", "bearer"); mode {
+	case "bearer":
+	case "cookie":
+		o.Enabled = true
+	default:
+		return o, fmt.Errorf("unknown AUTH_MODE %q", mode)
+	}
+	switch sameSite := strings.ToLower(config.String("COOKIE_SAMESITE", "strict")); sameSite {
+	case "strict":
+		o.SameSite = http.SameSiteStrictMode
+	case "lax":
+		o.SameSite = http.SameSiteLaxMode
+	case "none":
+		// Browsers drop SameSite=None cookies that are not Secure
+		if !o.Secure {
+			return o, fmt.Errorf("COOKIE_SAMESITE=none requires COOKIE_SECURE=true")
+		}
+		o.SameSite = http.SameSiteNoneMode
+	default:
+		return o, fmt.Errorf("unknown COOKIE_SAMESITE %q", sameSite)
+	}
+	return o, nil
+}
+
+// Cookies carry a new set of tokens to the browser.
+func Cookies(tokens Tokens) []*http.Cookie {
+	refreshExpires := time.Now().Add(refreshTTL)
+	return []*http.Cookie{
+		cookie(AccessCookie, tokens.AccessToken, "/", tokens.ExpiresAt, true),
+		cookie(RefreshCookie, tokens.RefreshToken, refreshCookiePath, refreshExpires, true),
+		cookie(CSRFCookie, tokens.CSRF, "/", refreshExpires, false),
+	}
+}
+
+// ClearCookies removes the session cookies from the browser.
+func ClearCookies() []*http.Cookie {
+	cookies := []*http.Cookie{
+		cookie(AccessCookie, "", "/", time.Unix(0, 0), true),
+		cookie(RefreshCookie, "", refreshCookiePath, time.Unix(0, 0), true),
+		cookie(CSRFCookie, "", "/", time.Unix(0, 0), false),
+	}
+	for _, c := range cookies {
+		c.MaxAge = -1
+	}
+	return cookies
+}
+
+func cookie(name, value, path string, expires time.Time, httpOnly bool) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Domain:   cookieOptions.Domain,
+		Expires:  expires,
+		Secure:   cookieOptions.Secure,
+		HttpOnly: httpOnly,
+		SameSite: cookieOptions.SameSite,
+	}
+}
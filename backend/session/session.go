@@ -0,0 +1,220 @@
+// Package session keeps track of logins. Each login is a session with a
+// short-lived access token and a refresh token that is replaced every time it
+// is used. Presenting a refresh token that has already been replaced means it
+// was copied, so the whole session is revoked.
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Reasons a session was revoked.
+const (
+	RevokedLogout        = "logout"
+	RevokedLogoutAll     = "logout_all"
+	RevokedReuse         = "refresh_token_reuse"
+	RevokedPasswordReset = "password_reset"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid or expired refresh token")
+	ErrRevoked      = errors.New("session has been revoked")
+	ErrReused       = errors.New("refresh token was already used; the session has been revoked")
+)
+
+var (
+	accessTTL  = 15 * time.Minute
+	refreshTTL = 30 * 24 * time.Hour
+)
+
+// SetLifetimes changes how long access and refresh tokens stay valid.
+func SetLifetimes(access, refresh time.Duration) {
+	accessTTL = access
+	refreshTTL = refresh
+}
+
+// DB is satisfied by *pgxpool.Pool and pgx.Tx.
+type DB interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// TxDB is satisfied by *pgxpool.Pool.
+type TxDB interface {
+	DB
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+// Tokens are handed to the client on login and on every refresh.
+type Tokens struct {
+	AccessToken  string    `json:"token"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+	RefreshToken string    `json:"refreshToken"`
+	CSRF         string    `json:"csrf"`
+}
+
+// Start opens a session for a user who has just proved who they are.
+func Start(ctx context.Context, db TxDB, userID int, userAgent, ip string) (Tokens, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return Tokens{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	var sessionID int64
+	err = tx.QueryRow(ctx, `
+		INSERT INTO sessions (user_id, user_agent, ip_address) VALUES ($1, $2, $3)
+		RETURNING id`, userID, userAgent, ip).Scan(&sessionID)
+	if err != nil {
+		return Tokens{}, err
+	}
+	tokens, err := issue(ctx, tx, sessionID, userID)
+	if err != nil {
+		return Tokens{}, err
+	}
+	return tokens, tx.Commit(ctx)
+}
+
+// Refresh trades a refresh token for a new access and refresh token.
+func Refresh(ctx context.Context, db TxDB, refreshToken string) (Tokens, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return Tokens{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Both rows stay locked, so of two requests with the same token only
+	// the first gets new tokens and the second is treated as reuse.
+	var (
+		tokenID, sessionID int64
+		userID             int
+		expiresAt          time.Time
+		replacedAt         *time.Time
+		revokedAt          *time.Time
+	)
+	err = tx.QueryRow(ctx, `
+		SELECT t.id, t.session_id, s.user_id, t.expires_at, t.replaced_at, s.revoked_at
+		FROM refresh_tokens t JOIN sessions s ON s.id = t.session_id
+		WHERE t.token_hash = $1
+		FOR UPDATE OF t, s`, hash(refreshToken)).Scan(&tokenID, &sessionID, &userID, &expiresAt, &replacedAt, &revokedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Tokens{}, ErrInvalidToken
+	}
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	switch {
+	case revokedAt != nil:
+		return Tokens{}, ErrRevoked
+	case replacedAt != nil:
+		if err := revoke(ctx, tx, sessionID, RevokedReuse); err != nil {
+			return Tokens{}, err
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return Tokens{}, err
+		}
+		return Tokens{}, ErrReused
+	case time.Now().After(expiresAt):
+		return Tokens{}, ErrInvalidToken
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE refresh_tokens SET replaced_at = now() WHERE id = $1`, tokenID); err != nil {
+		return Tokens{}, err
+	}
+	if _, err := tx.Exec(ctx, `UPDATE sessions SET last_used_at = now() WHERE id = $1`, sessionID); err != nil {
+		return Tokens{}, err
+	}
+	tokens, err := issue(ctx, tx, sessionID, userID)
+	if err != nil {
+		return Tokens{}, err
+	}
+	return tokens, tx.Commit(ctx)
+}
+
+// issue creates the next refresh token of a session and an access token to go with it.
+func issue(ctx context.Context, tx pgx.Tx, sessionID int64, userID int) (Tokens, error) {
+	refreshToken, err := randomToken()
+	if err != nil {
+		return Tokens{}, err
+	}
+	_, err = tx.Exec(ctx, `INSERT INTO refresh_tokens (session_id, token_hash, expires_at) VALUES ($1, $2, $3)`,
+		sessionID, hash(refreshToken), time.Now().Add(refreshTTL))
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	tokens, err := newAccessToken(sessionID, userID)
+	tokens.RefreshToken = refreshToken
+	return tokens, err
+}
+
+// Active reports whether a session may still be used.
+func Active(ctx context.Context, db DB, sessionID int64, userID int) (bool, error) {
+	var active bool
+	err := db.QueryRow(ctx, `
+		SELECT EXISTS (SELECT 1 FROM sessions WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL)`,
+		sessionID, userID).Scan(&active)
+	return active, err
+}
+
+// Revoke ends one session of a user.
+func Revoke(ctx context.Context, db DB, sessionID int64, userID int) error {
+	_, err := db.Exec(ctx, `
+		UPDATE sessions SET revoked_at = now(), revoked_reason = $3
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL`, sessionID, userID, RevokedLogout)
+	return err
+}
+
+// RevokeAll ends every session of a user and returns how many there were.
+func RevokeAll(ctx context.Context, db DB, userID int, reason string) (int64, error) {
+	tag, err := db.Exec(ctx, `
+		UPDATE sessions SET revoked_at = now(), revoked_reason = $2
+		WHERE user_id = $1 AND revoked_at IS NULL`, userID, reason)
+	return tag.RowsAffected(), err
+}
+
+func revoke(ctx context.Context, db DB, sessionID int64, reason string) error {
+	_, err := db.Exec(ctx, `
+		UPDATE sessions SET revoked_at = now(), revoked_reason = $2
+		WHERE id = $1 AND revoked_at IS NULL`, sessionID, reason)
+	return err
+}
+
+// Purge deletes refresh tokens that expired before cutoff, then sessions
+// that were revoked before it or have no tokens left.
+func Purge(ctx context.Context, db DB, cutoff time.Time) (int64, error) {
+	if _, err := db.Exec(ctx, `DELETE FROM refresh_tokens WHERE expires_at < $1`, cutoff); err != nil {
+		return 0, err
+	}
+	tag, err := db.Exec(ctx, `
+		DELETE FROM sessions s
+		WHERE s.revoked_at < $1
+			OR (s.created_at < $1 AND NOT EXISTS (SELECT 1 FROM refresh_tokens t WHERE t.session_id = s.id))`, cutoff)
+	return tag.RowsAffected(), err
+}
+
+// Only a hash of each refresh token is stored, so a copy of the table
+// cannot be used to log in. The tokens are random enough that a fast hash
+// is sufficient.
+func hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
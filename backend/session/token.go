@@ -0,0 +1,63 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// Claims are what an access token says about its bearer.
+type Claims struct {
+	UserID    int
+	SessionID int64
+	CSRF      string
+}
+
+func newAccessToken(sessionID int64, userID int) (Tokens, error) {
+	now := time.Now()
+	tokens := Tokens{
+		ExpiresAt: now.Add(accessTTL),
+		CSRF:      uuid.New().String(),
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub":  userID,
+		"sid":  sessionID,
+		"iat":  now.Unix(),
+		"exp":  tokens.ExpiresAt.Unix(),
+		"csrf": tokens.CSRF,
+	})
+	var err error
+	tokens.AccessToken, err = token.SignedString([]byte(os.Getenv("JWT_SECRET")))
+	return tokens, err
+}
+
+// ParseAccessToken checks an access token's signature and expiry. It does
+// not check whether the session is still active; see Active.
+func ParseAccessToken(tokenString string) (Claims, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return []byte(os.Getenv("JWT_SECRET")), nil
+	})
+	if err != nil {
+		return Claims{}, err
+	}
+	mapClaims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return Claims{}, errors.New("could not parse token claims")
+	}
+
+	// Tokens issued before sessions existed carry no sid and cannot be revoked
+	userID, okUser := mapClaims["sub"].(float64)
+	sessionID, okSession := mapClaims["sid"].(float64)
+	if !okUser || !okSession {
+		return Claims{}, errors.New("token has no user or session")
+	}
+	csrf, _ := mapClaims["csrf"].(string)
+	return Claims{UserID: int(userID), SessionID: int64(sessionID), CSRF: csrf}, nil
+}
@@ -10,6 +10,7 @@ import LoginPage from './components/LoginPage';
 import Footer from './components/Footer';
 import UserDashboardPage from './components/UserDashboardPage';
 import AdminDashboardPage from './components/AdminDashboardPage';
+import { authFetch, clearTokens } from './auth';
 
 // UserProfile type remains the same
 type UserProfile = {
@@ -35,9 +36,7 @@ export default function App() {
 
   const fetchUserProfile = async (token: string) => {
     try {
-      const response = await fetch(`${import.meta.env.VITE_DEPLOY_API_URL}/api/me`, {
-        headers: { 'Authorization': `Bearer ${token}` },
-      });
+      const response = await authFetch('/api/me');
       if (!response.ok) {
         handleLogout();
         return; 
@@ -56,8 +55,7 @@ export default function App() {
   };
   
   const handleLogout = () => {
-    localStorage.removeItem('sea-catering-token');
-    localStorage.removeItem('sea-catering-csrf');
+    clearTokens();
     setAuthToken(null);
     setCurrentUser(null);
   };
@@ -0,0 +1,104 @@
+// Session tokens and authenticated requests. Access tokens are short-lived,
+// so requests go through authFetch, which renews the session with the
+// refresh token before the access token runs out or when a request is
+// rejected with 401.
+
+const API_URL = import.meta.env.VITE_DEPLOY_API_URL;
+
+const TOKEN_KEY = 'sea-catering-token';
+const REFRESH_TOKEN_KEY = 'sea-catering-refresh-token';
+const EXPIRES_AT_KEY = 'sea-catering-token-expires-at';
+const CSRF_KEY = 'sea-catering-csrf';
+
+// Refresh this long before the access token expires
+const REFRESH_MARGIN_MS = 30 * 1000;
+
+export type Tokens = {
+  token: string;
+  refreshToken: string;
+  expiresAt: string;
+  csrf: string;
+};
+
+export const getToken = () => localStorage.getItem(TOKEN_KEY);
+
+export const saveTokens = (tokens: Tokens) => {
+  localStorage.setItem(TOKEN_KEY, tokens.token);
+  localStorage.setItem(REFRESH_TOKEN_KEY, tokens.refreshToken);
+  localStorage.setItem(EXPIRES_AT_KEY, String(Date.parse(tokens.expiresAt)));
+  localStorage.setItem(CSRF_KEY, tokens.csrf);
+};
+
+export const clearTokens = () => {
+  localStorage.removeItem(TOKEN_KEY);
+  localStorage.removeItem(REFRESH_TOKEN_KEY);
+  localStorage.removeItem(EXPIRES_AT_KEY);
+  localStorage.removeItem(CSRF_KEY);
+};
+
+// Each refresh token works once, and using one twice revokes the session,
+// so requests that need a new token at the same time share one refresh.
+let refreshing: Promise<string | null> | null = null;
+
+export const refreshTokens = (): Promise<string | null> => {
+  const refreshToken = localStorage.getItem(REFRESH_TOKEN_KEY);
+  if (!refreshToken) {
+    return Promise.resolve(null);
+  }
+  if (!refreshing) {
+    refreshing = (async () => {
+      try {
+        const response = await fetch(`${API_URL}/api/token/refresh`, {
+          method: 'POST',
+          headers: { 'Content-Type': 'application/json', 'X-CSRF-Token': localStorage.getItem(CSRF_KEY) || '' },
+          body: JSON.stringify({ refreshToken }),
+        });
+        if (!response.ok) {
+          // The session is over; the user has to log in again
+          clearTokens();
+          return null;
+        }
+        const tokens: Tokens = await response.json();
+        saveTokens(tokens);
+        return tokens.token;
+      } catch (error) {
+        console.error('Failed to refresh the session:', error);
+        return null;
+      } finally {
+        refreshing = null;
+      }
+    })();
+  }
+  return refreshing;
+};
+
+const withAuth = (init: RequestInit, token: string | null): RequestInit => {
+  const headers = new Headers(init.headers);
+  if (token) {
+    headers.set('Authorization', `Bearer ${token}`);
+  }
+  if (init.method && init.method !== 'GET') {
+    headers.set('X-CSRF-Token', localStorage.getItem(CSRF_KEY) || '');
+  }
+  return { ...init, headers };
+};
+
+// authFetch calls the API with the current access token, refreshing it first
+// if it is about to expire, and once more if the request comes back 401.
+export const authFetch = async (path: string, init: RequestInit = {}): Promise<Response> => {
+  let token = getToken();
+  const expiresAt = Number(localStorage.getItem(EXPIRES_AT_KEY));
+  if (token && expiresAt && expiresAt - Date.now() < REFRESH_MARGIN_MS) {
+    token = (await refreshTokens()) ?? token;
+  }
+
+  const response = await fetch(`${API_URL}${path}`, withAuth(init, token));
+  if (response.status !== 401 || !token) {
+    return response;
+  }
+  const fresh = await refreshTokens();
+  if (!fresh) {
+    return response;
+  }
+  return fetch(`${API_URL}${path}`, withAuth(init, fresh));
+};
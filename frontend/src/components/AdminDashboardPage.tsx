@@ -1,5 +1,6 @@
 import React, { useState, useEffect } from 'react';
 import DatePicker from 'react-datepicker';
+import { authFetch } from '../auth';
 import { DollarSign, Users, TrendingUp, RefreshCw, Calendar as CalendarIcon } from 'lucide-react';
 
 import { Line } from 'react-chartjs-2';
@@ -67,9 +68,7 @@ const AdminDashboardPage = () => {
             const formattedStartDate = startDate.toISOString().split('T')[0];
             const formattedEndDate = endDate.toISOString().split('T')[0];
             try {
-                const response = await fetch(`${import.meta.env.VITE_DEPLOY_API_URL}/api/admin/dashboard-stats?startDate=${formattedStartDate}&endDate=${formattedEndDate}`, {
-                    headers: { 'Authorization': `Bearer ${token}` }
-                });
+                const response = await authFetch(`/api/admin/dashboard-stats?startDate=${formattedStartDate}&endDate=${formattedEndDate}`);
                 if (response.status === 403) throw new Error("Access Denied.");
                 if (!response.ok) throw new Error("Failed to fetch statistics.");
                 const data: AdminStats = await response.json();
@@ -1,6 +1,7 @@
 import React, { useState } from 'react';
 import { Link } from 'react-router-dom';
 import { Eye, EyeOff } from 'lucide-react';
+import { saveTokens } from '../auth';
 
 type LoginPageProps = {
   onLoginSuccess: (token: string) => void;
@@ -35,14 +36,11 @@ const LoginPage = ({ onLoginSuccess }: LoginPageProps) => {
         throw new Error(responseData.error || 'Login failed. Please check your credentials.');
       }
       
-      // If login success, grab and save JWT and CSRF token.
-      const token = responseData.token;
-      const csrfToken = responseData.csrf; 
-      localStorage.setItem('sea-catering-token', token);
-      localStorage.setItem('sea-catering-csrf', csrfToken);
+      // If login success, keep the access and refresh tokens and the CSRF token.
+      saveTokens(responseData);
 
       // Call the onLoginSuccess callback from App.tsx with the token
-      onLoginSuccess(token);
+      onLoginSuccess(responseData.token);
 
     } catch (err) {
       if (err instanceof Error) {
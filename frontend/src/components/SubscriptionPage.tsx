@@ -1,4 +1,5 @@
 import React, { useState, useEffect } from 'react';
+import { authFetch } from '../auth';
 
 // This global declaration is correct for using the Midtrans Snap script.
 declare global {
@@ -80,9 +81,6 @@ const SubscriptionPage = ({ currentUser }: SubscriptionPageProps) => {
     setSubmitStatus(null);
     setStatusMessage('Creating your subscription...');
 
-    const token = localStorage.getItem('sea-catering-token');
-    const csrfToken = localStorage.getItem('sea-catering-csrf');
-
     try {
       // --- Step 1: Create a subscription with "pending" status (Unchanged) ---
       const subData = {
@@ -90,12 +88,10 @@ const SubscriptionPage = ({ currentUser }: SubscriptionPageProps) => {
         selectedDays, allergies, totalPrice
       };
 
-      const subResponse = await fetch(`${import.meta.env.VITE_DEPLOY_API_URL}/api/subscribe`, {
+      const subResponse = await authFetch('/api/subscribe', {
         method: 'POST',
         headers: {
           'Content-Type': 'application/json',
-          'Authorization': `Bearer ${token}`,
-          'X-CSRF-Token': csrfToken || '',
         },
         body: JSON.stringify(subData),
       });
@@ -112,12 +108,8 @@ const SubscriptionPage = ({ currentUser }: SubscriptionPageProps) => {
       // --- Step 2: Create a Midtrans payment transaction (Corrected) ---
       // FIX: Use the correct endpoint with the ID in the URL.
       // FIX: Use a POST request with no body, as the backend handles it.
-      const paymentResponse = await fetch(`${import.meta.env.VITE_DEPLOY_API_URL}/api/subscriptions/${subscriptionId}/create-payment`, {
+      const paymentResponse = await authFetch(`/api/subscriptions/${subscriptionId}/create-payment`, {
           method: 'POST',
-          headers: {
-              'Authorization': `Bearer ${token}`,
-              'X-CSRF-Token': csrfToken || '',
-          },
       });
 
       if (!paymentResponse.ok) throw new Error('Failed to create payment transaction.');
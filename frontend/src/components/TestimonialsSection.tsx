@@ -1,6 +1,7 @@
 import React, { useState, useEffect } from 'react';
 import { Link } from 'react-router-dom'; // MODIFIED: Import Link for navigation
 import StarRating from './StarRating';
+import { authFetch } from '../auth';
 import { ChevronLeft, ChevronRight } from 'lucide-react';
 
 // --- Data Structures ---
@@ -75,15 +76,10 @@ const TestimonialsSection = ({ currentUser }: TestimonialsSectionProps) => {
     };
 
     try {
-        const token = localStorage.getItem('sea-catering-token');
-        const csrfToken = localStorage.getItem('sea-catering-csrf');
-
-        const response = await fetch(`${import.meta.env.VITE_DEPLOY_API_URL}/api/testimonials`, {
+        const response = await authFetch('/api/testimonials', {
             method: 'POST',
             headers: { 
                 'Content-Type': 'application/json',
-                'Authorization': `Bearer ${token}`,
-                'X-CSRF-Token': csrfToken || '',
             },
             body: JSON.stringify(submissionData),
         });
@@ -3,6 +3,7 @@
 import { useState, useEffect } from 'react';
 import { Sparkles, CreditCard } from 'lucide-react'; // Import a nice icon for the AI and Pay buttons
 import Modal from './Modal';
+import { authFetch } from '../auth';
 
 // This global declaration is correct for using the Midtrans Snap script.
 // Add this to your file if it's not already there.
@@ -28,6 +29,7 @@ type Subscription = {
     deliveryDays: string[];
     totalPrice: number;
     status: string;
+    currentPeriodEnd: string | null;
 };
 
 // Type for our AI recommendation results from the Gemini API
@@ -62,9 +64,7 @@ const UserDashboardPage = () => {
         return;
       }
       try {
-        const response = await fetch(`${import.meta.env.VITE_DEPLOY_API_URL}/api/subscriptions`, {
-          headers: { 'Authorization': `Bearer ${token}` }
-        });
+        const response = await authFetch('/api/subscriptions');
         if (!response.ok) {
           throw new Error('Failed to fetch subscriptions. Please try again later.');
         }
@@ -85,13 +85,21 @@ const UserDashboardPage = () => {
     if (!window.confirm(`Are you sure you want to ${newStatus} this subscription?`)) {
         return;
     }
-    const token = localStorage.getItem('sea-catering-token');
-    const csrfToken = localStorage.getItem('sea-catering-csrf');
+    // Pausing needs a date range; the backend resumes the subscription when it ends
+    let pauseWindow = {};
+    if (newStatus === 'paused') {
+        const pauseStart = window.prompt('Pause from (YYYY-MM-DD):', new Date().toISOString().slice(0, 10));
+        const pauseEnd = pauseStart && window.prompt('Pause until (YYYY-MM-DD):', pauseStart);
+        if (!pauseStart || !pauseEnd) {
+            return;
+        }
+        pauseWindow = { pauseStart, pauseEnd };
+    }
     try {
-        const response = await fetch(`${import.meta.env.VITE_DEPLOY_API_URL}/api/subscriptions/${subscriptionId}/status`, {
+        const response = await authFetch(`/api/subscriptions/${subscriptionId}/status`, {
             method: 'PUT',
-            headers: { 'Content-Type': 'application/json', 'Authorization': `Bearer ${token}`, 'X-CSRF-Token': csrfToken || '' },
-            body: JSON.stringify({ status: newStatus }),
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ status: newStatus, ...pauseWindow }),
         });
         if (!response.ok) {
             const errorData = await response.json();
@@ -107,16 +115,10 @@ const UserDashboardPage = () => {
   // --- NEW: Function to handle payment for a pending subscription ---
   const handlePayNow = async (subscriptionId: number) => {
     setIsPaying(subscriptionId);
-    const token = localStorage.getItem('sea-catering-token');
-    const csrfToken = localStorage.getItem('sea-catering-csrf');
 
     try {
-      const paymentResponse = await fetch(`${import.meta.env.VITE_DEPLOY_API_URL}/api/subscriptions/${subscriptionId}/create-payment`, {
+      const paymentResponse = await authFetch(`/api/subscriptions/${subscriptionId}/create-payment`, {
         method: 'POST',
-        headers: {
-          'Authorization': `Bearer ${token}`,
-          'X-CSRF-Token': csrfToken || '',
-        },
       });
 
       if (!paymentResponse.ok) {
@@ -160,16 +162,11 @@ const UserDashboardPage = () => {
     setAiError(null);
     setRecommendations([]);
 
-    const token = localStorage.getItem('sea-catering-token');
-    const csrfToken = localStorage.getItem('sea-catering-csrf');
-
     try {
-      const response = await fetch(`${import.meta.env.VITE_DEPLOY_API_URL}/api/subscriptions/${subscriptionId}/ai-recommendation`, {
+      const response = await authFetch(`/api/subscriptions/${subscriptionId}/ai-recommendation`, {
         method: 'POST',
         headers: {
           'Content-Type': 'application/json',
-          'Authorization': `Bearer ${token}`,
-          'X-CSRF-Token': csrfToken || '',
         },
         body: JSON.stringify({ subscriptionId: subscriptionId }),
       });
@@ -216,22 +213,26 @@ const UserDashboardPage = () => {
                                   sub.status === 'active' ? 'bg-green-100 text-green-800' :
                                   sub.status === 'paused' ? 'bg-yellow-100 text-yellow-800' :
                                   sub.status === 'pending' ? 'bg-blue-100 text-blue-800' : // Style for pending
+                                  sub.status === 'past_due' ? 'bg-orange-100 text-orange-800' :
                                   'bg-red-100 text-red-800'
                               }`}>
-                                  {sub.status}
+                                  {sub.status.replace('_', ' ')}
                               </span>
                           </div>
                           <div className="mt-4 pt-4 border-t">
                               <p><strong>Total Price:</strong> {formatPrice(sub.totalPrice)} / month</p>
                               <p><strong>Meal Types:</strong> {sub.mealTypes.join(', ')}</p>
                               <p><strong>Delivery Days:</strong> {sub.deliveryDays.join(', ')}</p>
+                              {sub.currentPeriodEnd && (
+                                <p><strong>Paid Until:</strong> {new Date(sub.currentPeriodEnd).toLocaleDateString('id-ID')}</p>
+                              )}
                           </div>
 
                           <div className="mt-6 flex flex-wrap items-center gap-4">
                               {/* --- MODIFIED BUTTONS AREA --- */}
 
-                              {/* PAY NOW button for pending subscriptions */}
-                              {sub.status === 'pending' && (
+                              {/* PAY NOW button for pending and unpaid renewals */}
+                              {(sub.status === 'pending' || sub.status === 'past_due' || sub.status === 'suspended') && (
                                 <button 
                                   onClick={() => handlePayNow(sub.id)}
                                   disabled={isPaying === sub.id}
@@ -247,7 +248,7 @@ const UserDashboardPage = () => {
                               {sub.status === 'active' && <button onClick={() => handleUpdateStatus(sub.id, 'paused')} className="bg-yellow-500 text-white px-4 py-2 rounded-md font-semibold hover:bg-yellow-600">Pause</button>}
                               
                               {/* Cancel button */}
-                              {(sub.status === 'active' || sub.status === 'paused' || sub.status === 'pending') && (
+                              {(sub.status === 'active' || sub.status === 'paused' || sub.status === 'pending' || sub.status === 'past_due' || sub.status === 'suspended') && (
                                 <button onClick={() => handleUpdateStatus(sub.id, 'cancelled')} className="bg-red-600 text-white px-4 py-2 rounded-md font-semibold hover:bg-red-700">Cancel</button>
                               )}
 